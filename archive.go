@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Variables of archive key templates that change with every upload.
+const (
+	archiveTime = "time"   // Upload time in UTC, such as 2026-10-16T10:00:00Z
+	archiveHash = "sha256" // Hex encoded SHA-256 of the uploaded content
+)
+
+// archiveTimeFormat formats the {time} variable. Its keys sort by time.
+const archiveTimeFormat = "2006-01-02T15:04:05Z"
+
+// archiveVariable matches a variable in an archive key template.
+var archiveVariable = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// ArchiveConfig configures archive mode, where every upload of a watched file
+// goes to a new key instead of overwriting the previous one.
+type ArchiveConfig struct {
+	Key       string // Template of the archive keys, archive mode is off if empty
+	LatestKey string // Optional key kept as a copy of the newest archive
+	Retention int    // Number of archives kept, 0 keeps all of them
+}
+
+// archiveSegment is a literal part or a variable of an archive key template.
+type archiveSegment struct {
+	text     string // Literal text, used if variable is empty
+	variable string // archiveTime or archiveHash
+}
+
+// archiver gives every upload its own key and prunes old archives. All
+// methods are safe to call on a nil *archiver, which leaves keys alone.
+type archiver struct {
+	config   ArchiveConfig
+	segments []archiveSegment
+	pattern  *regexp.Regexp // Matches the keys of archives
+	prefix   string         // Literal start of every archive key, used to list them
+
+	mu sync.Mutex // Serialises pruning
+}
+
+// parseArchiveKey parses an archive key template for the watched localFile,
+// mirrored to keyPrefix. {key}, {name} and {ext} are replaced right away by
+// the key prefix and the file's base name without its extension, and by the
+// extension itself. {time} and {sha256} are left for every upload, and at
+// least one of them must be used so that uploads do not share a key.
+func parseArchiveKey(template, localFile, keyPrefix string) ([]archiveSegment, error) {
+	ext := filepath.Ext(localFile)
+	static := map[string]string{
+		"key":  strings.TrimSuffix(strings.TrimSuffix(keyPrefix, "/"), ext),
+		"name": strings.TrimSuffix(filepath.Base(localFile), ext),
+		"ext":  ext,
+	}
+
+	var segments []archiveSegment
+	literal := func(text string) {
+		if n := len(segments); n > 0 && segments[n-1].variable == "" {
+			segments[n-1].text += text
+		} else if text != "" {
+			segments = append(segments, archiveSegment{text: text})
+		}
+	}
+	unique := false
+	last := 0
+	for _, match := range archiveVariable.FindAllStringSubmatchIndex(template, -1) {
+		literal(template[last:match[0]])
+		last = match[1]
+		name := template[match[2]:match[3]]
+		switch name {
+		case archiveTime, archiveHash:
+			segments = append(segments, archiveSegment{variable: name})
+			unique = true
+		case "key", "name", "ext":
+			literal(static[name])
+		default:
+			return nil, fmt.Errorf("invalid archive key %q: unknown variable {%s}", template, name)
+		}
+	}
+	literal(template[last:])
+
+	if !unique {
+		return nil, fmt.Errorf("invalid archive key %q: must contain {%s} or {%s}", template, archiveTime, archiveHash)
+	}
+	return segments, nil
+}
+
+// archivePattern returns a regular expression matching every key the
+// segments can expand to.
+func archivePattern(segments []archiveSegment) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, s := range segments {
+		switch s.variable {
+		case archiveTime:
+			b.WriteString(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
+		case archiveHash:
+			b.WriteString(`[0-9a-f]{64}`)
+		default:
+			b.WriteString(regexp.QuoteMeta(s.text))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// EnableArchive uploads the watched localFile to a new key made from the
+// config's template every time, instead of to keyPrefix.
+func (p *UploadWorkerPool) EnableArchive(config ArchiveConfig, localFile, keyPrefix string) error {
+	segments, err := parseArchiveKey(config.Key, localFile, keyPrefix)
+	if err != nil {
+		return err
+	}
+	a := &archiver{
+		config:   config,
+		segments: segments,
+		pattern:  archivePattern(segments),
+	}
+	// The latest key would otherwise be pruned like an archive.
+	if config.LatestKey != "" && a.pattern.MatchString(config.LatestKey) {
+		return fmt.Errorf("--archive-latest-key %s must not look like an archive key", config.LatestKey)
+	}
+	if segments[0].variable == "" {
+		a.prefix = segments[0].text
+	}
+	// Pruning lists the archives by their literal start, and would otherwise
+	// list, and may delete from, the whole bucket.
+	if config.Retention > 0 && a.prefix == "" {
+		return fmt.Errorf("--archive-retention requires --archive-key %s to start with literal text, such as {key}/", config.Key)
+	}
+	p.archive = a
+	return nil
+}
+
+// keyFor returns the key of an archive of localFile uploaded at now, or key
+// if archive mode is off.
+func (a *archiver) keyFor(localFile, key string, now time.Time) (string, error) {
+	if a == nil {
+		return key, nil
+	}
+	var b strings.Builder
+	for _, s := range a.segments {
+		switch s.variable {
+		case archiveTime:
+			b.WriteString(now.UTC().Format(archiveTimeFormat))
+		case archiveHash:
+			sum, err := sha256File(localFile)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(sum)
+		default:
+			b.WriteString(s.text)
+		}
+	}
+	return b.String(), nil
+}
+
+// rotate points the latest key at a new archive and prunes the archives
+// beyond the retention count. The archive has already been uploaded, so
+// failures are only logged.
+func (a *archiver) rotate(ctx context.Context, p *UploadWorkerPool, key string) {
+	if a == nil {
+		return
+	}
+	if a.config.LatestKey != "" {
+		_, err := p.uploader.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:       aws.String(p.bucket),
+			Key:          aws.String(a.config.LatestKey),
+			CopySource:   aws.String(copySource(p.bucket, key)),
+			StorageClass: p.storageClass,
+		})
+		if err != nil {
+			slog.Error("Failed to update latest archive", "bucket", p.bucket, "key", a.config.LatestKey, "source", key, "error", err)
+		} else {
+			slog.Info("Updated latest archive", "bucket", p.bucket, "key", a.config.LatestKey, "source", key)
+		}
+	}
+	if a.config.Retention > 0 {
+		if err := a.prune(ctx, p); err != nil {
+			slog.Error("Failed to prune archives", "bucket", p.bucket, "prefix", a.prefix, "error", err)
+		}
+	}
+}
+
+// prune deletes all but the newest config.Retention archives.
+func (a *archiver) prune(ctx context.Context, p *UploadWorkerPool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var archives []types.Object
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(p.bucket),
+		Prefix: aws.String(a.prefix),
+	}
+	for {
+		output, err := p.uploader.ListObjectsV2(ctx, input)
+		if err != nil {
+			return fmt.Errorf("could not list archives: %w", err)
+		}
+		for _, obj := range output.Contents {
+			if a.pattern.MatchString(aws.ToString(obj.Key)) {
+				archives = append(archives, obj)
+			}
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+	if len(archives) <= a.config.Retention {
+		return nil
+	}
+
+	// Newest first. Archives uploaded within the same second are ordered by
+	// key, which is also their order in time for {time} keys.
+	sort.Slice(archives, func(i, j int) bool {
+		ti, tj := aws.ToTime(archives[i].LastModified), aws.ToTime(archives[j].LastModified)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return aws.ToString(archives[i].Key) > aws.ToString(archives[j].Key)
+	})
+	for _, obj := range archives[a.config.Retention:] {
+		key := aws.ToString(obj.Key)
+		start := time.Now()
+		output, err := p.uploader.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(p.bucket),
+			Key:    aws.String(key),
+		})
+		result := JobResult{Op: opDelete, Key: key, Duration: time.Since(start), Err: err}
+		if err == nil {
+			result.VersionID = aws.ToString(output.VersionId)
+		}
+		// Pruned archives are reported to the sinks like the pool's own jobs.
+		p.publish(result)
+		if err != nil {
+			return fmt.Errorf("could not delete archive %s: %w", key, err)
+		}
+		p.forgetETag(key)
+		slog.Info("Pruned archive", "op", opDelete.String(), "bucket", p.bucket, "key", key, "duration", result.Duration)
+	}
+	return nil
+}
+
+// copySource returns the URL encoded CopySource of an object. S3 decodes "+"
+// in it as a plus sign, so spaces are encoded as "%20". Objects in access
+// points are named by the access point's ARN followed by "/object/".
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
+	}
+	if strings.HasPrefix(bucket, "arn:") {
+		return bucket + "/object/" + strings.Join(segments, "/")
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
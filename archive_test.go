@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newArchivePool creates a pool archiving report.csv mirrored to
+// reports/daily.csv.
+func newArchivePool(t *testing.T, config ArchiveConfig) (*UploadWorkerPool, *MockS3Uploader, string) {
+	t.Helper()
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	t.Cleanup(pool.Shutdown)
+	localFile := filepath.Join(t.TempDir(), "report.csv")
+	require.NoError(t, pool.EnableArchive(config, localFile, "reports/daily.csv"))
+	return pool, mockUploader, localFile
+}
+
+func TestParseArchiveKey(t *testing.T) {
+	now := time.Date(2026, 10, 16, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	localFile := filepath.Join(t.TempDir(), "report.csv")
+	require.NoError(t, os.WriteFile(localFile, []byte("1,2"), 0644))
+	sum, err := sha256File(localFile)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		template string
+		want     string
+		prefix   string
+	}{
+		{"{key}/{time}{ext}", "reports/daily/2026-10-16T08:00:00Z.csv", "reports/daily/"},
+		{"archive/{name}-{sha256}{ext}", "archive/report-" + sum + ".csv", "archive/report-"},
+		{"{time}/{name}", "2026-10-16T08:00:00Z/report", ""},
+	}
+	for _, tc := range testCases {
+		pool := NewUploadWorkerPool(newMockS3Uploader(), "test-bucket", types.StorageClassStandard, 1)
+		require.NoError(t, pool.EnableArchive(ArchiveConfig{Key: tc.template}, localFile, "reports/daily.csv"), tc.template)
+		key, err := pool.archive.keyFor(localFile, "reports/daily.csv", now)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, key, tc.template)
+		assert.Equal(t, tc.prefix, pool.archive.prefix, tc.template)
+		assert.True(t, pool.archive.pattern.MatchString(key), tc.template)
+		pool.Shutdown()
+	}
+
+	for template, msg := range map[string]string{
+		"{key}/latest{ext}":     "must contain {time} or {sha256}",
+		"{key}/{date}{ext}":     "unknown variable {date}",
+		"{key}/{time}{ext}{}":   "unknown variable {}",
+		"{name}-{sha256}{ext}/": "",
+	} {
+		_, err := parseArchiveKey(template, localFile, "reports/daily.csv")
+		if msg == "" {
+			assert.NoError(t, err, template)
+		} else {
+			assert.ErrorContains(t, err, msg, template)
+		}
+	}
+
+	var nilArchiver *archiver
+	key, err := nilArchiver.keyFor(localFile, "reports/daily.csv", now)
+	require.NoError(t, err)
+	assert.Equal(t, "reports/daily.csv", key, "Keys are left alone outside archive mode")
+}
+
+func TestUploadWorkerPool_archive(t *testing.T) {
+	t.Run("Uploads go to new keys and update the latest key", func(t *testing.T) {
+		pool, mockUploader, localFile := newArchivePool(t, ArchiveConfig{
+			Key:       "{key}/{sha256}{ext}",
+			LatestKey: "reports/daily.csv",
+		})
+		require.NoError(t, os.WriteFile(localFile, []byte("1,2"), 0644))
+		first := uploadNow(t, pool, localFile, "reports/daily.csv")
+		require.NoError(t, first.Err)
+		require.NoError(t, os.WriteFile(localFile, []byte("3,4"), 0644))
+		second := uploadNow(t, pool, localFile, "reports/daily.csv")
+		require.NoError(t, second.Err)
+
+		assert.NotEqual(t, first.Key, second.Key)
+		assert.True(t, strings.HasPrefix(second.Key, "reports/daily/"), second.Key)
+		assert.Equal(t, "1,2", mockUploader.Bodies[first.Key])
+		assert.Equal(t, "3,4", mockUploader.Bodies[second.Key])
+		assert.Equal(t, "3,4", mockUploader.Bodies["reports/daily.csv"])
+		assert.Equal(t, "test-bucket/"+second.Key, aws.ToString(mockUploader.Copies["reports/daily.csv"].CopySource))
+		assert.NotContains(t, mockUploader.Uploads, "reports/daily.csv", "The latest key is copied, not uploaded")
+	})
+
+	t.Run("Archives beyond the retention count are pruned", func(t *testing.T) {
+		pool, mockUploader, localFile := newArchivePool(t, ArchiveConfig{
+			Key:       "{key}/{time}{ext}",
+			LatestKey: "reports/daily.csv",
+			Retention: 2,
+		})
+		recorder := &eventRecorder{}
+		pool.AddEventSink(recorder)
+		old := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+		for i, key := range []string{"reports/daily/2026-10-14T10:00:00Z.csv", "reports/daily/2026-10-15T10:00:00Z.csv"} {
+			putRemote(t, mockUploader, key, "old")
+			mockUploader.Objects[len(mockUploader.Objects)-1].LastModified = aws.Time(old.Add(time.Duration(i) * 24 * time.Hour))
+		}
+		putRemote(t, mockUploader, "reports/daily/notes.txt", "not an archive")
+
+		require.NoError(t, os.WriteFile(localFile, []byte("new"), 0644))
+		result := uploadNow(t, pool, localFile, "reports/daily.csv")
+		require.NoError(t, result.Err)
+
+		assert.Equal(t, map[string]string{
+			"reports/daily/2026-10-15T10:00:00Z.csv": "old",
+			result.Key:                               "new",
+			"reports/daily/notes.txt":                "not an archive",
+			"reports/daily.csv":                      "new",
+		}, mockUploader.Bodies)
+		assert.Contains(t, mockUploader.Deletes, "reports/daily/2026-10-14T10:00:00Z.csv")
+
+		pool.Shutdown()
+		assert.Equal(t, []string{"reports/daily/2026-10-14T10:00:00Z.csv", result.Key}, recorder.uploaded(),
+			"Pruned archives are published before their replacement")
+	})
+
+	t.Run("The latest key must not be pruned", func(t *testing.T) {
+		pool := NewUploadWorkerPool(newMockS3Uploader(), "test-bucket", types.StorageClassStandard, 1)
+		defer pool.Shutdown()
+		err := pool.EnableArchive(ArchiveConfig{Key: "{key}/{time}{ext}", LatestKey: "reports/daily/2026-10-16T10:00:00Z.csv"},
+			"report.csv", "reports/daily.csv")
+		assert.ErrorContains(t, err, "must not look like an archive key")
+	})
+
+	t.Run("Pruning requires a literal start of the archive keys", func(t *testing.T) {
+		pool := NewUploadWorkerPool(newMockS3Uploader(), "test-bucket", types.StorageClassStandard, 1)
+		defer pool.Shutdown()
+		err := pool.EnableArchive(ArchiveConfig{Key: "{time}/{name}", Retention: 2}, "report.csv", "reports/daily.csv")
+		assert.ErrorContains(t, err, "to start with literal text")
+		assert.Nil(t, pool.archive)
+
+		require.NoError(t, pool.EnableArchive(ArchiveConfig{Key: "{time}/{name}"}, "report.csv", "reports/daily.csv"),
+			"Archives are only listed when pruning")
+		require.NoError(t, pool.EnableArchive(ArchiveConfig{Key: "{name}/{time}", Retention: 2}, "report.csv", "reports/daily.csv"))
+		assert.Equal(t, "report/", pool.archive.prefix)
+	})
+}
+
+func TestCopySource(t *testing.T) {
+	assert.Equal(t, "bucket/reports/2026-10-16T10%3A00%3A00Z.csv", copySource("bucket", "reports/2026-10-16T10:00:00Z.csv"))
+	assert.Equal(t, "bucket/a%20b/c%3Fd", copySource("bucket", "a b/c?d"))
+	assert.Equal(t, "arn:aws:s3:us-west-2:123456789012:accesspoint/exports/object/daily/a%20b.csv",
+		copySource("arn:aws:s3:us-west-2:123456789012:accesspoint/exports", "daily/a b.csv"))
+}
+
+func TestParseFlags_Archive(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	parse := func(args ...string) (*AppConfig, error) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		os.Args = append(append([]string{"echos3"}, args...), "local/path", "s3://bucket/key")
+		_, config, _, err := parseFlags()
+		return config, err
+	}
+
+	config, err := parse("--archive-key", "{key}/{time}{ext}", "--archive-latest-key", "key", "--archive-retention", "7")
+	require.NoError(t, err)
+	assert.Equal(t, ArchiveConfig{Key: "{key}/{time}{ext}", LatestKey: "key", Retention: 7}, config.Archive)
+
+	for _, args := range [][]string{
+		{"--archive-retention", "7"},
+		{"--archive-latest-key", "key"},
+		{"--archive-key", "{key}/{time}", "--archive-retention", "-1"},
+		{"--archive-key", "{key}/{time}", "--delete"},
+		{"--archive-key", "{key}/{time}", "--direction", "pull"},
+	} {
+		_, err := parse(args...)
+		assert.Error(t, err, "%v", args)
+	}
+}
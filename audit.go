@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// auditLog is an EventSink that appends a JSON line to a file for every
+// upload and delete, successful or not.
+type auditLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// EnableChecksums has S3 compute and verify a SHA-256 checksum of every
+// upload, which is reported in the job results.
+func (p *UploadWorkerPool) EnableChecksums() {
+	p.checksums = true
+}
+
+// openAuditLog opens an audit log for appending, creating it if needed.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	return &auditLog{path: path, file: file}, nil
+}
+
+// Publish appends an upload or delete event to the log.
+func (l *auditLog) Publish(event Event) {
+	if event.Op != opUpload.String() && event.Op != opDelete.String() {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Could not encode audit record", "path", l.path, "key", event.Key, "error", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Could not write audit record", "path", l.path, "key", event.Key, "error", err)
+	}
+}
+
+// Close flushes the log to disk and closes it.
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAuditLog returns the records in an audit log.
+func readAuditLog(t *testing.T, path string) []Event {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	app, _, tmpDir := newTestApp(t, true, true)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	require.NoError(t, err)
+	app.workerPool.AddEventSink(audit)
+	app.workerPool.EnableChecksums()
+
+	localFile := filepath.Join(tmpDir, "a.txt")
+	writeLocal(t, localFile, "audited")
+	uploadNow(t, app.workerPool, localFile, "test-prefix/a.txt")
+	app.handleRemove(context.Background(), "test-prefix/a.txt")
+	app.workerPool.publish(JobResult{Op: opDownload, Key: "test-prefix/b.txt"})
+	app.workerPool.Shutdown()
+
+	events := readAuditLog(t, path)
+	require.Len(t, events, 2, "Downloads are not audited")
+
+	upload := events[0]
+	sum := sha256.Sum256([]byte("audited"))
+	assert.Equal(t, opUpload.String(), upload.Op)
+	assert.Equal(t, eventSuccess, upload.Status)
+	assert.Equal(t, "test-prefix/a.txt", upload.Key)
+	assert.Equal(t, int64(len("audited")), upload.Size)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), upload.Checksum)
+	assert.NotEmpty(t, upload.ETag)
+	assert.WithinDuration(t, time.Now(), upload.Time, time.Minute)
+
+	assert.Equal(t, opDelete.String(), events[1].Op, "Deletes made while watching are audited")
+	assert.Equal(t, "test-prefix/a.txt", events[1].Key)
+}
+
+func TestAuditLog_appends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, key := range []string{"a", "b"} {
+		audit, err := openAuditLog(path)
+		require.NoError(t, err)
+		audit.Publish(Event{Op: opUpload.String(), Status: eventFailure, Key: key, Error: "denied"})
+		require.NoError(t, audit.Close())
+	}
+
+	events := readAuditLog(t, path)
+	require.Len(t, events, 2)
+	assert.Equal(t, "a", events[0].Key)
+	assert.Equal(t, "b", events[1].Key)
+	assert.Equal(t, "denied", events[1].Error, "Failures are audited too")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// batchManifestName is the name of the manifest uploaded into a batch
+// directory before its marker.
+const batchManifestName = "_manifest.json"
+
+// batchManifest lists the files of a published batch.
+type batchManifest struct {
+	Bucket      string         `json:"bucket"`
+	PublishedAt time.Time      `json:"published_at"`
+	Files       []manifestFile `json:"files"`
+}
+
+// manifestFile describes an uploaded file of a batch.
+type manifestFile struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	ETag   string `json:"etag"`
+}
+
+// batchFor returns the batch rule a file is the marker of, if any.
+func (w *completionWaiter) batchFor(localFile string) (CompletionRule, bool) {
+	for _, rule := range w.config.Rules {
+		if rule.Strategy == completeBatch && filepath.Base(localFile) == rule.Marker {
+			return rule, true
+		}
+	}
+	return CompletionRule{}, false
+}
+
+// isBatchManifest reports whether a local path is where the manifest of a
+// batch would be, which echos3 writes to S3 without a local copy.
+func (w *completionWaiter) isBatchManifest(localFile string) bool {
+	if w == nil || filepath.Base(localFile) != batchManifestName {
+		return false
+	}
+	return w.ruleFor(localFile).Strategy == completeBatch
+}
+
+// batchFiles returns the files of the batch a marker completes: every file
+// below the marker's directory that the batch rule applies to.
+func (w *completionWaiter) batchFiles(marker string, rule CompletionRule) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(filepath.Dir(marker), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || name == rule.Marker || name == batchManifestName {
+			return nil
+		}
+		if r := w.ruleFor(path); r.Strategy == completeBatch && r.Marker == rule.Marker {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// publishBatch uploads the files of the batch a marker completes, then a
+// manifest of them, then the marker itself, so that consumers waiting for the
+// marker see the whole batch at once. Nothing more is uploaded if any file
+// fails; writing the marker again retries the batch.
+func (w *completionWaiter) publishBatch(marker string, rule CompletionRule) {
+	if _, err := os.Stat(marker); err != nil {
+		return
+	}
+	dir := filepath.Dir(marker)
+	w.mu.Lock()
+	if w.stopped || w.batches[dir] {
+		w.mu.Unlock()
+		return
+	}
+	w.batches[dir] = true
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.batches, dir)
+		w.mu.Unlock()
+	}()
+
+	logger := slog.With("path", dir, "bucket", w.pool.bucket)
+	files, err := w.batchFiles(marker, rule)
+	if err != nil {
+		logger.Error("Could not list batch", "error", err)
+		return
+	}
+	logger.Info("Publishing batch", "files", len(files))
+
+	manifest := batchManifest{Bucket: w.pool.bucket, Files: make([]manifestFile, len(files))}
+	results := make(chan error, len(files))
+	for n, localFile := range files {
+		s3Key, err := w.keyFor(localFile)
+		if err == nil {
+			manifest.Files[n].SHA256, err = sha256File(localFile)
+		}
+		if err != nil {
+			logger.Error("Could not prepare batch file. Not publishing the batch", "error", err)
+			return
+		}
+		manifest.Files[n].Key = s3Key
+		w.pool.queue(UploadJob{op: opUpload, localFile: localFile, s3Key: s3Key, done: func(result JobResult) {
+			manifest.Files[n].Size, manifest.Files[n].ETag = result.Size, result.ETag
+			results <- result.Err
+		}})
+	}
+
+	failed := 0
+	for range files {
+		if err := <-results; err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		logger.Error("Batch upload failed. Not publishing the manifest or marker", "files", len(files), "failed", failed)
+		return
+	}
+
+	manifest.PublishedAt = time.Now().UTC()
+	if err := w.uploadManifest(manifest, filepath.Join(dir, batchManifestName)); err != nil {
+		logger.Error("Could not upload batch manifest. Not publishing the marker", "error", err)
+		return
+	}
+	if err := w.uploadNow(marker); err != nil {
+		logger.Error("Could not upload batch marker", "error", err)
+		return
+	}
+	logger.Info("Published batch", "files", len(files))
+}
+
+// uploadManifest uploads a manifest to the key of localFile, through a
+// temporary file.
+func (w *completionWaiter) uploadManifest(manifest batchManifest, localFile string) error {
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	s3Key, err := w.keyFor(localFile)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp("", "echos3-manifest-*.json")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+	if _, err := temp.Write(append(body, '\n')); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return w.uploadFileNow(temp.Name(), s3Key)
+}
+
+// uploadNow uploads a file through the worker pool and waits for the result.
+func (w *completionWaiter) uploadNow(localFile string) error {
+	s3Key, err := w.keyFor(localFile)
+	if err != nil {
+		return err
+	}
+	return w.uploadFileNow(localFile, s3Key)
+}
+
+// uploadFileNow uploads a file to a key through the worker pool and waits for
+// the result.
+func (w *completionWaiter) uploadFileNow(localFile, s3Key string) error {
+	done := make(chan error, 1)
+	w.pool.queue(UploadJob{op: opUpload, localFile: localFile, s3Key: s3Key, done: func(result JobResult) {
+		done <- result.Err
+	}})
+	return <-done
+}
+
+// sha256File returns the hex encoded SHA-256 of a file.
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("could not read file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventRecorder is an EventSink that records the keys of successful jobs in
+// the order they complete.
+type eventRecorder struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (r *eventRecorder) Publish(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if event.Status == eventSuccess {
+		r.keys = append(r.keys, event.Key)
+	}
+}
+
+func (r *eventRecorder) Close() error { return nil }
+
+func (r *eventRecorder) uploaded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.keys...)
+}
+
+// newBatchTestWaiter creates a waiter publishing batches below exports, with
+// two parts waiting in exports/day.
+func newBatchTestWaiter(t *testing.T) (*completionWaiter, *MockS3Uploader, *eventRecorder, string) {
+	t.Helper()
+	waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Rules: []CompletionRule{
+		{Pattern: "exports/**", Strategy: completeBatch, Marker: "_SUCCESS"},
+	}})
+	recorder := &eventRecorder{}
+	waiter.pool.AddEventSink(recorder)
+
+	dir := filepath.Join(root, "exports", "day")
+	writeLocal(t, filepath.Join(dir, "part-0"), "zero")
+	writeLocal(t, filepath.Join(dir, "nested", "part-1"), "one")
+	return waiter, mockUploader, recorder, dir
+}
+
+func TestCompletionWaiter_batch(t *testing.T) {
+	t.Run("Parts are published, then the manifest, then the marker", func(t *testing.T) {
+		waiter, mockUploader, recorder, dir := newBatchTestWaiter(t)
+
+		waiter.offer(filepath.Join(dir, "part-0"))
+		assertNotUploaded(t, mockUploader, "exports/day/part-0")
+
+		marker := filepath.Join(dir, "_SUCCESS")
+		writeLocal(t, marker, "")
+		_, isMarker := waiter.markedFiles(marker)
+		assert.True(t, isMarker, "Batch markers are not synced like other files")
+		waiter.offer(marker)
+		assertUploaded(t, mockUploader, "exports/day/_SUCCESS", "")
+
+		keys := recorder.uploaded()
+		require.Len(t, keys, 4)
+		assert.ElementsMatch(t, []string{"exports/day/part-0", "exports/day/nested/part-1"}, keys[:2])
+		assert.Equal(t, []string{"exports/day/_manifest.json", "exports/day/_SUCCESS"}, keys[2:])
+
+		var manifest batchManifest
+		require.NoError(t, json.Unmarshal([]byte(mockUploader.Bodies["exports/day/_manifest.json"]), &manifest))
+		assert.Equal(t, "test-bucket", manifest.Bucket)
+		assert.WithinDuration(t, time.Now(), manifest.PublishedAt, time.Minute)
+		require.Len(t, manifest.Files, 2)
+		for _, file := range manifest.Files {
+			body := mockUploader.Bodies[file.Key]
+			sum := sha256.Sum256([]byte(body))
+			assert.Equal(t, hex.EncodeToString(sum[:]), file.SHA256)
+			assert.Equal(t, int64(len(body)), file.Size)
+			assert.Equal(t, *mockUploader.Uploads[file.Key].Key, file.Key)
+			assert.NotEmpty(t, file.ETag)
+		}
+	})
+
+	t.Run("A failed part holds back the manifest and the marker", func(t *testing.T) {
+		waiter, mockUploader, recorder, dir := newBatchTestWaiter(t)
+		// Conditional writes refuse to replace an object echos3 has not seen.
+		waiter.pool.EnableConditionalWrites(onConflictSkip)
+		putRemote(t, mockUploader, "exports/day/part-0", "someone else's")
+
+		writeLocal(t, filepath.Join(dir, "_SUCCESS"), "")
+		waiter.offer(filepath.Join(dir, "_SUCCESS"))
+		assert.Eventually(t, func() bool { return waiter.pool.Stats().Failed == 1 }, time.Second, 5*time.Millisecond)
+		assertNotUploaded(t, mockUploader, "exports/day/_manifest.json")
+		assertNotUploaded(t, mockUploader, "exports/day/_SUCCESS")
+		assert.Equal(t, []string{"exports/day/nested/part-1"}, recorder.uploaded())
+	})
+
+	t.Run("A removed marker publishes nothing", func(t *testing.T) {
+		waiter, mockUploader, _, dir := newBatchTestWaiter(t)
+
+		waiter.offer(filepath.Join(dir, "_SUCCESS"))
+		assertNotUploaded(t, mockUploader, "exports/day/part-0")
+	})
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Conflict policies accepted by the --conflict-policy flag.
+const (
+	conflictNewest   = "newest"    // The side with the most recent modification wins
+	conflictKeepBoth = "keep-both" // The local copy is renamed with a conflict suffix
+	conflictLocal    = "local"     // The local copy always wins
+)
+
+// syncedFile records the last synced version of a file on both sides.
+type syncedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	ETag    string    `json:"etag"`
+}
+
+// syncState is the base-state database used to detect which side changed
+// since the last bidirectional sync. Files are keyed by S3 key.
+type syncState struct {
+	Files map[string]syncedFile `json:"files"`
+}
+
+// defaultStatePath returns the location of the base-state database for a
+// local path and S3 prefix pair.
+func defaultStatePath(localPath, bucket, keyPrefix string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine cache directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(localPath + "\x00" + bucket + "\x00" + keyPrefix))
+	return filepath.Join(cacheDir, "echos3", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadSyncState reads the base-state database, returning an empty state if
+// it does not exist yet.
+func loadSyncState(statePath string) (*syncState, error) {
+	state := &syncState{Files: make(map[string]syncedFile)}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read sync state %s: %w", statePath, err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not parse sync state %s: %w", statePath, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]syncedFile)
+	}
+	return state, nil
+}
+
+// save writes the base-state database atomically.
+func (s *syncState) save(statePath string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(statePath, strings.NewReader(string(data)), time.Time{}, 0644); err != nil {
+		return fmt.Errorf("could not write sync state %s: %w", statePath, err)
+	}
+	return nil
+}
+
+// conflictName inserts a conflict suffix before the extension of a local path
+// or S3 key, e.g. "notes.txt" becomes "notes.conflict-20260102T030405Z.txt".
+func conflictName(name string, at time.Time) string {
+	ext := path.Ext(name)
+	if strings.ContainsAny(ext, `/\`) {
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + ".conflict-" + at.UTC().Format("20060102T150405Z") + ext
+}
+
+// sameContent reports whether a local file matches a remote object by
+// comparing its MD5 with the object's ETag. Multipart and encrypted objects
+// have ETags that are not MD5 digests, in which case false is returned.
+func sameContent(localFile string, info os.FileInfo, obj types.Object) bool {
+	etag := strings.Trim(aws.ToString(obj.ETag), `"`)
+	if aws.ToInt64(obj.Size) != info.Size() || len(etag) != 32 {
+		return false
+	}
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = file.Close() }()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == etag
+}
+
+// bisyncOp identifies an operation planned by reconcile.
+type bisyncOp int
+
+const (
+	bisyncUpload bisyncOp = iota
+	bisyncDownload
+	bisyncDelete      // Delete the remote object
+	bisyncRemoveLocal // Delete the local file
+	bisyncRenameLocal // Move the local file aside to target
+)
+
+// bisyncAction is a single operation planned by reconcile.
+type bisyncAction struct {
+	op        bisyncOp
+	s3Key     string
+	localFile string
+	target    string
+}
+
+// jobOps maps the planned operations that run in the worker pool to jobs.
+var jobOps = map[bisyncOp]jobOp{
+	bisyncUpload:   opUpload,
+	bisyncDownload: opDownload,
+	bisyncDelete:   opDelete,
+}
+
+// bisyncer performs bidirectional reconciliation between the local path and
+// the mirrored prefix.
+type bisyncer struct {
+	app            *App
+	state          *syncState
+	statePath      string
+	conflictPolicy string
+	now            func() time.Time
+}
+
+// reconcile compares both sides with the base state, runs the resulting
+// uploads, downloads and deletes through the worker pool and records the new
+// base state.
+func (b *bisyncer) reconcile(ctx context.Context) (SyncSummary, error) {
+	var summary SyncSummary
+	a := b.app
+
+	remote, err := a.listRemote(ctx)
+	if err != nil {
+		return summary, err
+	}
+	a.workerPool.RememberObjects(remote)
+	locals, paths, err := a.listLocal()
+	if err != nil {
+		return summary, err
+	}
+
+	keys := make(map[string]struct{})
+	for key := range remote {
+		keys[key] = struct{}{}
+	}
+	for key := range locals {
+		keys[key] = struct{}{}
+	}
+	for key := range b.state.Files {
+		keys[key] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var actions []bisyncAction
+	for _, key := range sorted {
+		planned, err := b.plan(key, locals, paths, remote)
+		if err != nil {
+			slog.Error("Could not plan sync", "key", key, "error", err)
+			summary.Failed++
+			continue
+		}
+		if planned == nil {
+			summary.Unchanged++
+		}
+		actions = append(actions, planned...)
+	}
+
+	if a.dryRun {
+		for _, action := range actions {
+			b.logDryRun(action, &summary)
+		}
+		return summary, nil
+	}
+
+	b.execute(actions, &summary)
+
+	if err := b.state.save(b.statePath); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// plan decides what to do with a single key. A nil result means both sides
+// are already in sync.
+func (b *bisyncer) plan(key string, locals map[string]os.FileInfo, paths map[string]string, remote map[string]types.Object) ([]bisyncAction, error) {
+	a := b.app
+	info, hasLocal := locals[key]
+	obj, hasRemote := remote[key]
+	base, hasBase := b.state.Files[key]
+
+	localFile, ok := paths[key]
+	if !ok {
+		var err error
+		if localFile, err = a.localPathFor(key); err != nil {
+			return nil, fmt.Errorf("skipping %s: %w", key, err)
+		}
+	}
+
+	// Both sides exist but have never been synced: adopt them as the base
+	// if their contents already match.
+	if !hasBase && hasLocal && hasRemote && sameContent(localFile, info, obj) {
+		b.state.Files[key] = syncedFile{Size: info.Size(), ModTime: info.ModTime(), ETag: aws.ToString(obj.ETag)}
+		return nil, nil
+	}
+
+	localChanged := hasLocal != hasBase ||
+		hasLocal && (info.Size() != base.Size || !info.ModTime().Equal(base.ModTime))
+	remoteChanged := hasRemote != hasBase ||
+		hasRemote && aws.ToString(obj.ETag) != base.ETag
+
+	upload := bisyncAction{op: bisyncUpload, s3Key: key, localFile: localFile}
+	download := bisyncAction{op: bisyncDownload, s3Key: key, localFile: localFile}
+
+	switch {
+	case !localChanged && !remoteChanged:
+		return nil, nil
+
+	case localChanged && !remoteChanged:
+		if hasLocal {
+			return []bisyncAction{upload}, nil
+		}
+		return b.propagateDelete(bisyncAction{op: bisyncDelete, s3Key: key})
+
+	case !localChanged && remoteChanged:
+		if hasRemote {
+			return []bisyncAction{download}, nil
+		}
+		return b.propagateDelete(bisyncAction{op: bisyncRemoveLocal, s3Key: key, localFile: localFile})
+
+	case !hasLocal && !hasRemote:
+		// Deleted on both sides.
+		delete(b.state.Files, key)
+		return nil, nil
+
+	case !hasLocal:
+		// Deleted locally but modified remotely: keep the modification.
+		return []bisyncAction{download}, nil
+
+	case !hasRemote:
+		// Deleted remotely but modified locally: keep the modification.
+		return []bisyncAction{upload}, nil
+	}
+
+	// Modified on both sides.
+	slog.Warn("File changed both locally and in S3", "path", localFile, "bucket", a.bucket, "key", key, "policy", b.conflictPolicy)
+	switch b.conflictPolicy {
+	case conflictLocal:
+		return []bisyncAction{upload}, nil
+	case conflictKeepBoth:
+		now := b.now()
+		conflictFile := conflictName(localFile, now)
+		return []bisyncAction{
+			{op: bisyncRenameLocal, s3Key: key, localFile: localFile, target: conflictFile},
+			{op: bisyncUpload, s3Key: conflictName(key, now), localFile: conflictFile},
+			download,
+		}, nil
+	default:
+		if info.ModTime().After(aws.ToTime(obj.LastModified)) {
+			return []bisyncAction{upload}, nil
+		}
+		return []bisyncAction{download}, nil
+	}
+}
+
+// propagateDelete returns a delete action if --delete is set. Otherwise the
+// deletion is ignored and the base state is kept so it is not retried.
+func (b *bisyncer) propagateDelete(action bisyncAction) ([]bisyncAction, error) {
+	if !b.app.delete {
+		return nil, nil
+	}
+	return []bisyncAction{action}, nil
+}
+
+// execute runs the planned actions. Renames are performed first so that
+// conflicting local copies are moved aside before anything is downloaded
+// over them; the remaining actions run concurrently in the worker pool.
+func (b *bisyncer) execute(actions []bisyncAction, summary *SyncSummary) {
+	a := b.app
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+
+	// Files whose conflicting copy could not be moved aside, which must be
+	// neither downloaded over nor uploaded as the conflict copy.
+	renameFailed := make(map[string]bool)
+	for _, action := range actions {
+		switch action.op {
+		case bisyncRenameLocal:
+			slog.Info("Renaming local file", "path", action.localFile, "target", action.target)
+			if err := os.Rename(action.localFile, action.target); err != nil {
+				slog.Error("Failed to rename local file", "path", action.localFile, "error", err)
+				summary.Failed++
+				renameFailed[action.localFile] = true
+				renameFailed[action.target] = true
+			}
+		case bisyncRemoveLocal:
+			// A file that could not be removed would look new next time, and
+			// be uploaded again.
+			if err := a.removeLocal(action.s3Key, summary); err == nil {
+				delete(b.state.Files, action.s3Key)
+			}
+		}
+	}
+
+	for _, action := range actions {
+		op, ok := jobOps[action.op]
+		if !ok {
+			continue
+		}
+		if renameFailed[action.localFile] {
+			slog.Warn("Skipping conflicting file that could not be renamed", "op", op.String(), "path", action.localFile, "bucket", a.bucket, "key", action.s3Key)
+			continue
+		}
+		// Capture the local file before an upload starts so that a file
+		// modified mid-upload is detected as changed on the next pass.
+		info, _ := os.Stat(action.localFile)
+
+		wg.Add(1)
+		a.workerPool.queue(UploadJob{
+			op:        op,
+			localFile: action.localFile,
+			s3Key:     action.s3Key,
+			done: func(result JobResult) {
+				defer wg.Done()
+				mu.Lock()
+				defer mu.Unlock()
+				b.record(result, info, summary)
+			},
+		})
+	}
+	wg.Wait()
+}
+
+// record updates the summary and base state with the result of a job.
+func (b *bisyncer) record(result JobResult, before os.FileInfo, summary *SyncSummary) {
+	if result.Err != nil {
+		summary.Failed++
+		return
+	}
+
+	switch result.Op {
+	case opUpload:
+		summary.Uploaded++
+		if before != nil {
+			b.state.Files[result.Key] = syncedFile{Size: before.Size(), ModTime: before.ModTime(), ETag: result.ETag}
+		}
+	case opDownload:
+		summary.Downloaded++
+		if info, err := os.Stat(result.LocalFile); err == nil {
+			b.state.Files[result.Key] = syncedFile{Size: info.Size(), ModTime: info.ModTime(), ETag: result.ETag}
+		}
+	case opDelete:
+		summary.Deleted++
+		delete(b.state.Files, result.Key)
+	}
+}
+
+// logDryRun logs a planned action without performing it.
+func (b *bisyncer) logDryRun(action bisyncAction, summary *SyncSummary) {
+	logger := slog.With("dry_run", true, "bucket", b.app.bucket, "key", action.s3Key, "path", action.localFile)
+	switch action.op {
+	case bisyncUpload:
+		logger.Info("Would upload", "op", "upload")
+		summary.Uploaded++
+	case bisyncDownload:
+		logger.Info("Would download", "op", "download")
+		summary.Downloaded++
+	case bisyncDelete:
+		logger.Info("Would delete", "op", "delete")
+		summary.Deleted++
+	case bisyncRemoveLocal:
+		logger.Info("Would remove local file", "op", "remove")
+		summary.Deleted++
+	case bisyncRenameLocal:
+		logger.Info("Would rename local file", "op", "rename", "target", action.target)
+	}
+}
+
+// newBisyncer loads the base state for the app.
+func (a *App) newBisyncer() (*bisyncer, error) {
+	statePath := a.statePath
+	if statePath == "" {
+		var err error
+		if statePath, err = defaultStatePath(a.localPath, a.bucket, a.keyPrefix); err != nil {
+			return nil, err
+		}
+	}
+	state, err := loadSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	return &bisyncer{
+		app:            a,
+		state:          state,
+		statePath:      statePath,
+		conflictPolicy: a.conflictPolicy,
+		now:            time.Now,
+	}, nil
+}
+
+// bisyncOnce reconciles both sides a single time, then shuts the worker pool
+// down. An error is returned if any operation failed.
+func (a *App) bisyncOnce(ctx context.Context) (SyncSummary, error) {
+	defer a.workerPool.Shutdown()
+
+	b, err := a.newBisyncer()
+	if err != nil {
+		return SyncSummary{}, err
+	}
+
+	slog.Info("Syncing in both directions", "path", a.localPath, "bucket", a.bucket, "key", a.keyPrefix)
+	summary, err := b.reconcile(ctx)
+	if err != nil {
+		return summary, err
+	}
+
+	slog.Info("Sync complete", "uploaded", summary.Uploaded, "downloaded", summary.Downloaded,
+		"deleted", summary.Deleted, "unchanged", summary.Unchanged, "failed", summary.Failed)
+
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d operation(s) failed", summary.Failed)
+	}
+	return summary, nil
+}
+
+// runBisync reconciles both sides every poll interval until the context is
+// cancelled.
+func (a *App) runBisync(ctx context.Context) error {
+	defer a.workerPool.Shutdown()
+
+	b, err := a.newBisyncer()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Syncing in both directions", "path", a.localPath, "bucket", a.bucket, "key", a.keyPrefix, "interval", a.pollInterval)
+
+	ticker := time.NewTicker(a.pollInterval)
+	defer ticker.Stop()
+
+	a.health.loopStarted(0)
+	defer a.health.loopStopped()
+
+	for {
+		summary, err := b.reconcile(ctx)
+		if err != nil {
+			slog.Error("Sync failed", "error", err)
+		} else {
+			a.health.initialScanDone()
+			if summary.Uploaded > 0 || summary.Downloaded > 0 || summary.Deleted > 0 || summary.Failed > 0 {
+				slog.Info("Sync complete", "uploaded", summary.Uploaded, "downloaded", summary.Downloaded,
+					"deleted", summary.Deleted, "failed", summary.Failed)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
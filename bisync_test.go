@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBisyncer sets up an App and a bisyncer with its own state file.
+func newTestBisyncer(t *testing.T, deleteFlag bool, policy string) (*bisyncer, *MockS3Uploader, string) {
+	t.Helper()
+	app, mockUploader, tmpDir := newTestApp(t, deleteFlag, true)
+	t.Cleanup(app.workerPool.Shutdown)
+
+	app.statePath = filepath.Join(t.TempDir(), "state.json")
+	app.conflictPolicy = policy
+	b, err := app.newBisyncer()
+	require.NoError(t, err)
+	b.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return b, mockUploader, tmpDir
+}
+
+// putRemote stores an object in the mock bucket as another client would.
+func putRemote(t *testing.T, m *MockS3Uploader, key, body string) {
+	t.Helper()
+	_, err := m.Upload(context.Background(), &s3.PutObjectInput{Key: aws.String(key), Body: strings.NewReader(body)})
+	require.NoError(t, err)
+}
+
+// writeLocal writes a local file with an mtime in the future so that it is
+// always seen as modified.
+func writeLocal(t *testing.T, path, body string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(body), 0644))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, future, future))
+}
+
+func readLocal(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestBisyncer_reconcile(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("First sync copies each side to the other and adopts identical files", func(t *testing.T) {
+		b, mockUploader, tmpDir := newTestBisyncer(t, false, conflictNewest)
+		writeLocal(t, filepath.Join(tmpDir, "local.txt"), "local")
+		writeLocal(t, filepath.Join(tmpDir, "same.txt"), "same")
+		putRemote(t, mockUploader, "test-prefix/remote.txt", "remote")
+		putRemote(t, mockUploader, "test-prefix/same.txt", "same")
+		mockUploader.Uploads = make(map[string]*s3.PutObjectInput)
+
+		summary, err := b.reconcile(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, SyncSummary{Uploaded: 1, Downloaded: 1, Unchanged: 1}, summary)
+		assert.Equal(t, "local", mockUploader.Bodies["test-prefix/local.txt"])
+		assert.Equal(t, "remote", readLocal(t, filepath.Join(tmpDir, "remote.txt")))
+		assert.NotContains(t, mockUploader.Uploads, "test-prefix/same.txt")
+		assert.Len(t, b.state.Files, 3)
+
+		// A second pass with no changes does nothing.
+		summary, err = b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Unchanged: 3}, summary)
+	})
+
+	t.Run("Changes on one side are copied to the other", func(t *testing.T) {
+		b, mockUploader, tmpDir := newTestBisyncer(t, false, conflictNewest)
+		writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a1")
+		putRemote(t, mockUploader, "test-prefix/b.txt", "b1")
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+
+		writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a2")
+		putRemote(t, mockUploader, "test-prefix/b.txt", "b2")
+
+		summary, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Uploaded: 1, Downloaded: 1}, summary)
+		assert.Equal(t, "a2", mockUploader.Bodies["test-prefix/a.txt"])
+		assert.Equal(t, "b2", readLocal(t, filepath.Join(tmpDir, "b.txt")))
+	})
+
+	t.Run("Deletions propagate only with the delete flag", func(t *testing.T) {
+		for _, deleteFlag := range []bool{false, true} {
+			b, mockUploader, tmpDir := newTestBisyncer(t, deleteFlag, conflictNewest)
+			writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a")
+			writeLocal(t, filepath.Join(tmpDir, "b.txt"), "b")
+			_, err := b.reconcile(ctx)
+			require.NoError(t, err)
+
+			require.NoError(t, os.Remove(filepath.Join(tmpDir, "a.txt")))
+			_, err = mockUploader.DeleteObject(ctx, &s3.DeleteObjectInput{Key: aws.String("test-prefix/b.txt")})
+			require.NoError(t, err)
+
+			summary, err := b.reconcile(ctx)
+			require.NoError(t, err)
+
+			if deleteFlag {
+				assert.Equal(t, int64(2), summary.Deleted)
+				assert.NotContains(t, mockUploader.Bodies, "test-prefix/a.txt")
+				assert.NoFileExists(t, filepath.Join(tmpDir, "b.txt"))
+				assert.Empty(t, b.state.Files)
+			} else {
+				assert.Equal(t, int64(0), summary.Deleted)
+				assert.Contains(t, mockUploader.Bodies, "test-prefix/a.txt")
+				assert.FileExists(t, filepath.Join(tmpDir, "b.txt"))
+			}
+		}
+	})
+
+	t.Run("Files that cannot be removed stay in the base state", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("Directory permissions do not stop root from removing files")
+		}
+		b, mockUploader, tmpDir := newTestBisyncer(t, true, conflictNewest)
+		localFile := filepath.Join(tmpDir, "locked", "a.txt")
+		writeLocal(t, localFile, "a")
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+
+		_, err = mockUploader.DeleteObject(ctx, &s3.DeleteObjectInput{Key: aws.String("test-prefix/locked/a.txt")})
+		require.NoError(t, err)
+		require.NoError(t, os.Chmod(filepath.Dir(localFile), 0555))
+		t.Cleanup(func() { _ = os.Chmod(filepath.Dir(localFile), 0755) })
+
+		summary, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Failed: 1}, summary)
+		assert.FileExists(t, localFile)
+		assert.Contains(t, b.state.Files, "test-prefix/locked/a.txt")
+
+		summary, err = b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Failed: 1}, summary, "The removal is retried rather than the file uploaded again")
+		assert.NotContains(t, mockUploader.Bodies, "test-prefix/locked/a.txt")
+	})
+
+	t.Run("A modification wins over a deletion on the other side", func(t *testing.T) {
+		b, mockUploader, tmpDir := newTestBisyncer(t, true, conflictNewest)
+		writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a1")
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+
+		writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a2")
+		_, err = mockUploader.DeleteObject(ctx, &s3.DeleteObjectInput{Key: aws.String("test-prefix/a.txt")})
+		require.NoError(t, err)
+
+		summary, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), summary.Uploaded)
+		assert.Equal(t, "a2", mockUploader.Bodies["test-prefix/a.txt"])
+	})
+}
+
+func TestBisyncer_conflicts(t *testing.T) {
+	ctx := context.Background()
+
+	// setup syncs a file, then changes it on both sides.
+	setup := func(t *testing.T, policy string, localNewer bool) (*bisyncer, *MockS3Uploader, string) {
+		b, mockUploader, tmpDir := newTestBisyncer(t, false, policy)
+		localFile := filepath.Join(tmpDir, "doc.txt")
+		writeLocal(t, localFile, "base")
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(localFile, []byte("local edit"), 0644))
+		mtime := time.Now().Add(-time.Hour)
+		if localNewer {
+			mtime = time.Now().Add(time.Hour)
+		}
+		require.NoError(t, os.Chtimes(localFile, mtime, mtime))
+		putRemote(t, mockUploader, "test-prefix/doc.txt", "remote edit")
+		return b, mockUploader, tmpDir
+	}
+
+	t.Run("Newest wins picks the remote copy when it is newer", func(t *testing.T) {
+		b, mockUploader, tmpDir := setup(t, conflictNewest, false)
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "remote edit", readLocal(t, filepath.Join(tmpDir, "doc.txt")))
+		assert.Equal(t, "remote edit", mockUploader.Bodies["test-prefix/doc.txt"])
+	})
+
+	t.Run("Newest wins picks the local copy when it is newer", func(t *testing.T) {
+		b, mockUploader, _ := setup(t, conflictNewest, true)
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "local edit", mockUploader.Bodies["test-prefix/doc.txt"])
+	})
+
+	t.Run("Local wins always uploads", func(t *testing.T) {
+		b, mockUploader, _ := setup(t, conflictLocal, false)
+		_, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "local edit", mockUploader.Bodies["test-prefix/doc.txt"])
+	})
+
+	t.Run("Keep both renames the local copy and syncs both files", func(t *testing.T) {
+		b, mockUploader, tmpDir := setup(t, conflictKeepBoth, true)
+		summary, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Uploaded: 1, Downloaded: 1}, summary)
+
+		conflictFile := filepath.Join(tmpDir, "doc.conflict-20260102T030405Z.txt")
+		assert.Equal(t, "local edit", readLocal(t, conflictFile))
+		assert.Equal(t, "remote edit", readLocal(t, filepath.Join(tmpDir, "doc.txt")))
+		assert.Equal(t, "local edit", mockUploader.Bodies["test-prefix/doc.conflict-20260102T030405Z.txt"])
+		assert.Equal(t, "remote edit", mockUploader.Bodies["test-prefix/doc.txt"])
+
+		summary, err = b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Unchanged: 2}, summary, "Both files should be in sync afterwards")
+	})
+
+	t.Run("Keep both leaves the local copy alone if it cannot be renamed", func(t *testing.T) {
+		b, mockUploader, tmpDir := setup(t, conflictKeepBoth, true)
+		// A directory in the way of the conflict copy makes the rename fail.
+		require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "doc.conflict-20260102T030405Z.txt"), 0755))
+
+		summary, err := b.reconcile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Failed: 1}, summary)
+		assert.Equal(t, "local edit", readLocal(t, filepath.Join(tmpDir, "doc.txt")), "The local edit is not downloaded over")
+		assert.Equal(t, "remote edit", mockUploader.Bodies["test-prefix/doc.txt"])
+		assert.NotContains(t, mockUploader.Bodies, "test-prefix/doc.conflict-20260102T030405Z.txt")
+	})
+}
+
+func TestSyncState_persistence(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "nested", "state.json")
+
+	state, err := loadSyncState(statePath)
+	require.NoError(t, err)
+	assert.Empty(t, state.Files)
+
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	state.Files["a.txt"] = syncedFile{Size: 1, ModTime: modTime, ETag: `"abc"`}
+	require.NoError(t, state.save(statePath))
+
+	loaded, err := loadSyncState(statePath)
+	require.NoError(t, err)
+	assert.Equal(t, state.Files, loaded.Files)
+}
+
+func TestConflictName(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		name   string
+		expect string
+	}{
+		{"notes.txt", "notes.conflict-20260102T030405Z.txt"},
+		{"prefix/dir/notes.txt", "prefix/dir/notes.conflict-20260102T030405Z.txt"},
+		{"Makefile", "Makefile.conflict-20260102T030405Z"},
+		{"dir.d/Makefile", "dir.d/Makefile.conflict-20260102T030405Z"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, conflictName(tc.name, at))
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Completion strategies, which decide when a changed file is complete and may
+// be uploaded.
+const (
+	completeImmediate  = "immediate"   // Upload on the first event
+	completeStable     = "stable"      // Wait for the size and mtime to stop changing
+	completeCloseWrite = "close-write" // Wait for the last writer to close the file (Linux)
+	completeNoWriters  = "no-writers"  // Poll until no process has the file open for writing (Linux)
+	completeMarker     = "marker"      // Wait for a companion marker file
+	completeBatch      = "batch"       // Upload a directory at once when its marker appears
+)
+
+// errCompletionUnsupported is returned for strategies that this platform
+// cannot provide.
+var errCompletionUnsupported = errors.New("not supported on this platform")
+
+// CompletionRule selects the completion strategy for the files matching a
+// pattern.
+type CompletionRule struct {
+	// Pattern is matched against the path relative to the watched directory,
+	// using / as the separator. A pattern without a / is matched against the
+	// file name, and a pattern ending in /** matches everything below a
+	// directory.
+	Pattern  string
+	Strategy string
+	// Marker is the marker of the marker strategy: a suffix starting with "."
+	// (file.csv.done), or a file name in the same directory (_SUCCESS). For the
+	// batch strategy it is the file name that completes a directory.
+	Marker string
+}
+
+// CompletionConfig configures how echos3 decides that a file is complete.
+type CompletionConfig struct {
+	Rules          []CompletionRule // The first matching rule applies
+	Default        string           // Strategy for files matching no rule
+	StableChecks   int              // Unchanged checks required by the stable strategy
+	StableInterval time.Duration    // Time between checks of the stable and no-writers strategies
+}
+
+// parseCompletionRule parses a rule given as PATTERN=STRATEGY, or as
+// PATTERN=marker:MARKER or PATTERN=batch:MARKER for the strategies taking a
+// marker.
+func parseCompletionRule(value string) (CompletionRule, error) {
+	pattern, strategy, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" {
+		return CompletionRule{}, fmt.Errorf("invalid completion rule %q: must be PATTERN=STRATEGY", value)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return CompletionRule{}, fmt.Errorf("invalid completion rule %q: %w", value, err)
+	}
+
+	rule := CompletionRule{Pattern: pattern, Strategy: strategy}
+	if name, marker, ok := strings.Cut(strategy, ":"); ok && (name == completeMarker || name == completeBatch) {
+		rule.Strategy, rule.Marker = name, marker
+		if marker == "" || marker == "." || strings.ContainsAny(marker, `/\`) {
+			return CompletionRule{}, fmt.Errorf("invalid marker %q: must be a suffix like .done or a file name like _SUCCESS", marker)
+		}
+		if name == completeBatch && (strings.HasPrefix(marker, ".") || marker == batchManifestName) {
+			return CompletionRule{}, fmt.Errorf("invalid batch marker %q: must be a file name like _SUCCESS", marker)
+		}
+		return rule, nil
+	}
+	if err := checkStrategy(strategy); err != nil {
+		return CompletionRule{}, fmt.Errorf("invalid completion rule %q: %w", value, err)
+	}
+	return rule, nil
+}
+
+// checkStrategy validates a strategy that takes no argument.
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case completeImmediate, completeStable:
+		return nil
+	case completeCloseWrite, completeNoWriters:
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("strategy %s is %w", strategy, errCompletionUnsupported)
+		}
+		return nil
+	case completeMarker:
+		return errors.New("the marker strategy needs a marker, as in marker:.done or marker:_SUCCESS")
+	case completeBatch:
+		return errors.New("the batch strategy needs a marker, as in batch:_SUCCESS")
+	}
+	return fmt.Errorf("unknown strategy %q: must be immediate, stable, close-write, no-writers, marker:MARKER or batch:MARKER", strategy)
+}
+
+// matchPattern reports whether a relative path matches a completion pattern.
+func matchPattern(pattern, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return strings.HasPrefix(rel, dir+"/")
+	}
+	if !strings.Contains(pattern, "/") {
+		rel = path.Base(rel)
+	}
+	matched, _ := path.Match(pattern, rel)
+	return matched
+}
+
+// completionWaiter holds changed files back until their completion strategy
+// decides that they are complete, then queues their upload.
+type completionWaiter struct {
+	config      CompletionConfig
+	root        string                       // Directory patterns are relative to
+	keyFor      func(string) (string, error) // Maps a local file to its S3 key
+	pool        *UploadWorkerPool
+	closeWrites *closeWriteWatcher // Set when a rule uses close-write
+
+	queueing sync.WaitGroup // Uploads of complete files being queued
+
+	mu      sync.Mutex
+	pending map[string]*pendingFile // Files waiting to complete, by path
+	queued  map[string]localVersion // Files queued for upload, by path
+	batches map[string]bool         // Directories whose batch is being published
+	stopped bool
+}
+
+// localVersion identifies a version of a local file by its size and mtime.
+type localVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// localVersionOf returns the version of a local file.
+func localVersionOf(info os.FileInfo) localVersion {
+	return localVersion{size: info.Size(), modTime: info.ModTime()}
+}
+
+// pendingFile is a file waiting for its completion strategy.
+type pendingFile struct {
+	strategy string
+	version  localVersion
+	checks   int         // Consecutive checks without a change
+	timer    *time.Timer // Set for polling strategies
+}
+
+// newCompletionWaiter creates a waiter that queues uploads in pool.
+func newCompletionWaiter(config CompletionConfig, root string, keyFor func(string) (string, error), pool *UploadWorkerPool) (*completionWaiter, error) {
+	if config.StableChecks < 1 {
+		config.StableChecks = 1
+	}
+	w := &completionWaiter{
+		config:  config,
+		root:    root,
+		keyFor:  keyFor,
+		pool:    pool,
+		pending: make(map[string]*pendingFile),
+		queued:  make(map[string]localVersion),
+		batches: make(map[string]bool),
+	}
+	for _, rule := range config.Rules {
+		if rule.Strategy == completeCloseWrite {
+			watcher, err := newCloseWriteWatcher(w.writeClosed)
+			if err != nil {
+				return nil, fmt.Errorf("could not watch for closed files: %w", err)
+			}
+			w.closeWrites = watcher
+			break
+		}
+	}
+	return w, nil
+}
+
+// ruleFor returns the rule that applies to a local file.
+func (w *completionWaiter) ruleFor(localFile string) CompletionRule {
+	rel, err := filepath.Rel(w.root, localFile)
+	if err == nil {
+		for _, rule := range w.config.Rules {
+			if matchPattern(rule.Pattern, rel) {
+				return rule
+			}
+		}
+	}
+	return CompletionRule{Pattern: "*", Strategy: w.config.Default}
+}
+
+// markedFiles returns the files a marker file marks complete, and whether
+// localFile is a marker at all.
+func (w *completionWaiter) markedFiles(localFile string) ([]string, bool) {
+	if w == nil {
+		return nil, false
+	}
+	if _, ok := w.batchFor(localFile); ok {
+		return nil, true
+	}
+	for _, rule := range w.config.Rules {
+		if rule.Strategy != completeMarker {
+			continue
+		}
+		if strings.HasPrefix(rule.Marker, ".") {
+			data, ok := strings.CutSuffix(localFile, rule.Marker)
+			if ok && w.ruleFor(data).Marker == rule.Marker {
+				return []string{data}, true
+			}
+			continue
+		}
+		if filepath.Base(localFile) != rule.Marker {
+			continue
+		}
+		dir := filepath.Dir(localFile)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, true
+		}
+		var files []string
+		for _, entry := range entries {
+			file := filepath.Join(dir, entry.Name())
+			if !entry.IsDir() && file != localFile && w.ruleFor(file).Marker == rule.Marker {
+				files = append(files, file)
+			}
+		}
+		return files, true
+	}
+	return nil, false
+}
+
+// mirrored reports whether a local file is uploaded under its own key.
+// Markers are not, except batch markers, which are uploaded last.
+func (w *completionWaiter) mirrored(localFile string) bool {
+	if w == nil {
+		return true
+	}
+	if _, ok := w.batchFor(localFile); ok {
+		return true
+	}
+	_, isMarker := w.markedFiles(localFile)
+	return !isMarker
+}
+
+// markerOf returns the marker file that marks a file complete.
+func markerOf(localFile string, rule CompletionRule) string {
+	if strings.HasPrefix(rule.Marker, ".") {
+		return localFile + rule.Marker
+	}
+	return filepath.Join(filepath.Dir(localFile), rule.Marker)
+}
+
+// offer uploads a changed file once it is complete. Offering a marker offers
+// the files it marks instead; markers themselves are only uploaded as the end
+// of a batch.
+func (w *completionWaiter) offer(localFile string) {
+	if rule, ok := w.batchFor(localFile); ok {
+		go w.publishBatch(localFile, rule)
+		return
+	}
+	if files, ok := w.markedFiles(localFile); ok {
+		for _, file := range files {
+			w.offer(file)
+		}
+		return
+	}
+
+	info, err := os.Stat(localFile)
+	if err != nil || info.IsDir() {
+		return
+	}
+	rule := w.ruleFor(localFile)
+	if rule.Strategy == completeBatch {
+		slog.Debug("File is part of a batch. Waiting for its marker", "path", localFile, "marker", rule.Marker)
+		return
+	}
+	if rule.Strategy == completeMarker {
+		if _, err := os.Stat(markerOf(localFile, rule)); err != nil {
+			slog.Debug("File has no marker yet. Waiting", "path", localFile, "marker", rule.Marker)
+			return
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped || w.pending[localFile] != nil {
+		return
+	}
+	if version, ok := w.queued[localFile]; ok && version == localVersionOf(info) {
+		return // Already on its way
+	}
+
+	file := &pendingFile{strategy: rule.Strategy, version: localVersionOf(info)}
+	switch rule.Strategy {
+	case completeStable, completeNoWriters:
+		file.timer = time.AfterFunc(w.config.StableInterval, func() { w.poll(localFile, file) })
+	case completeCloseWrite:
+		if err := w.closeWrites.watch(localFile); err != nil {
+			slog.Error("Could not watch file for close. Uploading it now", "path", localFile, "error", err)
+			w.enqueue(localFile, file.version)
+			return
+		}
+		// The last writer may have closed the file before it was watched.
+		go w.writeClosed(localFile)
+	default:
+		w.enqueue(localFile, file.version)
+		return
+	}
+	w.pending[localFile] = file
+}
+
+// poll checks a file waiting for a polling strategy, queueing it once it is
+// complete and checking it again later otherwise.
+func (w *completionWaiter) poll(localFile string, file *pendingFile) {
+	info, err := os.Stat(localFile)
+	complete := false
+	if err == nil && file.strategy == completeNoWriters {
+		writing, err := openForWriting(localFile)
+		if err != nil {
+			slog.Warn("Could not check for writers", "path", localFile, "error", err)
+		}
+		complete = !writing
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped || w.pending[localFile] != file {
+		return
+	}
+	if err != nil {
+		delete(w.pending, localFile)
+		return
+	}
+
+	version := localVersionOf(info)
+	if file.strategy == completeStable {
+		if version == file.version {
+			file.checks++
+		} else {
+			file.checks = 0
+		}
+		complete = file.checks >= w.config.StableChecks
+	}
+	file.version = version
+	if !complete {
+		slog.Debug("File is still being written. Waiting", "path", localFile, "bytes", info.Size())
+		file.timer.Reset(w.config.StableInterval)
+		return
+	}
+	delete(w.pending, localFile)
+	w.enqueue(localFile, version)
+}
+
+// writeClosed is called when a writer closed a file waiting for close-write,
+// and queues the file unless another process still has it open for writing.
+func (w *completionWaiter) writeClosed(localFile string) {
+	info, err := os.Stat(localFile)
+	if err == nil {
+		writing, checkErr := openForWriting(localFile)
+		if checkErr != nil {
+			slog.Warn("Could not check for writers", "path", localFile, "error", checkErr)
+		}
+		if writing {
+			return // The last writer to close it calls again
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	file, ok := w.pending[localFile]
+	if w.stopped || !ok || file.strategy != completeCloseWrite {
+		return
+	}
+	delete(w.pending, localFile)
+	w.closeWrites.unwatch(localFile)
+	if err == nil {
+		w.enqueue(localFile, localVersionOf(info))
+	}
+}
+
+// enqueue queues the upload of a complete file. The caller must hold w.mu.
+func (w *completionWaiter) enqueue(localFile string, version localVersion) {
+	s3Key, err := w.keyFor(localFile)
+	if err != nil {
+		slog.Error("Could not map file to an S3 key", "path", localFile, "error", err)
+		return
+	}
+	marker := ""
+	if rule := w.ruleFor(localFile); rule.Strategy == completeMarker && strings.HasPrefix(rule.Marker, ".") {
+		marker = markerOf(localFile, rule)
+	}
+
+	w.queued[localFile] = version
+	// Queue without holding the lock, as a full queue blocks until a worker
+	// finishes a job, which calls back into the waiter. stop waits for the
+	// job to be queued, so that it is not lost when the pool shuts down.
+	w.queueing.Add(1)
+	job := UploadJob{op: opUpload, localFile: localFile, s3Key: s3Key, done: func(result JobResult) {
+		w.mu.Lock()
+		if w.queued[localFile] == version {
+			delete(w.queued, localFile)
+		}
+		w.mu.Unlock()
+
+		// A marker belonging only to a file the inbox removed goes with it.
+		if marker != "" && result.Err == nil && w.pool.inbox.removed(localFile) {
+			w.pool.inbox.remember(marker)
+			if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+				slog.Error("Could not delete marker file", "path", marker, "error", err)
+			}
+		}
+	}}
+	go func() {
+		defer w.queueing.Done()
+		w.pool.queue(job)
+	}()
+}
+
+// stop abandons files that are still waiting to complete, and returns once
+// the uploads of complete files are queued, so that the pool can be shut down.
+func (w *completionWaiter) stop() {
+	if w == nil {
+		return
+	}
+	defer func() {
+		// A paused pool would never take them; shutting it down resumes it
+		// next anyway.
+		if w.pool != nil {
+			w.pool.gate.stop()
+		}
+		w.queueing.Wait()
+	}()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	for localFile, file := range w.pending {
+		if file.timer != nil {
+			file.timer.Stop()
+		}
+		delete(w.pending, localFile)
+	}
+	if w.closeWrites != nil {
+		if err := w.closeWrites.close(); err != nil {
+			slog.Error("Could not close the close-write watcher", "error", err)
+		}
+	}
+}
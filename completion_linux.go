@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// closeWriteWatcher reports when a file that was open for writing is closed,
+// using an inotify instance of its own, as fsnotify does not expose
+// IN_CLOSE_WRITE.
+type closeWriteWatcher struct {
+	fd     int
+	file   *os.File // Wraps fd so that reads use the runtime poller
+	closed func(path string)
+
+	mu    sync.Mutex
+	paths map[int32]string // Watched files by watch descriptor
+	wds   map[string]int32 // Watch descriptors by file
+}
+
+// newCloseWriteWatcher starts watching for closed files, calling closed with
+// the path of each watched file that a writer closes or that is removed.
+func newCloseWriteWatcher(closed func(path string)) (*closeWriteWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	c := &closeWriteWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		closed: closed,
+		paths:  make(map[int32]string),
+		wds:    make(map[string]int32),
+	}
+	go c.run()
+	return c, nil
+}
+
+// watch starts watching a file for IN_CLOSE_WRITE.
+func (c *closeWriteWatcher) watch(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wd, err := syscall.InotifyAddWatch(c.fd, path, syscall.IN_CLOSE_WRITE|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	c.paths[int32(wd)] = path
+	c.wds[path] = int32(wd)
+	return nil
+}
+
+// unwatch stops watching a file.
+func (c *closeWriteWatcher) unwatch(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if wd, ok := c.wds[path]; ok {
+		_, _ = syscall.InotifyRmWatch(c.fd, uint32(wd))
+		delete(c.wds, path)
+		delete(c.paths, wd)
+	}
+}
+
+// close stops the watcher.
+func (c *closeWriteWatcher) close() error {
+	return c.file.Close()
+}
+
+// run reads inotify events until the watcher is closed.
+func (c *closeWriteWatcher) run() {
+	var buf [4096 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		n, err := c.file.Read(buf[:])
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				slog.Error("Could not read close-write events", "error", err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			c.mu.Lock()
+			path, ok := c.paths[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(c.paths, event.Wd)
+				if ok && c.wds[path] == event.Wd {
+					delete(c.wds, path)
+				}
+			}
+			c.mu.Unlock()
+			if ok && event.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+				c.closed(path)
+			}
+		}
+	}
+}
+
+// openForWriting reports whether any process has a file open for writing, by
+// looking through the file descriptors in /proc. Processes whose file
+// descriptors cannot be read, such as those of other users when not running
+// as root, are not seen.
+func openForWriting(path string) (bool, error) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, err
+	}
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Exited, or not ours to look at
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err != nil || target != path {
+				continue
+			}
+			if fdWritable(filepath.Join("/proc", proc.Name(), "fdinfo", fd.Name())) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// fdWritable reports whether the file descriptor described by an fdinfo file
+// was opened for writing.
+func fdWritable(fdinfo string) bool {
+	file, err := os.Open(fdinfo)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "flags:")
+		if !ok {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 64)
+		if err != nil {
+			return false
+		}
+		mode := flags & syscall.O_ACCMODE
+		return mode == syscall.O_WRONLY || mode == syscall.O_RDWR
+	}
+	return false
+}
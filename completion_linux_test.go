@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenForWriting(t *testing.T) {
+	localFile := filepath.Join(t.TempDir(), "a.txt")
+	writeLocal(t, localFile, "a")
+
+	writing, err := openForWriting(localFile)
+	require.NoError(t, err)
+	assert.False(t, writing)
+
+	reader, err := os.Open(localFile)
+	require.NoError(t, err)
+	defer func() { _ = reader.Close() }()
+	writing, err = openForWriting(localFile)
+	require.NoError(t, err)
+	assert.False(t, writing, "Readers are not writers")
+
+	writer, err := os.OpenFile(localFile, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	writing, err = openForWriting(localFile)
+	require.NoError(t, err)
+	assert.True(t, writing)
+
+	require.NoError(t, writer.Close())
+	writing, err = openForWriting(localFile)
+	require.NoError(t, err)
+	assert.False(t, writing)
+}
+
+func TestCompletionWaiter_writers(t *testing.T) {
+	for _, strategy := range []string{completeCloseWrite, completeNoWriters} {
+		t.Run(strategy, func(t *testing.T) {
+			waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Rules: []CompletionRule{
+				{Pattern: "*.bin", Strategy: strategy},
+			}})
+			localFile := filepath.Join(root, "a.bin")
+			writer, err := os.Create(localFile)
+			require.NoError(t, err)
+			_, err = writer.WriteString("partial")
+			require.NoError(t, err)
+
+			waiter.offer(localFile)
+			assertNotUploaded(t, mockUploader, "a.bin")
+
+			_, err = writer.WriteString(" and complete")
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+			assertUploaded(t, mockUploader, "a.bin", "partial and complete")
+		})
+	}
+
+	t.Run("close-write uploads files that were already closed", func(t *testing.T) {
+		waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Default: completeImmediate, Rules: []CompletionRule{
+			{Pattern: "*", Strategy: completeCloseWrite},
+		}})
+		writeLocal(t, filepath.Join(root, "a.bin"), "done")
+
+		waiter.offer(filepath.Join(root, "a.bin"))
+		assertUploaded(t, mockUploader, "a.bin", "done")
+		assert.Eventually(t, func() bool {
+			waiter.closeWrites.mu.Lock()
+			defer waiter.closeWrites.mu.Unlock()
+			return len(waiter.closeWrites.wds) == 0
+		}, time.Second, 5*time.Millisecond, "The file should no longer be watched")
+	})
+}
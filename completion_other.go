@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+// closeWriteWatcher is only available on Linux.
+type closeWriteWatcher struct{}
+
+func newCloseWriteWatcher(func(path string)) (*closeWriteWatcher, error) {
+	return nil, errCompletionUnsupported
+}
+
+func (c *closeWriteWatcher) watch(string) error { return errCompletionUnsupported }
+func (c *closeWriteWatcher) unwatch(string)     {}
+func (c *closeWriteWatcher) close() error       { return nil }
+
+// openForWriting is only available on Linux.
+func openForWriting(string) (bool, error) {
+	return false, errCompletionUnsupported
+}
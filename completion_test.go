@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWaiter creates a completion waiter uploading the files below a
+// temporary directory under their relative paths.
+func newTestWaiter(t *testing.T, config CompletionConfig) (*completionWaiter, *MockS3Uploader, string) {
+	t.Helper()
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	t.Cleanup(pool.Shutdown)
+
+	root := t.TempDir()
+	keyFor := func(localFile string) (string, error) {
+		rel, err := filepath.Rel(root, localFile)
+		return filepath.ToSlash(rel), err
+	}
+	if config.Default == "" {
+		config.Default = completeImmediate
+	}
+	if config.StableInterval == 0 {
+		config.StableInterval = 10 * time.Millisecond
+	}
+	waiter, err := newCompletionWaiter(config, root, keyFor, pool)
+	require.NoError(t, err)
+	t.Cleanup(waiter.stop)
+	return waiter, mockUploader, root
+}
+
+// uploaded returns the body of an uploaded object.
+func (m *MockS3Uploader) uploaded(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, ok := m.Bodies[key]
+	return body, ok
+}
+
+// assertUploaded waits for an object to be uploaded with the given body.
+func assertUploaded(t *testing.T, mockUploader *MockS3Uploader, key, body string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		uploaded, ok := mockUploader.uploaded(key)
+		return ok && uploaded == body
+	}, 2*time.Second, 5*time.Millisecond, "%s should be uploaded", key)
+}
+
+// assertNotUploaded checks that an object is not uploaded for a little while.
+func assertNotUploaded(t *testing.T, mockUploader *MockS3Uploader, key string) {
+	t.Helper()
+	time.Sleep(50 * time.Millisecond)
+	_, ok := mockUploader.uploaded(key)
+	assert.False(t, ok, "%s should not be uploaded", key)
+}
+
+func TestParseCompletionRule(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected CompletionRule
+		err      string
+	}{
+		{value: "*.mp4=stable", expected: CompletionRule{Pattern: "*.mp4", Strategy: completeStable}},
+		{value: "*=immediate", expected: CompletionRule{Pattern: "*", Strategy: completeImmediate}},
+		{value: "*.csv=marker:.done", expected: CompletionRule{Pattern: "*.csv", Strategy: completeMarker, Marker: ".done"}},
+		{value: "exports/**=marker:_SUCCESS", expected: CompletionRule{Pattern: "exports/**", Strategy: completeMarker, Marker: "_SUCCESS"}},
+		{value: "out/**=batch:_SUCCESS", expected: CompletionRule{Pattern: "out/**", Strategy: completeBatch, Marker: "_SUCCESS"}},
+		{value: "*=batch", err: "needs a marker"},
+		{value: "*=batch:.done", err: "invalid batch marker"},
+		{value: "*=batch:_manifest.json", err: "invalid batch marker"},
+		{value: "*.mp4", err: "must be PATTERN=STRATEGY"},
+		{value: "=stable", err: "must be PATTERN=STRATEGY"},
+		{value: "[=stable", err: "syntax error in pattern"},
+		{value: "*=eventually", err: "unknown strategy"},
+		{value: "*=marker", err: "needs a marker"},
+		{value: "*=marker:", err: "invalid marker"},
+		{value: "*=marker:done/_SUCCESS", err: "invalid marker"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			rule, err := parseCompletionRule(tc.value)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rule)
+		})
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		rel     string
+		match   bool
+	}{
+		{"*.csv", "a.csv", true},
+		{"*.csv", filepath.Join("deep", "dir", "a.csv"), true},
+		{"*.csv", "a.csv.done", false},
+		{"exports/*.csv", filepath.Join("exports", "a.csv"), true},
+		{"exports/*.csv", filepath.Join("other", "a.csv"), false},
+		{"exports/**", filepath.Join("exports", "day", "a.csv"), true},
+		{"exports/**", "exports", false},
+		{"exports/**", filepath.Join("exportsx", "a.csv"), false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.match, matchPattern(tc.pattern, tc.rel), "%s against %s", tc.pattern, tc.rel)
+	}
+}
+
+func TestCompletionWaiter_ruleFor(t *testing.T) {
+	waiter, _, root := newTestWaiter(t, CompletionConfig{Default: completeStable, Rules: []CompletionRule{
+		{Pattern: "*.tmp", Strategy: completeImmediate},
+		{Pattern: "*", Strategy: completeMarker, Marker: ".done"},
+	}})
+
+	assert.Equal(t, completeImmediate, waiter.ruleFor(filepath.Join(root, "a.tmp")).Strategy, "The first matching rule applies")
+	assert.Equal(t, completeMarker, waiter.ruleFor(filepath.Join(root, "a.csv")).Strategy)
+
+	waiter.config.Rules = waiter.config.Rules[:1]
+	assert.Equal(t, completeStable, waiter.ruleFor(filepath.Join(root, "a.csv")).Strategy, "Unmatched files use the default")
+}
+
+func TestCompletionWaiter_immediate(t *testing.T) {
+	waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{})
+	writeLocal(t, filepath.Join(root, "a.txt"), "a")
+
+	waiter.offer(filepath.Join(root, "a.txt"))
+	assertUploaded(t, mockUploader, "a.txt", "a")
+}
+
+func TestCompletionWaiter_stable(t *testing.T) {
+	waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Default: completeStable, StableChecks: 3, StableInterval: 30 * time.Millisecond})
+	localFile := filepath.Join(root, "a.txt")
+	writeLocal(t, localFile, "part")
+
+	waiter.offer(localFile)
+	time.Sleep(40 * time.Millisecond)
+	writeLocal(t, localFile, "partial") // Growing the file restarts the count
+	assertNotUploaded(t, mockUploader, "a.txt")
+	assertUploaded(t, mockUploader, "a.txt", "partial")
+}
+
+func TestCompletionWaiter_marker(t *testing.T) {
+	t.Run("A file with a marker suffix waits for its marker", func(t *testing.T) {
+		waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Rules: []CompletionRule{
+			{Pattern: "*.csv", Strategy: completeMarker, Marker: ".done"},
+		}})
+		localFile := filepath.Join(root, "a.csv")
+		writeLocal(t, localFile, "a,b")
+
+		waiter.offer(localFile)
+		assertNotUploaded(t, mockUploader, "a.csv")
+
+		writeLocal(t, localFile+".done", "")
+		files, ok := waiter.markedFiles(localFile + ".done")
+		assert.True(t, ok)
+		assert.Equal(t, []string{localFile}, files)
+		waiter.offer(localFile + ".done")
+		assertUploaded(t, mockUploader, "a.csv", "a,b")
+		assertNotUploaded(t, mockUploader, "a.csv.done")
+	})
+
+	t.Run("A marker file name marks every file in its directory", func(t *testing.T) {
+		waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Rules: []CompletionRule{
+			{Pattern: "exports/**", Strategy: completeMarker, Marker: "_SUCCESS"},
+		}})
+		dir := filepath.Join(root, "exports", "day")
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		writeLocal(t, filepath.Join(dir, "part-0"), "0")
+		writeLocal(t, filepath.Join(dir, "part-1"), "1")
+
+		waiter.offer(filepath.Join(dir, "part-0"))
+		assertNotUploaded(t, mockUploader, "exports/day/part-0")
+
+		writeLocal(t, filepath.Join(dir, "_SUCCESS"), "")
+		waiter.offer(filepath.Join(dir, "_SUCCESS"))
+		assertUploaded(t, mockUploader, "exports/day/part-0", "0")
+		assertUploaded(t, mockUploader, "exports/day/part-1", "1")
+		assertNotUploaded(t, mockUploader, "exports/day/_SUCCESS")
+	})
+
+	t.Run("The inbox removes a marker suffix with its file", func(t *testing.T) {
+		waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Rules: []CompletionRule{
+			{Pattern: "*", Strategy: completeMarker, Marker: ".done"},
+		}})
+		waiter.pool.EnableInbox(root, InboxConfig{Action: inboxDelete})
+		localFile := filepath.Join(root, "a.csv")
+		writeLocal(t, localFile, "a,b")
+		writeLocal(t, localFile+".done", "")
+
+		waiter.offer(localFile + ".done")
+		waiter.offer(localFile) // Already queued, so not uploaded twice
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(localFile + ".done")
+			return os.IsNotExist(err)
+		}, time.Second, 5*time.Millisecond)
+		assert.NoFileExists(t, localFile)
+		assert.True(t, waiter.pool.inbox.removed(localFile+".done"), "The marker's removal should not be propagated")
+		waiter.pool.Shutdown()
+		assert.Equal(t, int64(1), waiter.pool.Stats().Uploaded)
+		assert.Len(t, mockUploader.Uploads, 1)
+	})
+}
+
+func TestCompletionWaiter_stop(t *testing.T) {
+	waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{Default: completeStable})
+	localFile := filepath.Join(root, "a.txt")
+	writeLocal(t, localFile, "a")
+
+	waiter.offer(localFile)
+	waiter.stop()
+	assertNotUploaded(t, mockUploader, "a.txt")
+
+	waiter.offer(localFile)
+	assertNotUploaded(t, mockUploader, "a.txt")
+}
+
+func TestCompletionWaiter_stop_queuesCompleteFiles(t *testing.T) {
+	waiter, mockUploader, root := newTestWaiter(t, CompletionConfig{})
+	// A paused pool with a full queue holds back the uploads being queued.
+	require.True(t, waiter.pool.Pause())
+	for i := range 5 {
+		localFile := filepath.Join(root, fmt.Sprintf("%d.txt", i))
+		writeLocal(t, localFile, "a")
+		waiter.offer(localFile)
+	}
+
+	waiter.stop()
+	waiter.pool.Shutdown()
+	for i := range 5 {
+		_, ok := mockUploader.uploaded(fmt.Sprintf("%d.txt", i))
+		assert.True(t, ok, "%d.txt should be uploaded before the pool shuts down", i)
+	}
+}
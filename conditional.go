@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Conflict handlers accepted by the --on-conflict flag.
+const (
+	onConflictSkip      = "skip"         // Leave the remote object alone and report a failure
+	onConflictOverwrite = "overwrite"    // Upload unconditionally
+	onConflictKey       = "conflict-key" // Upload to a key with a conflict suffix instead
+)
+
+// errUploadConflict is returned when a conditional upload was skipped because
+// the remote object changed since it was last seen.
+var errUploadConflict = errors.New("remote object was modified by another writer")
+
+// etagCache tracks the last known ETag of every key written or seen by the
+// worker pool.
+type etagCache struct {
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{etags: make(map[string]string)}
+}
+
+func (c *etagCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	etag, ok := c.etags[key]
+	return etag, ok
+}
+
+func (c *etagCache) set(key, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.etags[key] = etag
+}
+
+func (c *etagCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.etags, key)
+}
+
+// isConditionalConflict reports whether err is S3 rejecting a conditional
+// write because the object no longer matches the precondition.
+func isConditionalConflict(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+// EnableConditionalWrites makes uploads conditional on the remote object
+// being unchanged since the pool last saw it: If-Match with the last known
+// ETag, or If-None-Match: * for keys that are not known to exist. Conflicts
+// are handled according to onConflict.
+func (p *UploadWorkerPool) EnableConditionalWrites(onConflict string) {
+	p.etags = newETagCache()
+	p.onConflict = onConflict
+}
+
+// RememberObjects records the ETags of listed objects, so that conditional
+// uploads succeed for objects that have not changed since they were listed.
+func (p *UploadWorkerPool) RememberObjects(objects map[string]types.Object) {
+	if p.etags == nil {
+		return
+	}
+	for key, obj := range objects {
+		p.etags.set(key, aws.ToString(obj.ETag))
+	}
+}
+
+// rememberETag records the ETag of an object written or read by the pool.
+func (p *UploadWorkerPool) rememberETag(key, etag string) {
+	if p.etags != nil && etag != "" {
+		p.etags.set(key, etag)
+	}
+}
+
+// forgetETag drops the ETag of an object deleted by the pool.
+func (p *UploadWorkerPool) forgetETag(key string) {
+	if p.etags != nil {
+		p.etags.forget(key)
+	}
+}
+
+// put uploads an object, applying conditional write preconditions when they
+// are enabled, and returns the key it was written to. body is rewound if the
+// upload has to be retried.
+func (p *UploadWorkerPool) put(ctx context.Context, input *s3.PutObjectInput, body io.Seeker) (*s3.PutObjectOutput, string, error) {
+	key := aws.ToString(input.Key)
+	if p.etags == nil {
+		output, err := p.uploader.Upload(ctx, input)
+		return output, key, err
+	}
+
+	if etag, ok := p.etags.get(key); ok {
+		input.IfMatch = aws.String(etag)
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	output, err := p.uploader.Upload(ctx, input)
+	if !isConditionalConflict(err) {
+		return output, key, err
+	}
+
+	logger := slog.With("op", opUpload.String(), "bucket", p.bucket, "key", key)
+	retry := *input
+	switch p.onConflict {
+	case onConflictOverwrite:
+		logger.Warn("Object was modified by another writer. Overwriting")
+		retry.IfMatch, retry.IfNoneMatch = nil, nil
+	case onConflictKey:
+		retry.IfMatch, retry.IfNoneMatch = nil, aws.String("*")
+		retry.Key = aws.String(conflictName(key, time.Now()))
+		logger.Warn("Object was modified by another writer. Uploading to a conflict key instead", "target", aws.ToString(retry.Key))
+	default:
+		logger.Warn("Object was modified by another writer. Skipping upload")
+		p.refreshETag(ctx, key)
+		return nil, key, fmt.Errorf("upload to s3://%s/%s skipped: %w", p.bucket, key, errUploadConflict)
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, key, err
+	}
+	output, err = p.uploader.Upload(ctx, &retry)
+	if err == nil && p.onConflict == onConflictKey {
+		p.refreshETag(ctx, key)
+	}
+	return output, aws.ToString(retry.Key), err
+}
+
+// refreshETag records the current ETag of an object another writer modified,
+// so that only the save that conflicted with it is reported as a conflict.
+func (p *UploadWorkerPool) refreshETag(ctx context.Context, key string) {
+	output, err := p.uploader.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// Checked against the object again on the next upload.
+		p.forgetETag(key)
+		return
+	}
+	p.rememberETag(key, aws.ToString(output.ETag))
+}
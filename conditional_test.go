@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadNow uploads a file through the pool and waits for the result.
+func uploadNow(t *testing.T, pool *UploadWorkerPool, localFile, s3Key string) JobResult {
+	t.Helper()
+	done := make(chan JobResult, 1)
+	pool.queue(UploadJob{op: opUpload, localFile: localFile, s3Key: s3Key, done: func(result JobResult) {
+		done <- result
+	}})
+	return <-done
+}
+
+func TestUploadWorkerPool_conditionalWrites(t *testing.T) {
+	ctx := context.Background()
+
+	// setup uploads a file once, then has another writer replace the object.
+	setup := func(t *testing.T, onConflict string) (*UploadWorkerPool, *MockS3Uploader, string) {
+		mockUploader := newMockS3Uploader()
+		pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+		pool.EnableConditionalWrites(onConflict)
+		t.Cleanup(pool.Shutdown)
+
+		localFile := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(localFile, []byte("v1"), 0644))
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+
+		require.NoError(t, os.WriteFile(localFile, []byte("v2"), 0644))
+		putRemote(t, mockUploader, "key", "from another host")
+		return pool, mockUploader, localFile
+	}
+
+	t.Run("Uploads of unchanged objects succeed", func(t *testing.T) {
+		mockUploader := newMockS3Uploader()
+		pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+		pool.EnableConditionalWrites(onConflictSkip)
+		defer pool.Shutdown()
+
+		localFile := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(localFile, []byte("v1"), 0644))
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.Equal(t, "*", *mockUploader.Uploads["key"].IfNoneMatch)
+
+		require.NoError(t, os.WriteFile(localFile, []byte("v2"), 0644))
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.NotNil(t, mockUploader.Uploads["key"].IfMatch)
+		assert.Equal(t, "v2", mockUploader.Bodies["key"])
+	})
+
+	t.Run("Skip leaves the remote object alone", func(t *testing.T) {
+		pool, mockUploader, localFile := setup(t, onConflictSkip)
+
+		result := uploadNow(t, pool, localFile, "key")
+		assert.ErrorIs(t, result.Err, errUploadConflict)
+		assert.Equal(t, "from another host", mockUploader.Bodies["key"])
+		assert.Equal(t, int64(1), pool.Stats().Failed)
+
+		// Only the save that conflicted is skipped.
+		for _, body := range []string{"v3", "v4"} {
+			require.NoError(t, os.WriteFile(localFile, []byte(body), 0644))
+			require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+			assert.Equal(t, body, mockUploader.Bodies["key"])
+		}
+	})
+
+	t.Run("Overwrite replaces the remote object", func(t *testing.T) {
+		pool, mockUploader, localFile := setup(t, onConflictOverwrite)
+
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.Equal(t, "v2", mockUploader.Bodies["key"])
+	})
+
+	t.Run("Conflict key uploads next to the remote object", func(t *testing.T) {
+		pool, mockUploader, localFile := setup(t, onConflictKey)
+
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.Equal(t, "from another host", mockUploader.Bodies["key"])
+
+		var conflictKeys []string
+		for key := range mockUploader.Bodies {
+			if strings.HasPrefix(key, "key.conflict-") {
+				conflictKeys = append(conflictKeys, key)
+			}
+		}
+		require.Len(t, conflictKeys, 1)
+		assert.Equal(t, "v2", mockUploader.Bodies[conflictKeys[0]])
+		head, err := mockUploader.HeadObject(ctx, &s3.HeadObjectInput{Key: aws.String(conflictKeys[0])})
+		require.NoError(t, err)
+		conflictETag, _ := pool.etags.get(conflictKeys[0])
+		assert.Equal(t, aws.ToString(head.ETag), conflictETag, "The ETag is recorded for the conflict key")
+
+		// Only the save that conflicted goes to a conflict key.
+		for _, body := range []string{"v3", "v4"} {
+			require.NoError(t, os.WriteFile(localFile, []byte(body), 0644))
+			require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+			assert.Equal(t, body, mockUploader.Bodies["key"])
+		}
+		conflictKeys = nil
+		for key := range mockUploader.Bodies {
+			if strings.HasPrefix(key, "key.conflict-") {
+				conflictKeys = append(conflictKeys, key)
+			}
+		}
+		assert.Len(t, conflictKeys, 1)
+	})
+
+	t.Run("Listed objects are not reported as conflicts", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		app.workerPool.EnableConditionalWrites(onConflictSkip)
+		putRemote(t, mockUploader, "test-prefix/file.txt", "old")
+		writeLocal(t, filepath.Join(tmpDir, "file.txt"), "new")
+
+		_, err := app.syncOnce(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "new", mockUploader.Bodies["test-prefix/file.txt"])
+	})
+}
+
+func TestIsConditionalConflict(t *testing.T) {
+	testCases := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{"Precondition failed", &smithy.GenericAPIError{Code: "PreconditionFailed"}, true},
+		{"Concurrent conditional request", &smithy.GenericAPIError{Code: "ConditionalRequestConflict"}, true},
+		{"Wrapped", fmt.Errorf("upload: %w", &smithy.GenericAPIError{Code: "PreconditionFailed"}), true},
+		{"Other API error", &smithy.GenericAPIError{Code: "AccessDenied"}, false},
+		{"Plain error", errors.New("boom"), false},
+		{"No error", nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, isConditionalConflict(tc.err))
+		})
+	}
+}
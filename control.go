@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// controlStatus is the response of GET /status on the control socket.
+type controlStatus struct {
+	Version    string    `json:"version"`
+	Direction  string    `json:"direction"`
+	LocalPath  string    `json:"local_path"`
+	Bucket     string    `json:"bucket"`
+	KeyPrefix  string    `json:"key_prefix"`
+	DryRun     bool      `json:"dry_run"`
+	Paused     bool      `json:"paused"`
+	StartedAt  time.Time `json:"started_at"`
+	Queued     int       `json:"queued"`
+	InFlight   int       `json:"in_flight"`
+	FailedJobs int       `json:"failed_jobs"` // Failed jobs waiting to be retried
+	Stats      PoolStats `json:"stats"`
+}
+
+// controlResult is the response of the control actions.
+type controlResult struct {
+	Message string       `json:"message"`
+	Summary *SyncSummary `json:"summary,omitempty"`
+	Stats   *PoolStats   `json:"stats,omitempty"`
+}
+
+// controlError is the body of an error response.
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// rescanRequest is the body of POST /rescan.
+type rescanRequest struct {
+	Path string `json:"path"` // Relative to the watched path, empty for all of it
+}
+
+// controlServer serves the control API for a running app.
+type controlServer struct {
+	app       *App
+	stop      context.CancelFunc // Stops the app's main loop
+	startedAt time.Time
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Could not write control response", "error", err)
+	}
+}
+
+// handler returns the control API routes.
+func (c *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("GET /jobs", c.handleJobs)
+	mux.HandleFunc("POST /pause", c.handlePause)
+	mux.HandleFunc("POST /resume", c.handleResume)
+	mux.HandleFunc("POST /retry", c.handleRetry)
+	mux.HandleFunc("POST /rescan", c.handleRescan)
+	mux.HandleFunc("POST /flush", c.handleFlush)
+	return mux
+}
+
+func (c *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	a := c.app
+	queued, inFlight, failed := a.workerPool.jobs.counts()
+	writeJSON(w, http.StatusOK, controlStatus{
+		Version:    Version,
+		Direction:  a.direction,
+		LocalPath:  a.localPath,
+		Bucket:     a.bucket,
+		KeyPrefix:  a.keyPrefix,
+		DryRun:     a.dryRun,
+		Paused:     a.workerPool.Paused(),
+		StartedAt:  c.startedAt,
+		Queued:     queued,
+		InFlight:   inFlight,
+		FailedJobs: failed,
+		Stats:      a.workerPool.Stats(),
+	})
+}
+
+func (c *controlServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.app.workerPool.Jobs())
+}
+
+func (c *controlServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !c.app.workerPool.Pause() {
+		writeJSON(w, http.StatusConflict, controlError{Error: "worker pool is shutting down"})
+		return
+	}
+	writeJSON(w, http.StatusOK, controlResult{Message: "paused"})
+}
+
+func (c *controlServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	c.app.workerPool.Resume()
+	writeJSON(w, http.StatusOK, controlResult{Message: "resumed"})
+}
+
+func (c *controlServer) handleRetry(w http.ResponseWriter, r *http.Request) {
+	n, err := c.app.workerPool.RetryFailed()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, controlError{Error: fmt.Sprintf("%d failed job(s) queued again: %v", n, err)})
+		return
+	}
+	writeJSON(w, http.StatusOK, controlResult{Message: fmt.Sprintf("%d failed job(s) queued again", n)})
+}
+
+func (c *controlServer) handleRescan(w http.ResponseWriter, r *http.Request) {
+	var req rescanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, controlError{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if c.app.direction != directionPush {
+		writeJSON(w, http.StatusConflict, controlError{Error: "rescan is only supported with --direction push"})
+		return
+	}
+
+	summary, err := c.app.rescan(r.Context(), req.Path)
+	if errors.Is(err, errQueueFull) || errors.Is(err, errPoolClosed) {
+		writeJSON(w, http.StatusServiceUnavailable, controlError{
+			Error: fmt.Sprintf("%v after queueing %d upload(s) and %d delete(s)", err, summary.Uploaded, summary.Deleted),
+		})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, controlError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, controlResult{Message: "rescan queued", Summary: &summary})
+}
+
+// handleFlush stops the main loop and responds once every queued job has been
+// processed. The process exits once the response has been sent.
+func (c *controlServer) handleFlush(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Flush requested through the control socket")
+	c.stop()
+
+	select {
+	case <-c.app.workerPool.Drained():
+	case <-r.Context().Done():
+		return
+	}
+	stats := c.app.workerPool.Stats()
+	writeJSON(w, http.StatusOK, controlResult{Message: "flushed", Stats: &stats})
+}
+
+// rescan compares a subtree of the watched path with S3 and queues uploads for
+// files that differ, and deletes for objects without a local file when
+// --delete is set. subtree is relative to the watched path. Jobs are queued
+// without waiting, so a paused pool with a full queue stops the rescan with
+// errQueueFull.
+func (a *App) rescan(ctx context.Context, subtree string) (SyncSummary, error) {
+	var summary SyncSummary
+
+	root := a.localPath
+	if a.isDir && subtree != "" {
+		root = filepath.Join(a.localPath, subtree)
+		if rel, err := filepath.Rel(a.localPath, root); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return summary, fmt.Errorf("path %q is outside of %s", subtree, a.localPath)
+		}
+	}
+	if _, err := os.Stat(root); err != nil {
+		return summary, fmt.Errorf("could not access %s: %w", root, err)
+	}
+
+	// Keys are in the subtree if their local paths are, as templated keys
+	// need not share a prefix.
+	inSubtree := func(string) bool { return true }
+	if root != a.localPath {
+		inSubtree = func(key string) bool {
+			localFile, err := a.localPathFor(key)
+			if err != nil {
+				return false
+			}
+			rel, err := filepath.Rel(root, localFile)
+			return err == nil && filepath.IsLocal(rel)
+		}
+	}
+
+	remote, err := a.listRemote(ctx)
+	if err != nil {
+		return summary, err
+	}
+	a.workerPool.RememberObjects(remote)
+	locals, paths, err := a.listLocal()
+	if err != nil {
+		return summary, err
+	}
+
+	slog.Info("Rescanning", "path", root, "bucket", a.bucket)
+	for s3Key, info := range locals {
+		if !inSubtree(s3Key) {
+			continue
+		}
+		obj, exists := remote[s3Key]
+		if needsUpload(info, obj, exists) {
+			if a.completion != nil {
+				a.completion.offer(paths[s3Key])
+			} else if err := a.workerPool.tryQueue(UploadJob{op: opUpload, localFile: paths[s3Key], s3Key: s3Key}); err != nil {
+				return summary, err
+			}
+			summary.Uploaded++
+		} else {
+			summary.Unchanged++
+		}
+	}
+	if a.delete {
+		for s3Key := range remote {
+			if _, exists := locals[s3Key]; !exists && inSubtree(s3Key) {
+				if err := a.workerPool.tryQueue(UploadJob{op: opDelete, s3Key: s3Key}); err != nil {
+					return summary, err
+				}
+				summary.Deleted++
+			}
+		}
+	}
+	return summary, nil
+}
+
+// listenUnix listens on a Unix socket at path, replacing a stale socket left
+// behind by a previous process. The socket is only accessible by its owner.
+func listenUnix(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("control socket %s is already in use", path)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("control socket path %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale control socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on control socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("could not restrict access to control socket %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// serveControl serves the control API on a Unix socket at path. stop is called
+// to stop the app's main loop when a flush is requested.
+func (a *App) serveControl(path string, stop context.CancelFunc) (*http.Server, error) {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+
+	control := &controlServer{app: a, stop: stop, startedAt: time.Now()}
+	server := &http.Server{Addr: path, Handler: control.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Control server failed", "path", path, "error", err)
+		}
+	}()
+	slog.Info("Serving control API", "path", path)
+	return server, nil
+}
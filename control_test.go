@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestControl starts a control server for a test app. The socket lives in
+// a short temporary directory because socket paths are limited in length.
+func newTestControl(t *testing.T) (*App, *MockS3Uploader, string, string, context.Context) {
+	t.Helper()
+	app, mockUploader, tmpDir := newTestApp(t, true, true)
+	app.direction = directionPush
+	t.Cleanup(app.workerPool.Shutdown)
+
+	socketDir, err := os.MkdirTemp("", "echos3")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(socketDir) })
+	socket := filepath.Join(socketDir, "ctl.sock")
+
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	server, err := app.serveControl(socket, stop)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = server.Close() })
+	return app, mockUploader, tmpDir, socket, ctx
+}
+
+// ctl runs the ctl subcommand and returns its exit status and output.
+func ctl(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runCtl(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestControl_statusAndJobs(t *testing.T) {
+	app, _, _, socket, _ := newTestControl(t)
+
+	code, stdout, _ := ctl(t, "--socket", socket, "status")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "s3://test-bucket/test-prefix")
+	assert.Contains(t, stdout, "running")
+
+	code, stdout, _ = ctl(t, "--socket", socket, "--json", "status")
+	require.Equal(t, 0, code)
+	var status controlStatus
+	require.NoError(t, json.Unmarshal([]byte(stdout), &status))
+	assert.Equal(t, directionPush, status.Direction)
+
+	// A failed job is listed and can be retried.
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	require.Error(t, uploadNow(t, app.workerPool, missing, "test-prefix/missing.txt").Err)
+
+	code, stdout, _ = ctl(t, "--socket", socket, "jobs")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "test-prefix/missing.txt")
+	assert.Contains(t, stdout, jobFailed)
+
+	code, stdout, _ = ctl(t, "--socket", socket, "retry")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "1 failed job(s) queued again")
+}
+
+func TestControl_pauseAndResume(t *testing.T) {
+	app, _, _, socket, _ := newTestControl(t)
+
+	code, _, _ := ctl(t, "--socket", socket, "pause")
+	require.Equal(t, 0, code)
+	assert.True(t, app.workerPool.Paused())
+
+	code, stdout, _ := ctl(t, "--socket", socket, "status")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "paused")
+
+	code, _, _ = ctl(t, "--socket", socket, "resume")
+	require.Equal(t, 0, code)
+	assert.False(t, app.workerPool.Paused())
+}
+
+func TestControl_rescan(t *testing.T) {
+	app, mockUploader, tmpDir, socket, _ := newTestControl(t)
+	writeLocal(t, filepath.Join(tmpDir, "sub", "a.txt"), "a")
+	writeLocal(t, filepath.Join(tmpDir, "other", "b.txt"), "b")
+	putRemote(t, mockUploader, "test-prefix/sub/stale.txt", "stale")
+	putRemote(t, mockUploader, "test-prefix/other/stale.txt", "stale")
+
+	code, stdout, _ := ctl(t, "--socket", socket, "rescan", "sub")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "1 upload(s) and 1 delete(s) queued")
+	app.workerPool.Shutdown()
+
+	assert.Equal(t, "a", mockUploader.Bodies["test-prefix/sub/a.txt"])
+	assert.NotContains(t, mockUploader.Bodies, "test-prefix/sub/stale.txt")
+	assert.NotContains(t, mockUploader.Bodies, "test-prefix/other/b.txt", "Files outside the subtree should be left alone")
+	assert.Contains(t, mockUploader.Bodies, "test-prefix/other/stale.txt")
+
+	code, _, stderr := ctl(t, "--socket", socket, "rescan", "../outside")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "outside of")
+}
+
+func TestControl_queueFull(t *testing.T) {
+	app, mockUploader, tmpDir, socket, _ := newTestControl(t)
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	require.Error(t, uploadNow(t, app.workerPool, missing, "test-prefix/missing.txt").Err)
+	writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a")
+
+	// Fill the queue of a paused pool, which would otherwise block requests.
+	require.True(t, app.workerPool.Pause())
+	filler := filepath.Join(t.TempDir(), "filler.txt")
+	writeLocal(t, filler, "filler")
+	// Each worker takes a job before it waits for the pool to resume.
+	pool := app.workerPool
+	workers := cap(pool.jobQueue) / 2
+	require.Eventually(t, func() bool {
+		for pool.tryQueue(UploadJob{op: opUpload, localFile: filler, s3Key: "test-prefix/filler.txt"}) == nil {
+		}
+		queued, _, _ := pool.jobs.counts()
+		return queued == cap(pool.jobQueue)+workers
+	}, 5*time.Second, 10*time.Millisecond)
+
+	code, _, stderr := ctl(t, "--socket", socket, "retry")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "0 failed job(s) queued again: job queue is full")
+	_, _, failed := app.workerPool.jobs.counts()
+	assert.Equal(t, 1, failed, "Jobs that could not be queued are still failed")
+
+	code, _, stderr = ctl(t, "--socket", socket, "rescan")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "job queue is full after queueing 0 upload(s)")
+
+	app.workerPool.Resume()
+	assert.Eventually(t, func() bool {
+		queued, _, _ := app.workerPool.jobs.counts()
+		return queued == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	code, stdout, _ := ctl(t, "--socket", socket, "rescan")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "1 upload(s)")
+	app.workerPool.Shutdown()
+	assert.Equal(t, "a", mockUploader.Bodies["test-prefix/a.txt"])
+}
+
+func TestControl_flush(t *testing.T) {
+	app, mockUploader, tmpDir, socket, ctx := newTestControl(t)
+	localFile := filepath.Join(tmpDir, "file.txt")
+	writeLocal(t, localFile, "data")
+
+	// Stand in for the main loop, which shuts the pool down once stopped.
+	app.workerPool.QueueUpload(localFile, "test-prefix/file.txt")
+	go func() {
+		<-ctx.Done()
+		app.workerPool.Shutdown()
+	}()
+
+	code, stdout, _ := ctl(t, "--socket", socket, "flush")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "flushed")
+	assert.Contains(t, stdout, "1 uploaded")
+	assert.Equal(t, "data", mockUploader.Bodies["test-prefix/file.txt"])
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestRunCtl_usage(t *testing.T) {
+	t.Setenv("ECHOS3_CONTROL_SOCKET", "")
+
+	code, _, stderr := ctl(t, "--socket", "/nonexistent.sock", "frobnicate")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage: echos3 ctl")
+
+	code, _, stderr = ctl(t, "status")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "--socket is required")
+
+	code, _, stderr = ctl(t, "--socket", filepath.Join(t.TempDir(), "missing.sock"), "status")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "could not reach echos3")
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "echos3")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	socket := filepath.Join(dir, "ctl.sock")
+
+	listener, err := listenUnix(socket)
+	require.NoError(t, err)
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = listenUnix(socket)
+	assert.ErrorContains(t, err, "already in use")
+	require.NoError(t, listener.Close())
+
+	regular := filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(regular, nil, 0644))
+	_, err = listenUnix(regular)
+	assert.ErrorContains(t, err, "not a socket")
+	assert.FileExists(t, regular)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// ctlCommands maps each ctl command to the control API request it sends.
+var ctlCommands = map[string]struct {
+	method string
+	path   string
+}{
+	"status": {http.MethodGet, "/status"},
+	"jobs":   {http.MethodGet, "/jobs"},
+	"pause":  {http.MethodPost, "/pause"},
+	"resume": {http.MethodPost, "/resume"},
+	"retry":  {http.MethodPost, "/retry"},
+	"rescan": {http.MethodPost, "/rescan"},
+	"flush":  {http.MethodPost, "/flush"},
+}
+
+const ctlUsage = `Usage: echos3 ctl [--socket PATH] [--json] COMMAND
+
+Commands:
+  status          Show the state of the running echos3
+  jobs            List queued, in-flight and failed jobs
+  pause           Stop starting new jobs
+  resume          Start processing jobs again
+  retry           Queue failed jobs again
+  rescan [PATH]   Compare PATH (relative to the watched path) with S3 and queue changes
+  flush           Stop watching, wait for queued jobs to finish and exit
+
+Flags:
+`
+
+// newControlClient returns an HTTP client that connects to the control socket.
+func newControlClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+// runCtl implements the ctl subcommand, which sends a command to a running
+// echos3 through its control socket. It returns the process exit status.
+func runCtl(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	socket := flags.String("socket", os.Getenv("ECHOS3_CONTROL_SOCKET"), "Path of the control socket (default: $ECHOS3_CONTROL_SOCKET).")
+	jsonOutput := flags.Bool("json", false, "Print the raw JSON response.")
+	flags.Usage = func() {
+		fmt.Fprint(stderr, ctlUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	command, ok := ctlCommands[flags.Arg(0)]
+	if !ok || (flags.NArg() > 1 && flags.Arg(0) != "rescan") || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+	if *socket == "" {
+		fmt.Fprintln(stderr, "echos3 ctl: --socket is required")
+		return 2
+	}
+
+	var body io.Reader
+	if flags.Arg(0) == "rescan" {
+		payload, err := json.Marshal(rescanRequest{Path: flags.Arg(1)})
+		if err != nil {
+			fmt.Fprintf(stderr, "echos3 ctl: %v\n", err)
+			return 1
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	response, err := sendControl(newControlClient(*socket), command.method, command.path, body)
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 ctl: %v\n", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		_, _ = stdout.Write(response)
+		return 0
+	}
+	if err := printControlResponse(stdout, flags.Arg(0), response); err != nil {
+		fmt.Fprintf(stderr, "echos3 ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// sendControl sends a request to the control API and returns the response
+// body. Error responses are returned as errors.
+func sendControl(client *http.Client, method, path string, body io.Reader) ([]byte, error) {
+	request, err := http.NewRequest(method, "http://echos3"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach echos3: %w", err)
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		var controlErr controlError
+		if json.Unmarshal(content, &controlErr) == nil && controlErr.Error != "" {
+			return nil, errors.New(controlErr.Error)
+		}
+		return nil, fmt.Errorf("unexpected response: %s", response.Status)
+	}
+	return content, nil
+}
+
+// printControlResponse prints a response in a human-readable form.
+func printControlResponse(w io.Writer, command string, response []byte) error {
+	switch command {
+	case "status":
+		var status controlStatus
+		if err := json.Unmarshal(response, &status); err != nil {
+			return err
+		}
+		state := "running"
+		if status.Paused {
+			state = "paused"
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Version:\t%s\n", status.Version)
+		fmt.Fprintf(tw, "Direction:\t%s\n", status.Direction)
+		fmt.Fprintf(tw, "Local path:\t%s\n", status.LocalPath)
+		fmt.Fprintf(tw, "Remote:\ts3://%s/%s\n", status.Bucket, status.KeyPrefix)
+		fmt.Fprintf(tw, "State:\t%s\n", state)
+		fmt.Fprintf(tw, "Dry run:\t%t\n", status.DryRun)
+		fmt.Fprintf(tw, "Started:\t%s\n", status.StartedAt.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Jobs:\t%d queued, %d in flight, %d failed\n", status.Queued, status.InFlight, status.FailedJobs)
+		fmt.Fprintf(tw, "Processed:\t%d uploaded, %d deleted, %d downloaded, %d failed\n",
+			status.Stats.Uploaded, status.Stats.Deleted, status.Stats.Downloaded, status.Stats.Failed)
+		return tw.Flush()
+
+	case "jobs":
+		var jobs []JobInfo
+		if err := json.Unmarshal(response, &jobs); err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			_, err := fmt.Fprintln(w, "No jobs")
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tOP\tSTATE\tSINCE\tKEY\tERROR")
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Op, job.State, job.Since.Format(time.RFC3339), job.Key, job.Error)
+		}
+		return tw.Flush()
+	}
+
+	var result controlResult
+	if err := json.Unmarshal(response, &result); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, result.Message)
+	if s := result.Summary; s != nil {
+		fmt.Fprintf(w, "%d upload(s) and %d delete(s) queued, %d file(s) unchanged\n", s.Uploaded, s.Deleted, s.Unchanged)
+	}
+	if s := result.Stats; s != nil {
+		fmt.Fprintf(w, "%d uploaded, %d deleted, %d downloaded, %d failed\n", s.Uploaded, s.Deleted, s.Downloaded, s.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// RecordedOp describes a write operation that a dry run would have performed.
+type RecordedOp struct {
+	Op     string
+	Bucket string
+	Key    string
+	Size   int64
+}
+
+// DryRunUploader is an S3Uploader that records and logs write operations
+// instead of performing them. Read-only operations are passed through to the
+// wrapped uploader so that reconciliation sees the real state of the bucket.
+type DryRunUploader struct {
+	next S3Uploader
+
+	mu  sync.Mutex
+	ops []RecordedOp
+}
+
+// NewDryRunUploader wraps an uploader so that no writes reach S3.
+func NewDryRunUploader(next S3Uploader) *DryRunUploader {
+	return &DryRunUploader{next: next}
+}
+
+// record stores and logs an intended operation.
+func (d *DryRunUploader) record(op RecordedOp) {
+	d.mu.Lock()
+	d.ops = append(d.ops, op)
+	d.mu.Unlock()
+
+	logger := slog.With("dry_run", true, "op", op.Op, "bucket", op.Bucket, "key", op.Key)
+	if op.Op == "PUT" {
+		logger = logger.With("bytes", op.Size)
+	}
+	logger.Info("Would " + op.Op)
+}
+
+// Ops returns the operations recorded so far.
+func (d *DryRunUploader) Ops() []RecordedOp {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]RecordedOp(nil), d.ops...)
+}
+
+// Upload records a PUT without sending the body to S3.
+func (d *DryRunUploader) Upload(_ context.Context, input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	size := aws.ToInt64(input.ContentLength)
+	if stater, ok := input.Body.(interface{ Stat() (os.FileInfo, error) }); ok && input.ContentLength == nil {
+		if info, err := stater.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	d.record(RecordedOp{Op: "PUT", Bucket: aws.ToString(input.Bucket), Key: aws.ToString(input.Key), Size: size})
+	return &s3.PutObjectOutput{}, nil
+}
+
+// DeleteObject records a DELETE without removing anything from S3.
+func (d *DryRunUploader) DeleteObject(_ context.Context, input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	d.record(RecordedOp{Op: "DELETE", Bucket: aws.ToString(input.Bucket), Key: aws.ToString(input.Key)})
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjectsV2 lists objects using the wrapped uploader.
+func (d *DryRunUploader) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return d.next.ListObjectsV2(ctx, input)
+}
+
+// GetObject retrieves an object using the wrapped uploader.
+func (d *DryRunUploader) GetObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return d.next.GetObject(ctx, input)
+}
+
+// HeadObject retrieves the metadata of an object using the wrapped uploader.
+func (d *DryRunUploader) HeadObject(ctx context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return d.next.HeadObject(ctx, input)
+}
+
+// ListObjectVersions lists object versions using the wrapped uploader.
+func (d *DryRunUploader) ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	return d.next.ListObjectVersions(ctx, input)
+}
+
+// RestoreObject records the restore request instead of sending it.
+func (d *DryRunUploader) RestoreObject(_ context.Context, input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	d.record(RecordedOp{Op: "RESTORE", Bucket: aws.ToString(input.Bucket), Key: aws.ToString(input.Key)})
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+// CopyObject records a COPY without copying anything in S3.
+func (d *DryRunUploader) CopyObject(_ context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	d.record(RecordedOp{Op: "COPY", Bucket: aws.ToString(input.Bucket), Key: aws.ToString(input.Key)})
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// HeadBucket checks the bucket using the wrapped uploader.
+func (d *DryRunUploader) HeadBucket(ctx context.Context, input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return d.next.HeadBucket(ctx, input)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDryRunTestApp sets up an App whose uploader records instead of writing.
+func newDryRunTestApp(t *testing.T, deleteFlag bool) (*App, *DryRunUploader, *MockS3Uploader, string) {
+	t.Helper()
+	app, mockUploader, tmpDir := newTestApp(t, deleteFlag, true)
+	app.workerPool.Shutdown()
+
+	dryRun := NewDryRunUploader(mockUploader)
+	app.uploader = dryRun
+	app.workerPool = NewUploadWorkerPool(dryRun, app.bucket, app.storageClass, 2)
+	return app, dryRun, mockUploader, tmpDir
+}
+
+func TestDryRunUploader(t *testing.T) {
+	t.Run("Watch mode records uploads and deletes without writing", func(t *testing.T) {
+		app, dryRun, mockUploader, tmpDir := newDryRunTestApp(t, true)
+		watcher, err := fsnotify.NewWatcher()
+		require.NoError(t, err)
+		defer func() { _ = watcher.Close() }()
+
+		testFile := filepath.Join(tmpDir, "file.txt")
+		require.NoError(t, os.WriteFile(testFile, []byte("12345"), 0644))
+
+		app.handleEvent(context.Background(), fsnotify.Event{Name: testFile, Op: fsnotify.Create}, watcher)
+		app.handleEvent(context.Background(), fsnotify.Event{Name: filepath.Join(tmpDir, "old.txt"), Op: fsnotify.Remove}, watcher)
+		app.workerPool.Shutdown()
+
+		assert.ElementsMatch(t, []RecordedOp{
+			{Op: "PUT", Bucket: "test-bucket", Key: "test-prefix/file.txt", Size: 5},
+			{Op: "DELETE", Bucket: "test-bucket", Key: "test-prefix/old.txt"},
+		}, dryRun.Ops())
+		assert.Empty(t, mockUploader.Uploads)
+		assert.Empty(t, mockUploader.Deletes)
+	})
+
+	t.Run("One-shot mode reconciles against the real listing", func(t *testing.T) {
+		app, dryRun, mockUploader, tmpDir := newDryRunTestApp(t, true)
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "new.txt"), []byte("new"), 0644))
+		mockUploader.Objects = []types.Object{
+			{Key: aws.String("test-prefix/stale.txt"), Size: aws.Int64(1), LastModified: aws.Time(time.Now())},
+		}
+
+		summary, err := app.syncOnce(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, SyncSummary{Uploaded: 1, Deleted: 1}, summary)
+		assert.ElementsMatch(t, []RecordedOp{
+			{Op: "PUT", Bucket: "test-bucket", Key: "test-prefix/new.txt", Size: 3},
+			{Op: "DELETE", Bucket: "test-bucket", Key: "test-prefix/stale.txt"},
+		}, dryRun.Ops())
+		assert.Empty(t, mockUploader.Uploads)
+		assert.Empty(t, mockUploader.Deletes)
+	})
+}
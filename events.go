@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Event statuses.
+const (
+	eventSuccess = "success"
+	eventFailure = "failure"
+)
+
+// Event describes the outcome of a worker pool job, as published to event
+// sinks.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Status    string    `json:"status"`
+	LocalPath string    `json:"local_path,omitempty"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	ETag      string    `json:"etag,omitempty"`
+	VersionID string    `json:"version_id,omitempty"`
+	Checksum  string    `json:"checksum_sha256,omitempty"`
+	Size      int64     `json:"size"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// EventSink receives an event for every job processed by the worker pool.
+type EventSink interface {
+	// Publish is called by the workers, so it must not block for long.
+	Publish(event Event)
+	// Close delivers any pending events and releases the sink's resources.
+	Close() error
+}
+
+// AddEventSink registers a sink to publish job events to. Sinks must be added
+// before jobs are queued, and are closed when the pool is shut down.
+func (p *UploadWorkerPool) AddEventSink(sink EventSink) {
+	p.sinks = append(p.sinks, sink)
+}
+
+// publish sends the outcome of a job to every sink.
+func (p *UploadWorkerPool) publish(result JobResult) {
+	if len(p.sinks) == 0 {
+		return
+	}
+
+	event := Event{
+		Time:      time.Now().UTC(),
+		Op:        result.Op.String(),
+		Status:    eventSuccess,
+		LocalPath: result.LocalFile,
+		Bucket:    p.bucket,
+		Key:       result.Key,
+		ETag:      result.ETag,
+		VersionID: result.VersionID,
+		Checksum:  result.Checksum,
+		Size:      result.Size,
+	}
+	if result.Err != nil {
+		event.Status = eventFailure
+		event.Error = result.Err.Error()
+	}
+	for _, sink := range p.sinks {
+		sink.Publish(event)
+	}
+}
+
+// closeSinks closes every sink once the workers have exited.
+func (p *UploadWorkerPool) closeSinks() {
+	for _, sink := range p.sinks {
+		if err := sink.Close(); err != nil {
+			slog.Error("Could not close event sink", "error", err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sys/unix"
+)
+
+// fanotifyMask is the set of fanotify events watched. Files are reported
+// when closed after writing rather than on every write, which would flood
+// the queue of a whole filesystem.
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO |
+	unix.FAN_CLOSE_WRITE | unix.FAN_ONDIR
+
+// fanotifyWatcher is the fanotify backend. It marks whole filesystems, so
+// that a tree of any size is watched without a watch per directory, and
+// filters the events of the filesystem down to the watched paths. It needs
+// CAP_SYS_ADMIN to mark filesystems and CAP_DAC_READ_SEARCH to map the file
+// handles of events back to paths.
+type fanotifyWatcher struct {
+	fd     int
+	file   *os.File // Wraps fd so that reads use the runtime poller
+	events chan fsnotify.Event
+	errors chan error
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	mountFDs map[unix.Fsid]int // A descriptor on each marked filesystem, to open file handles
+	dirs     map[string]string // Directories whose entries are watched, by real path
+	roots    map[string]string // Directories whose whole tree is watched, by real path
+}
+
+// newFanotifyWatcher creates a fanotify watcher, checking that fanotify
+// works for localPath with the privileges echos3 has.
+func newFanotifyWatcher(localPath string) (fileWatcher, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY)
+	if err != nil {
+		return nil, os.NewSyscallError("fanotify_init", err)
+	}
+	w := &fanotifyWatcher{
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "fanotify"),
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		mountFDs: make(map[unix.Fsid]int),
+		dirs:     make(map[string]string),
+		roots:    make(map[string]string),
+	}
+	if err := w.mark(localPath); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	// Events name files by handle, which only privileged processes open.
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, localPath, 0)
+	if err == nil {
+		var checkFD int
+		if checkFD, err = w.openHandle(localPath, handle); err == nil {
+			_ = unix.Close(checkFD)
+		}
+	}
+	if err != nil {
+		_ = w.Close()
+		return nil, fmt.Errorf("could not open file handles: %w", err)
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func (w *fanotifyWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *fanotifyWatcher) Errors() <-chan error          { return w.errors }
+
+// Add starts watching the entries of a directory.
+func (w *fanotifyWatcher) Add(dir string) error {
+	if err := w.mark(dir); err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[real] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+// AddTree starts watching every directory below root, including those on the
+// same filesystem created later. Filesystems mounted below root are not
+// watched.
+func (w *fanotifyWatcher) AddTree(root string) error {
+	if err := w.mark(root); err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.roots[real] = root
+	w.mu.Unlock()
+	return nil
+}
+
+// mark marks the filesystem path is on, unless it already is.
+func (w *fanotifyWatcher) mark(path string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.mountFDs[stat.Fsid]; ok {
+		return nil
+	}
+	if err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, path); err != nil {
+		return os.NewSyscallError("fanotify_mark", err)
+	}
+	mountFD, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	w.mountFDs[stat.Fsid] = mountFD
+	return nil
+}
+
+// openHandle opens a file handle on the filesystem path is on.
+func (w *fanotifyWatcher) openHandle(path string, handle unix.FileHandle) (int, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return -1, err
+	}
+	w.mu.Lock()
+	mountFD, ok := w.mountFDs[stat.Fsid]
+	w.mu.Unlock()
+	if !ok {
+		return -1, fmt.Errorf("filesystem of %s is not marked", path)
+	}
+	return unix.OpenByHandleAt(mountFD, handle, unix.O_PATH)
+}
+
+// Close stops the watcher.
+func (w *fanotifyWatcher) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	close(w.done)
+	err := w.file.Close()
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for fsid, mountFD := range w.mountFDs {
+		_ = unix.Close(mountFD)
+		delete(w.mountFDs, fsid)
+	}
+	return err
+}
+
+// run reads fanotify events until the watcher is closed.
+func (w *fanotifyWatcher) run() {
+	defer w.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.sendError(fmt.Errorf("could not read fanotify events: %w", err))
+			}
+			return
+		}
+		events, err := parseFanotifyEvents(buf[:n])
+		if err != nil {
+			w.sendError(err)
+		}
+		for _, event := range events {
+			if event.mask&unix.FAN_Q_OVERFLOW != 0 {
+				w.sendError(errors.New("fanotify queue overflowed, changes were missed"))
+				continue
+			}
+			path, ok := w.resolve(event)
+			if !ok {
+				continue
+			}
+			for _, op := range fanotifyOps(event.mask) {
+				select {
+				case w.events <- fsnotify.Event{Name: path, Op: op}:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// resolve returns the path an event is about, if it is watched, below the
+// path the directory was added as rather than its real path. Events in
+// directories that no longer exist cannot be resolved, and are dropped.
+func (w *fanotifyWatcher) resolve(event fanotifyEvent) (string, bool) {
+	if event.name == "" || event.name == "." {
+		return "", false
+	}
+	w.mu.Lock()
+	mountFD, ok := w.mountFDs[event.fsid]
+	w.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	dirFD, err := unix.OpenByHandleAt(mountFD, event.dir, unix.O_PATH)
+	if err != nil {
+		return "", false
+	}
+	defer unix.Close(dirFD)
+	dir, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(dirFD))
+	if err != nil {
+		return "", false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if added, ok := w.dirs[dir]; ok {
+		return filepath.Join(added, event.name), true
+	}
+	for real, added := range w.roots {
+		if dir == real || strings.HasPrefix(dir, real+string(filepath.Separator)) {
+			return filepath.Join(added, strings.TrimPrefix(dir, real), event.name), true
+		}
+	}
+	return "", false
+}
+
+// sendError reports an error unless the watcher is closed.
+func (w *fanotifyWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}
+
+// fanotifyEvent is an event read from a fanotify group reporting directory
+// file handles and names.
+type fanotifyEvent struct {
+	mask uint64
+	fsid unix.Fsid
+	dir  unix.FileHandle // The directory of the entry the event is about
+	name string          // The entry's name in dir
+}
+
+// parseFanotifyEvents parses the events read from a fanotify group. Each is
+// a struct fanotify_event_metadata followed by info records, of which the
+// FAN_EVENT_INFO_TYPE_DFID_NAME record holds a struct
+// fanotify_event_info_fid: the filesystem ID and the directory's struct
+// file_handle, followed by the entry's name.
+func parseFanotifyEvents(buf []byte) ([]fanotifyEvent, error) {
+	const metadataLen = 24
+	var events []fanotifyEvent
+	for len(buf) >= metadataLen {
+		eventLen := binary.NativeEndian.Uint32(buf[0:])
+		if eventLen < metadataLen || int(eventLen) > len(buf) {
+			return events, fmt.Errorf("invalid fanotify event length %d", eventLen)
+		}
+		if version := buf[4]; version != unix.FANOTIFY_METADATA_VERSION {
+			return events, fmt.Errorf("unsupported fanotify metadata version %d", version)
+		}
+		event := fanotifyEvent{mask: binary.NativeEndian.Uint64(buf[8:])}
+		info := buf[binary.NativeEndian.Uint16(buf[6:]):eventLen]
+		for len(info) >= 4 {
+			infoType, infoLen := info[0], int(binary.NativeEndian.Uint16(info[2:]))
+			if infoLen < 4 || infoLen > len(info) {
+				return events, fmt.Errorf("invalid fanotify info record length %d", infoLen)
+			}
+			if record := info[:infoLen]; infoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME && len(record) >= 20 {
+				event.fsid.Val[0] = int32(binary.NativeEndian.Uint32(record[4:]))
+				event.fsid.Val[1] = int32(binary.NativeEndian.Uint32(record[8:]))
+				handleBytes := int(binary.NativeEndian.Uint32(record[12:]))
+				handleType := int32(binary.NativeEndian.Uint32(record[16:]))
+				if 20+handleBytes > len(record) {
+					return events, fmt.Errorf("invalid fanotify file handle length %d", handleBytes)
+				}
+				event.dir = unix.NewFileHandle(handleType, record[20:20+handleBytes])
+				name := record[20+handleBytes:]
+				if i := bytes.IndexByte(name, 0); i >= 0 {
+					name = name[:i]
+				}
+				event.name = string(name)
+			}
+			info = info[infoLen:]
+		}
+		events = append(events, event)
+		buf = buf[eventLen:]
+	}
+	return events, nil
+}
+
+// fanotifyOps returns the fsnotify operations of a fanotify event mask.
+func fanotifyOps(mask uint64) []fsnotify.Op {
+	var ops []fsnotify.Op
+	if mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+		ops = append(ops, fsnotify.Create)
+	}
+	if mask&unix.FAN_CLOSE_WRITE != 0 {
+		ops = append(ops, fsnotify.Write)
+	}
+	if mask&unix.FAN_MOVED_FROM != 0 {
+		ops = append(ops, fsnotify.Rename)
+	}
+	if mask&unix.FAN_DELETE != 0 {
+		ops = append(ops, fsnotify.Remove)
+	}
+	return ops
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// newTestFanotifyWatcher creates a fanotify watcher, skipping the test where
+// fanotify is unavailable or echos3 lacks the privileges for it.
+func newTestFanotifyWatcher(t *testing.T, localPath string) *fanotifyWatcher {
+	t.Helper()
+	watcher, err := newFanotifyWatcher(localPath)
+	if err != nil {
+		t.Skipf("fanotify is not available: %v", err)
+	}
+	t.Cleanup(func() { _ = watcher.Close() })
+	return watcher.(*fanotifyWatcher)
+}
+
+// fanotifyRecord builds an event as read from a fanotify group reporting
+// directory file handles and names.
+func fanotifyRecord(mask uint64, fsid [2]int32, handleType int32, handle []byte, name string) []byte {
+	info := binary.NativeEndian.AppendUint32(nil, 0) // Type and length, set below
+	info = binary.NativeEndian.AppendUint32(info, uint32(fsid[0]))
+	info = binary.NativeEndian.AppendUint32(info, uint32(fsid[1]))
+	info = binary.NativeEndian.AppendUint32(info, uint32(len(handle)))
+	info = binary.NativeEndian.AppendUint32(info, uint32(handleType))
+	info = append(info, handle...)
+	info = append(info, name...)
+	info = append(info, 0)
+	for len(info)%4 != 0 {
+		info = append(info, 0)
+	}
+	info[0] = unix.FAN_EVENT_INFO_TYPE_DFID_NAME
+	binary.NativeEndian.PutUint16(info[2:], uint16(len(info)))
+
+	event := binary.NativeEndian.AppendUint32(nil, uint32(24+len(info)))
+	event = append(event, unix.FANOTIFY_METADATA_VERSION, 0)
+	event = binary.NativeEndian.AppendUint16(event, 24)
+	event = binary.NativeEndian.AppendUint64(event, mask)
+	event = binary.NativeEndian.AppendUint32(event, uint32(0xffffffff)) // FAN_NOFD
+	event = binary.NativeEndian.AppendUint32(event, 1234)
+	return append(event, info...)
+}
+
+func TestParseFanotifyEvents(t *testing.T) {
+	buf := append(
+		fanotifyRecord(unix.FAN_CREATE, [2]int32{1, 2}, 1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, "file.txt"),
+		fanotifyRecord(unix.FAN_DELETE|unix.FAN_ONDIR, [2]int32{3, 4}, 2, []byte{9, 10, 11, 12}, "sub")...,
+	)
+	events, err := parseFanotifyEvents(buf)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	assert.Equal(t, uint64(unix.FAN_CREATE), events[0].mask)
+	assert.Equal(t, [2]int32{1, 2}, events[0].fsid.Val)
+	assert.Equal(t, int32(1), events[0].dir.Type())
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, events[0].dir.Bytes())
+	assert.Equal(t, "file.txt", events[0].name)
+
+	assert.Equal(t, uint64(unix.FAN_DELETE|unix.FAN_ONDIR), events[1].mask)
+	assert.Equal(t, [2]int32{3, 4}, events[1].fsid.Val)
+	assert.Equal(t, "sub", events[1].name)
+
+	_, err = parseFanotifyEvents(buf[:len(buf)-4])
+	assert.ErrorContains(t, err, "invalid fanotify event length", "Truncated events are rejected")
+}
+
+func TestFanotifyOps(t *testing.T) {
+	assert.Equal(t, []fsnotify.Op{fsnotify.Create}, fanotifyOps(unix.FAN_CREATE))
+	assert.Equal(t, []fsnotify.Op{fsnotify.Create}, fanotifyOps(unix.FAN_MOVED_TO))
+	assert.Equal(t, []fsnotify.Op{fsnotify.Write}, fanotifyOps(unix.FAN_CLOSE_WRITE))
+	assert.Equal(t, []fsnotify.Op{fsnotify.Rename}, fanotifyOps(unix.FAN_MOVED_FROM))
+	assert.Equal(t, []fsnotify.Op{fsnotify.Remove}, fanotifyOps(unix.FAN_DELETE))
+	assert.Equal(t, []fsnotify.Op{fsnotify.Create, fsnotify.Write}, fanotifyOps(unix.FAN_CREATE|unix.FAN_CLOSE_WRITE), "Merged events are reported in order")
+	assert.Empty(t, fanotifyOps(unix.FAN_Q_OVERFLOW))
+}
+
+func TestFanotifyWatcher(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	w := newTestFanotifyWatcher(t, root)
+	require.NoError(t, w.AddTree(root))
+
+	// Wait for the next event about path, skipping any others.
+	next := func(path string, op fsnotify.Op) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-w.Events():
+				assert.NotContains(t, event.Name, outside, "Paths outside the tree are not reported")
+				if event.Name == path && event.Op == op {
+					return
+				}
+			case err := <-w.Errors():
+				t.Fatalf("Watcher error: %v", err)
+			case <-timeout:
+				t.Fatalf("No %s event for %s", op, path)
+			}
+		}
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "file.txt"), []byte("v1"), 0644))
+	sub := filepath.Join(root, "a", "b")
+	require.NoError(t, os.MkdirAll(sub, 0755))
+	next(filepath.Join(root, "a"), fsnotify.Create)
+	next(sub, fsnotify.Create)
+
+	file := filepath.Join(sub, "file.txt")
+	require.NoError(t, os.WriteFile(file, []byte("v1"), 0644))
+	next(file, fsnotify.Create)
+	next(file, fsnotify.Write)
+
+	require.NoError(t, os.Rename(file, filepath.Join(root, "moved.txt")))
+	next(file, fsnotify.Rename)
+	next(filepath.Join(root, "moved.txt"), fsnotify.Create)
+
+	require.NoError(t, os.Remove(filepath.Join(root, "moved.txt")))
+	next(filepath.Join(root, "moved.txt"), fsnotify.Remove)
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close(), "Closing twice is harmless")
+}
+
+func TestFanotifyWatcher_Add(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	require.NoError(t, os.MkdirAll(sub, 0755))
+	w := newTestFanotifyWatcher(t, dir)
+	require.NoError(t, w.Add(dir))
+
+	require.NoError(t, os.WriteFile(filepath.Join(sub, "ignored.txt"), []byte("v1"), 0644))
+	file := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(file, []byte("v1"), 0644))
+	select {
+	case event := <-w.Events():
+		assert.Equal(t, fsnotify.Event{Name: file, Op: fsnotify.Create}, event, "Only the entries of added directories are reported")
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event reported")
+	}
+}
+
+func TestNewFileWatcher_Fanotify(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := newFileWatcher(WatcherConfig{Backend: watcherFanotify}, dir)
+	require.NoError(t, err)
+	defer watcher.Close()
+	if fanotify, err := newFanotifyWatcher(dir); err != nil {
+		assert.IsType(t, fsnotifyWatcher{}, watcher, "fsnotify is used when fanotify is unavailable")
+	} else {
+		require.NoError(t, fanotify.Close())
+		assert.IsType(t, &fanotifyWatcher{}, watcher)
+	}
+
+	watcher, err = newFileWatcher(WatcherConfig{Backend: watcherFanotify}, filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	assert.IsType(t, fsnotifyWatcher{}, watcher, "fsnotify is used when fanotify fails")
+	require.NoError(t, watcher.Close())
+}
+
+func TestApp_run_fanotify(t *testing.T) {
+	app, mockUploader, tmpDir := newTestApp(t, false, true)
+	newTestFanotifyWatcher(t, tmpDir)
+	app.watcher = WatcherConfig{Backend: watcherFanotify}
+	app.health = app.newHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- app.run(ctx) }()
+	defer func() {
+		cancel()
+		assert.True(t, errors.Is(<-done, context.Canceled))
+	}()
+
+	require.Eventually(t, app.health.started.Load, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "sub", "deeper"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "sub", "deeper", "file.txt"), []byte("content"), 0644))
+	assert.Eventually(t, func() bool {
+		mockUploader.mu.Lock()
+		defer mockUploader.mu.Unlock()
+		return mockUploader.Bodies["test-prefix/sub/deeper/file.txt"] == "content"
+	}, 5*time.Second, 10*time.Millisecond, "Files in new directories are uploaded")
+}
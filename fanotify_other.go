@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newFanotifyWatcher is only available on Linux.
+func newFanotifyWatcher(string) (fileWatcher, error) {
+	return nil, errors.New("fanotify is only available on Linux")
+}
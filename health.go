@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// heartbeatInterval is how often the watch loop reports that it is alive.
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTimeout is how long the watch loop may go without a heartbeat
+	// before it is reported as stuck. It is generous because the loop blocks
+	// while the job queue is full.
+	heartbeatTimeout = 10 * time.Minute
+	// s3ProbeInterval is how long the result of an S3 reachability check is
+	// reused, so that frequent probes do not turn into frequent S3 requests.
+	s3ProbeInterval = 30 * time.Second
+	// s3ProbeTimeout bounds a single S3 reachability check.
+	s3ProbeTimeout = 5 * time.Second
+	// maxConsecutiveFailures is the number of S3 failures in a row after which
+	// the pool is considered to be in a persistent error state.
+	maxConsecutiveFailures = 5
+)
+
+// health tracks the state reported on /healthz and /readyz. All methods are
+// safe to call on a nil *health, which disables tracking.
+type health struct {
+	pool    *UploadWorkerPool
+	probeS3 func(ctx context.Context) error
+	now     func() time.Time
+
+	started    atomic.Bool  // The watch or poll loop has started
+	stopped    atomic.Bool  // The watch or poll loop has exited
+	scanned    atomic.Bool  // The initial scan has completed
+	lastBeat   atomic.Int64 // Unix nanoseconds of the last heartbeat
+	staleAfter atomic.Int64 // Heartbeat age after which the loop is stuck, 0 to disable
+
+	mu       sync.Mutex
+	probedAt time.Time
+	probeErr error
+}
+
+// loopStarted records that the main loop is running. staleAfter is how long
+// the loop may go without a heartbeat before it is reported as stuck; zero
+// disables the check for loops whose iterations may legitimately take long.
+func (h *health) loopStarted(staleAfter time.Duration) {
+	if h == nil {
+		return
+	}
+	h.staleAfter.Store(int64(staleAfter))
+	h.beat()
+	h.started.Store(true)
+}
+
+// loopStopped records that the main loop has exited.
+func (h *health) loopStopped() {
+	if h != nil {
+		h.stopped.Store(true)
+	}
+}
+
+// beat records that the main loop is still responsive.
+func (h *health) beat() {
+	if h != nil {
+		h.lastBeat.Store(h.now().UnixNano())
+	}
+}
+
+// initialScanDone records that the app has finished its initial scan.
+func (h *health) initialScanDone() {
+	if h != nil {
+		h.scanned.Store(true)
+	}
+}
+
+// live returns nil if the process and its main loop are alive.
+func (h *health) live() error {
+	if h.stopped.Load() {
+		return errors.New("main loop has exited")
+	}
+	if !h.started.Load() {
+		return nil // Still starting up
+	}
+	if staleAfter := time.Duration(h.staleAfter.Load()); staleAfter > 0 {
+		if age := h.now().Sub(time.Unix(0, h.lastBeat.Load())); age > staleAfter {
+			return fmt.Errorf("main loop has not responded for %s", age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// s3Reachable returns the result of the last S3 check, refreshing it when it
+// is older than s3ProbeInterval.
+func (h *health) s3Reachable(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.probedAt.IsZero() || h.now().Sub(h.probedAt) >= s3ProbeInterval {
+		probeCtx, cancel := context.WithTimeout(ctx, s3ProbeTimeout)
+		defer cancel()
+		h.probeErr = h.probeS3(probeCtx)
+		h.probedAt = h.now()
+	}
+	return h.probeErr
+}
+
+// readiness runs every readiness check and returns the results by name.
+func (h *health) readiness(ctx context.Context) map[string]error {
+	checks := map[string]error{
+		"live":         h.live(),
+		"initial_scan": nil,
+		"s3":           nil,
+		"queue":        nil,
+		"errors":       nil,
+	}
+	if !h.scanned.Load() {
+		checks["initial_scan"] = errors.New("initial scan has not completed")
+	}
+	if err := h.s3Reachable(ctx); err != nil {
+		checks["s3"] = fmt.Errorf("S3 is not reachable: %w", err)
+	}
+	if h.pool.saturated() {
+		checks["queue"] = errors.New("job queue is full")
+	}
+	if n := h.pool.consecutiveFailures.Load(); n >= maxConsecutiveFailures {
+		checks["errors"] = fmt.Errorf("last %d S3 operations failed", n)
+	}
+	return checks
+}
+
+// saturated reports whether the job queue is full, so that queueing another
+// job would block.
+func (p *UploadWorkerPool) saturated() bool {
+	return len(p.jobQueue) >= cap(p.jobQueue)
+}
+
+// isS3Failure reports whether err points at a problem talking to S3, as
+// opposed to a local file problem, a write conflict, a vetoed upload or a
+// cancellation.
+func isS3Failure(err error) bool {
+	switch errorClass(err) {
+	case "local_io", "conflict", "vetoed", "canceled":
+		return false
+	}
+	return true
+}
+
+// healthResponse is the body of /healthz and /readyz.
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// writeHealth writes the result of a set of checks, with a 503 status if any
+// of them failed.
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	response := healthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err == nil {
+			response.Checks[name] = "ok"
+			continue
+		}
+		response.Checks[name] = err.Error()
+		response.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Could not write health response", "error", err)
+	}
+}
+
+// register adds the /healthz and /readyz handlers to mux.
+func (h *health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]error{"live": h.live()})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.readiness(r.Context()))
+	})
+}
+
+// newHealth creates the health state for the app. S3 is considered reachable
+// if the key prefix can be listed.
+func (a *App) newHealth() *health {
+	return &health{
+		pool: a.workerPool,
+		probeS3: func(ctx context.Context) error {
+			_, err := a.uploader.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+				Bucket:  aws.String(a.bucket),
+				Prefix:  aws.String(a.remotePrefix()),
+				MaxKeys: aws.Int32(1),
+			})
+			return err
+		},
+		now: time.Now,
+	}
+}
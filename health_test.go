@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHealth sets up an App with health tracking and a controllable clock.
+func newTestHealth(t *testing.T) (*health, *MockS3Uploader, *time.Time) {
+	t.Helper()
+	app, mockUploader, _ := newTestApp(t, false, true)
+	t.Cleanup(app.workerPool.Shutdown)
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := app.newHealth()
+	h.now = func() time.Time { return now }
+	return h, mockUploader, &now
+}
+
+// getHealth requests path from the health handlers and decodes the response.
+func getHealth(t *testing.T, h *health, path string) (int, healthResponse) {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.register(mux)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var response healthResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+func TestHealth_liveness(t *testing.T) {
+	t.Run("Alive while starting up", func(t *testing.T) {
+		h, _, _ := newTestHealth(t)
+		code, _ := getHealth(t, h, "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Stuck loop is reported", func(t *testing.T) {
+		h, _, now := newTestHealth(t)
+		h.loopStarted(time.Minute)
+		*now = now.Add(30 * time.Second)
+		code, _ := getHealth(t, h, "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+
+		*now = now.Add(time.Minute)
+		code, response := getHealth(t, h, "/healthz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, response.Checks["live"], "has not responded")
+
+		h.beat()
+		code, _ = getHealth(t, h, "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Exited loop is reported", func(t *testing.T) {
+		h, _, _ := newTestHealth(t)
+		h.loopStarted(0)
+		h.loopStopped()
+		code, response := getHealth(t, h, "/healthz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, "unavailable", response.Status)
+	})
+}
+
+func TestHealth_readiness(t *testing.T) {
+	t.Run("Ready once the initial scan is done", func(t *testing.T) {
+		h, _, _ := newTestHealth(t)
+		code, response := getHealth(t, h, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, response.Checks["initial_scan"], "has not completed")
+
+		h.initialScanDone()
+		code, response = getHealth(t, h, "/readyz")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ok", response.Checks["s3"])
+	})
+
+	t.Run("S3 checks are cached", func(t *testing.T) {
+		h, mockUploader, now := newTestHealth(t)
+		h.initialScanDone()
+		mockUploader.ListErr = &smithy.GenericAPIError{Code: "AccessDenied"}
+
+		code, response := getHealth(t, h, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, response.Checks["s3"], "AccessDenied")
+
+		mockUploader.ListErr = nil
+		code, _ = getHealth(t, h, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code, "The failed check should be reused")
+
+		*now = now.Add(s3ProbeInterval)
+		code, _ = getHealth(t, h, "/readyz")
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Not ready after repeated S3 failures", func(t *testing.T) {
+		h, _, _ := newTestHealth(t)
+		h.initialScanDone()
+		h.pool.consecutiveFailures.Store(maxConsecutiveFailures)
+
+		code, response := getHealth(t, h, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, response.Checks["errors"], "S3 operations failed")
+	})
+}
+
+func TestUploadWorkerPool_saturated(t *testing.T) {
+	pool := &UploadWorkerPool{jobQueue: make(chan UploadJob, 2)}
+	assert.False(t, pool.saturated())
+	pool.jobQueue <- UploadJob{}
+	assert.False(t, pool.saturated())
+	pool.jobQueue <- UploadJob{}
+	assert.True(t, pool.saturated())
+}
+
+func TestUploadWorkerPool_consecutiveFailures(t *testing.T) {
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	defer pool.Shutdown()
+
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localFile, []byte("data"), 0644))
+
+	mockUploader.UploadErr = &smithy.GenericAPIError{Code: "InternalError", Fault: smithy.FaultServer}
+	uploadNow(t, pool, localFile, "a")
+	uploadNow(t, pool, localFile, "b")
+	assert.Equal(t, int64(2), pool.consecutiveFailures.Load())
+
+	// Local file errors say nothing about S3.
+	uploadNow(t, pool, filepath.Join(t.TempDir(), "missing.txt"), "c")
+	assert.Equal(t, int64(2), pool.consecutiveFailures.Load())
+
+	mockUploader.UploadErr = nil
+	require.NoError(t, uploadNow(t, pool, localFile, "d").Err)
+	assert.Equal(t, int64(0), pool.consecutiveFailures.Load())
+}
+
+func TestIsS3Failure(t *testing.T) {
+	_, openErr := os.Open(filepath.Join(t.TempDir(), "missing"))
+	assert.True(t, isS3Failure(&smithy.GenericAPIError{Code: "SlowDown"}))
+	assert.True(t, isS3Failure(errors.New("boom")))
+	assert.False(t, isS3Failure(openErr))
+	assert.False(t, isS3Failure(errUploadConflict))
+	assert.False(t, isS3Failure(context.Canceled))
+}
+
+func TestStartHTTP_sharedAddress(t *testing.T) {
+	app, _, _ := newTestApp(t, false, true)
+	defer app.workerPool.Shutdown()
+
+	servers, err := app.startHTTP("127.0.0.1:0", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Len(t, servers, 1, "Metrics and health should share a server")
+	defer func() { _ = servers[0].Close() }()
+
+	for _, path := range []string{"/metrics", "/healthz"} {
+		resp, err := http.Get("http://" + servers[0].Addr + path)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
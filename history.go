@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const historyUsage = `Usage: echos3 history [flags] FILE [/path/to/watch s3://bucket/key]
+
+Lists the versions and delete markers of the object a local file is mirrored
+to, newest first. The watched path and S3 path map the file to its key like
+watch mode does; without them, they are asked of the echos3 serving the
+control socket. Recover a version with echos3 restore --version-id.
+
+Flags:
+`
+
+// ObjectHistory lists the versions of the object a local file is mirrored to.
+type ObjectHistory struct {
+	LocalPath string         `json:"local_path"`
+	Bucket    string         `json:"bucket"`
+	Key       string         `json:"key"`
+	Versions  []HistoryEntry `json:"versions"`
+}
+
+// HistoryEntry is a version or a delete marker of an object.
+type HistoryEntry struct {
+	VersionID    string    `json:"version_id"`
+	LastModified time.Time `json:"last_modified"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	StorageClass string    `json:"storage_class,omitempty"`
+	Latest       bool      `json:"latest"`
+	DeleteMarker bool      `json:"delete_marker"`
+}
+
+// runHistory implements the history subcommand. It returns the process exit
+// status.
+func runHistory(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	socket := flags.String("socket", os.Getenv("ECHOS3_CONTROL_SOCKET"), "Control socket of the running echos3 to take the watched path and S3 path from (default: $ECHOS3_CONTROL_SOCKET).")
+	jsonOutput := flags.Bool("json", false, "Print the history as JSON.")
+	parseKeys := keyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, historyUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 && flags.NArg() != 3 {
+		flags.Usage()
+		return 2
+	}
+
+	keys, err := parseKeys()
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 history: %v\n", err)
+		return 2
+	}
+	app, err := newHistoryApp(ctx, flags.Args()[1:], *socket, keys)
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 history: %v\n", err)
+		return 1
+	}
+	history, err := app.history(ctx, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 history: %v\n", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(history)
+	} else {
+		err = printHistory(stdout, history)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 history: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newHistoryApp creates an App for the watched path and S3 path in args, or
+// for those of the echos3 serving the control socket if args is empty, that
+// maps files to keys with the given key mapping.
+func newHistoryApp(ctx context.Context, args []string, socket string, keys KeyConfig) (*App, error) {
+	var localPathArg, s3Path string
+	if len(args) == 2 {
+		localPathArg, s3Path = args[0], args[1]
+	} else {
+		if socket == "" {
+			return nil, errors.New("give the watched path and S3 path, or --socket to ask a running echos3")
+		}
+		response, err := sendControl(newControlClient(socket), http.MethodGet, "/status", nil)
+		if err != nil {
+			return nil, err
+		}
+		var status controlStatus
+		if err := json.Unmarshal(response, &status); err != nil {
+			return nil, err
+		}
+		localPathArg, s3Path = status.LocalPath, "s3://"+status.Bucket+"/"+status.KeyPrefix
+	}
+
+	localPath, pathInfo, err := setupLocalPath(localPathArg)
+	if err != nil {
+		return nil, err
+	}
+	bucket, keyPrefix, err := parseS3Path(s3Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 path: %w", err)
+	}
+	if !pathInfo.IsDir() {
+		keyPrefix = fileKey(keyPrefix, localPath)
+	}
+	s3Client, err := newS3Client(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	app := &App{
+		uploader:  s3Client,
+		localPath: localPath,
+		isDir:     pathInfo.IsDir(),
+		bucket:    bucket,
+		keyPrefix: keyPrefix,
+	}
+	if keys.enabled() {
+		if err := app.mapKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+	return app, nil
+}
+
+// history lists the versions and delete markers of the object a local file
+// is mirrored to, newest first. The file does not need to exist anymore.
+func (a *App) history(ctx context.Context, localFile string) (ObjectHistory, error) {
+	localFile, err := filepath.Abs(localFile)
+	if err != nil {
+		return ObjectHistory{}, err
+	}
+	if a.isDir {
+		if rel, err := filepath.Rel(a.localPath, localFile); err != nil || !filepath.IsLocal(rel) {
+			return ObjectHistory{}, fmt.Errorf("%s is not under the watched directory %s", localFile, a.localPath)
+		}
+	} else if localFile != a.localPath {
+		return ObjectHistory{}, fmt.Errorf("%s is not the watched file %s", localFile, a.localPath)
+	}
+	s3Key, err := a.s3KeyFor(localFile)
+	if err != nil {
+		return ObjectHistory{}, err
+	}
+
+	history := ObjectHistory{LocalPath: localFile, Bucket: a.bucket, Key: s3Key, Versions: []HistoryEntry{}}
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(s3Key),
+	}
+	for {
+		output, err := a.uploader.ListObjectVersions(ctx, input)
+		if err != nil {
+			return history, fmt.Errorf("could not list versions of s3://%s/%s: %w", a.bucket, s3Key, err)
+		}
+		// The prefix also matches longer keys, such as "a.txt.bak".
+		for _, v := range output.Versions {
+			if aws.ToString(v.Key) == s3Key {
+				history.Versions = append(history.Versions, HistoryEntry{
+					VersionID:    aws.ToString(v.VersionId),
+					LastModified: aws.ToTime(v.LastModified),
+					Size:         aws.ToInt64(v.Size),
+					ETag:         aws.ToString(v.ETag),
+					StorageClass: string(v.StorageClass),
+					Latest:       aws.ToBool(v.IsLatest),
+				})
+			}
+		}
+		for _, marker := range output.DeleteMarkers {
+			if aws.ToString(marker.Key) == s3Key {
+				history.Versions = append(history.Versions, HistoryEntry{
+					VersionID:    aws.ToString(marker.VersionId),
+					LastModified: aws.ToTime(marker.LastModified),
+					Latest:       aws.ToBool(marker.IsLatest),
+					DeleteMarker: true,
+				})
+			}
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+
+	sort.SliceStable(history.Versions, func(i, j int) bool {
+		return history.Versions[i].LastModified.After(history.Versions[j].LastModified)
+	})
+	return history, nil
+}
+
+// printHistory prints a history as a table.
+func printHistory(w io.Writer, history ObjectHistory) error {
+	if len(history.Versions) == 0 {
+		_, err := fmt.Fprintf(w, "No versions of s3://%s/%s\n", history.Bucket, history.Key)
+		return err
+	}
+	fmt.Fprintf(w, "Versions of s3://%s/%s:\n", history.Bucket, history.Key)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION ID\tLAST MODIFIED\tSIZE\tSTATE")
+	for _, v := range history.Versions {
+		state := ""
+		switch {
+		case v.DeleteMarker && v.Latest:
+			state = "deleted (latest)"
+		case v.DeleteMarker:
+			state = "deleted"
+		case v.Latest:
+			state = "latest"
+		}
+		size := fmt.Sprint(v.Size)
+		if v.DeleteMarker {
+			size = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.VersionID, v.LastModified.Format(time.RFC3339), size, state)
+	}
+	return tw.Flush()
+}
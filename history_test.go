@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApp_history(t *testing.T) {
+	ctx := context.Background()
+	modified := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	t.Run("Versions and delete markers are listed newest first", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		putVersion(mockUploader, "test-prefix/dir/a.txt", "v1", "one", modified)
+		putVersion(mockUploader, "test-prefix/dir/a.txt", "v2", "two!", modified.Add(2*time.Hour))
+		putVersion(mockUploader, "test-prefix/dir/a.txt.bak", "b1", "backup", modified.Add(3*time.Hour))
+		mockUploader.DeleteMarkers = append(mockUploader.DeleteMarkers, types.DeleteMarkerEntry{
+			Key: aws.String("test-prefix/dir/a.txt"), VersionId: aws.String("d1"), LastModified: aws.Time(modified.Add(time.Hour)),
+		})
+		mockUploader.Versions[1].IsLatest = aws.Bool(true)
+
+		history, err := app.history(ctx, filepath.Join(tmpDir, "dir", "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "test-prefix/dir/a.txt", history.Key)
+		assert.Equal(t, []HistoryEntry{
+			{VersionID: "v2", LastModified: modified.Add(2 * time.Hour), Size: 4, Latest: true},
+			{VersionID: "d1", LastModified: modified.Add(time.Hour), DeleteMarker: true},
+			{VersionID: "v1", LastModified: modified, Size: 3},
+		}, history.Versions)
+	})
+
+	t.Run("Files must be under the watched path", func(t *testing.T) {
+		app, _, _ := newTestApp(t, false, true)
+		_, err := app.history(ctx, t.TempDir())
+		assert.ErrorContains(t, err, "is not under the watched directory")
+
+		app.isDir = false
+		app.localPath = filepath.Join(t.TempDir(), "report.csv")
+		_, err = app.history(ctx, filepath.Join(filepath.Dir(app.localPath), "other.csv"))
+		assert.ErrorContains(t, err, "is not the watched file")
+	})
+
+	t.Run("Files are mapped to keys like the watch does", func(t *testing.T) {
+		app, mockUploader, tmpDir := newKeysTestApp(t, "archive/{ext}/{path}")
+		putVersion(mockUploader, "test-prefix/archive/.txt/dir/a.txt", "v1", "one", modified)
+
+		history, err := app.history(ctx, filepath.Join(tmpDir, "dir", "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "test-prefix/archive/.txt/dir/a.txt", history.Key)
+		require.Len(t, history.Versions, 1)
+		assert.Equal(t, "v1", history.Versions[0].VersionID)
+	})
+
+	t.Run("A watched file maps to the key prefix", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, false)
+		app.localPath = filepath.Join(tmpDir, "report.csv")
+		app.keyPrefix = "reports/latest.csv"
+		putVersion(mockUploader, "reports/latest.csv", "v1", "1,2", modified)
+
+		history, err := app.history(ctx, app.localPath)
+		require.NoError(t, err)
+		require.Len(t, history.Versions, 1)
+		assert.Equal(t, "v1", history.Versions[0].VersionID)
+	})
+}
+
+func TestNewHistoryApp_controlSocket(t *testing.T) {
+	app, _, tmpDir, socket, ctx := newTestControl(t)
+
+	historyApp, err := newHistoryApp(ctx, nil, socket, KeyConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, tmpDir, historyApp.localPath)
+	assert.True(t, historyApp.isDir)
+	assert.Equal(t, app.bucket, historyApp.bucket)
+	assert.Equal(t, app.keyPrefix, historyApp.keyPrefix)
+
+	_, err = newHistoryApp(ctx, nil, "", KeyConfig{})
+	assert.ErrorContains(t, err, "--socket")
+}
+
+func TestNewHistoryApp_keys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keys, err := parseKeyConfig("archive/{path}", nil)
+	require.NoError(t, err)
+
+	app, err := newHistoryApp(ctx, []string{dir, "s3://bucket/prefix"}, "", keys)
+	require.NoError(t, err)
+	s3Key, err := app.s3KeyFor(filepath.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "prefix/archive/a.txt", s3Key)
+
+	file := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(file, []byte("a"), 0644))
+	_, err = newHistoryApp(ctx, []string{file, "s3://bucket/prefix"}, "", keys)
+	assert.ErrorContains(t, err, "require a directory")
+}
+
+func TestPrintHistory(t *testing.T) {
+	modified := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	history := ObjectHistory{Bucket: "bucket", Key: "a.txt"}
+	require.NoError(t, printHistory(&out, history))
+	assert.Equal(t, "No versions of s3://bucket/a.txt\n", out.String())
+
+	out.Reset()
+	history.Versions = []HistoryEntry{
+		{VersionID: "d1", LastModified: modified.Add(time.Hour), DeleteMarker: true, Latest: true},
+		{VersionID: "v1", LastModified: modified, Size: 3},
+	}
+	require.NoError(t, printHistory(&out, history))
+	assert.Equal(t, "Versions of s3://bucket/a.txt:\n"+
+		"VERSION ID  LAST MODIFIED         SIZE  STATE\n"+
+		"d1          2026-10-16T11:00:00Z  -     deleted (latest)\n"+
+		"v1          2026-10-16T10:00:00Z  3     \n", out.String())
+}
+
+func TestRunHistory_usage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"a.txt", "/path/to/watch"},
+		{"--no-such-flag", "a.txt"},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 2, runHistory(context.Background(), args, &stdout, &stderr), "%v", args)
+		assert.Empty(t, stdout.String())
+	}
+}
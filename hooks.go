@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHookOutput is the number of bytes of hook output included in errors.
+const maxHookOutput = 512
+
+// errUploadVetoed is returned when a pre-upload hook rejected an upload.
+var errUploadVetoed = errors.New("upload vetoed by pre-upload hook")
+
+// HookConfig holds the commands run around each upload.
+type HookConfig struct {
+	PreUpload     string        // Run before each upload. A non-zero exit vetoes the upload
+	PostUpload    string        // Run after each successful upload
+	Timeout       time.Duration // Time a hook may run before it is killed, 0 for no limit
+	MaxConcurrent int           // Hooks that may run at once, 0 for no limit beyond the workers
+}
+
+// hookRunner runs the configured hooks. All methods are safe to call on a nil
+// *hookRunner, which runs no hooks.
+type hookRunner struct {
+	config HookConfig
+	slots  chan struct{} // Limits concurrent hooks when non-nil
+}
+
+// EnableHooks runs the configured commands before and after every upload.
+// Commands are run by the shell with the job described in ECHOS3_*
+// environment variables.
+func (p *UploadWorkerPool) EnableHooks(config HookConfig) {
+	runner := &hookRunner{config: config}
+	if config.MaxConcurrent > 0 {
+		runner.slots = make(chan struct{}, config.MaxConcurrent)
+	}
+	p.hooks = runner
+}
+
+// uploadWithHooks uploads a file, running the pre-upload hook before and the
+// post-upload hook after it. In archive mode the key is chosen first, and the
+// latest key is updated before the post-upload hook runs. In inbox mode the
+// file is then removed, so that the post-upload hook can still read it.
+func (p *UploadWorkerPool) uploadWithHooks(ctx context.Context, result *JobResult) error {
+	key, err := p.archive.keyFor(result.LocalFile, result.Key, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not choose archive key: %w", err)
+	}
+	result.Key = key
+	if err := p.hooks.preUpload(ctx, p.bucket, result); err != nil {
+		return err
+	}
+	var before os.FileInfo
+	if p.inbox != nil {
+		before, _ = os.Stat(result.LocalFile)
+	}
+	if err := p.processUpload(ctx, result); err != nil {
+		return err
+	}
+	p.archive.rotate(ctx, p, result.Key)
+	p.hooks.postUpload(ctx, p.bucket, result)
+	p.inbox.collect(result, before)
+	return nil
+}
+
+// preUpload runs the pre-upload hook, returning an error wrapping
+// errUploadVetoed if it did not succeed.
+func (h *hookRunner) preUpload(ctx context.Context, bucket string, result *JobResult) error {
+	if h == nil || h.config.PreUpload == "" {
+		return nil
+	}
+	if err := h.run(ctx, h.config.PreUpload, hookEnv("pre-upload", bucket, result)); err != nil {
+		return fmt.Errorf("%w: %v", errUploadVetoed, err)
+	}
+	return nil
+}
+
+// postUpload runs the post-upload hook. The upload has already happened, so
+// failures are only logged.
+func (h *hookRunner) postUpload(ctx context.Context, bucket string, result *JobResult) {
+	if h == nil || h.config.PostUpload == "" {
+		return
+	}
+	if err := h.run(ctx, h.config.PostUpload, hookEnv("post-upload", bucket, result)); err != nil {
+		slog.Error("Post-upload hook failed", "op", result.Op.String(), "path", result.LocalFile,
+			"bucket", bucket, "key", result.Key, "error", err)
+	}
+}
+
+// hookEnv returns the environment variables describing a job to a hook.
+func hookEnv(hook, bucket string, result *JobResult) []string {
+	env := []string{
+		"ECHOS3_HOOK=" + hook,
+		"ECHOS3_OP=" + result.Op.String(),
+		"ECHOS3_LOCAL_PATH=" + result.LocalFile,
+		"ECHOS3_BUCKET=" + bucket,
+		"ECHOS3_KEY=" + result.Key,
+	}
+	if hook == "post-upload" {
+		env = append(env,
+			"ECHOS3_ETAG="+result.ETag,
+			"ECHOS3_VERSION_ID="+result.VersionID,
+			"ECHOS3_SIZE="+strconv.FormatInt(result.Size, 10),
+		)
+	}
+	return env
+}
+
+// shellCommand returns the command that runs command with the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// run runs a hook command once a slot is free, and returns an error including
+// the end of its output if it fails or times out.
+func (h *hookRunner) run(ctx context.Context, command string, env []string) error {
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+			defer func() { <-h.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if h.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.config.Timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = time.Second // Don't wait for children holding the output open
+
+	start := time.Now()
+	err := cmd.Run()
+	slog.Debug("Ran hook", "command", command, "duration", time.Since(start), "output", output.String(), "error", err)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", h.config.Timeout)
+	}
+	if tail := lastBytes(strings.TrimSpace(output.String()), maxHookOutput); tail != "" {
+		return fmt.Errorf("hook %q failed: %v: %s", command, err, tail)
+	}
+	return fmt.Errorf("hook %q failed: %v", command, err)
+}
+
+// lastBytes returns the last n bytes of s.
+func lastBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
+}
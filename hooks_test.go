@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHookTestPool creates a pool with hooks and a file to upload.
+func newHookTestPool(t *testing.T, config HookConfig) (*UploadWorkerPool, *MockS3Uploader, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Hook tests use POSIX shell commands")
+	}
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	pool.EnableHooks(config)
+	t.Cleanup(pool.Shutdown)
+
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localFile, []byte("12345"), 0644))
+	return pool, mockUploader, localFile
+}
+
+func TestHooks_preUpload(t *testing.T) {
+	t.Run("A successful pre-upload hook lets the upload through", func(t *testing.T) {
+		envFile := filepath.Join(t.TempDir(), "env")
+		pool, mockUploader, localFile := newHookTestPool(t, HookConfig{
+			PreUpload: `echo "$ECHOS3_HOOK $ECHOS3_OP $ECHOS3_BUCKET $ECHOS3_KEY $ECHOS3_LOCAL_PATH" > ` + envFile,
+		})
+
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.Equal(t, "12345", mockUploader.Bodies["key"])
+		assert.Equal(t, "pre-upload upload test-bucket key "+localFile+"\n", readLocal(t, envFile))
+	})
+
+	t.Run("A failing pre-upload hook vetoes the upload", func(t *testing.T) {
+		pool, mockUploader, localFile := newHookTestPool(t, HookConfig{PreUpload: "echo infected >&2; exit 3"})
+
+		result := uploadNow(t, pool, localFile, "key")
+		assert.ErrorIs(t, result.Err, errUploadVetoed)
+		assert.Contains(t, result.Err.Error(), "infected")
+		assert.NotContains(t, mockUploader.Bodies, "key")
+		assert.Equal(t, "vetoed", errorClass(result.Err))
+	})
+
+	t.Run("A pre-upload hook that times out vetoes the upload", func(t *testing.T) {
+		pool, mockUploader, localFile := newHookTestPool(t, HookConfig{PreUpload: "sleep 5", Timeout: 50 * time.Millisecond})
+
+		start := time.Now()
+		result := uploadNow(t, pool, localFile, "key")
+		assert.ErrorIs(t, result.Err, errUploadVetoed)
+		assert.Contains(t, result.Err.Error(), "timed out")
+		assert.Less(t, time.Since(start), 4*time.Second)
+		assert.NotContains(t, mockUploader.Bodies, "key")
+	})
+}
+
+func TestHooks_postUpload(t *testing.T) {
+	t.Run("The post-upload hook receives the result of the upload", func(t *testing.T) {
+		envFile := filepath.Join(t.TempDir(), "env")
+		pool, _, localFile := newHookTestPool(t, HookConfig{
+			PostUpload: `echo "$ECHOS3_HOOK $ECHOS3_KEY $ECHOS3_ETAG $ECHOS3_SIZE" > ` + envFile,
+		})
+
+		result := uploadNow(t, pool, localFile, "key")
+		require.NoError(t, result.Err)
+		assert.Equal(t, "post-upload key "+result.ETag+" 5\n", readLocal(t, envFile))
+	})
+
+	t.Run("A failing post-upload hook does not fail the upload", func(t *testing.T) {
+		pool, mockUploader, localFile := newHookTestPool(t, HookConfig{PostUpload: "exit 1"})
+
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.Equal(t, "12345", mockUploader.Bodies["key"])
+	})
+
+	t.Run("The post-upload hook does not run after a failed upload", func(t *testing.T) {
+		marker := filepath.Join(t.TempDir(), "ran")
+		pool, _, _ := newHookTestPool(t, HookConfig{PostUpload: "touch " + marker})
+
+		require.Error(t, uploadNow(t, pool, filepath.Join(t.TempDir(), "missing.txt"), "key").Err)
+		assert.NoFileExists(t, marker)
+	})
+}
+
+func TestHookRunner_concurrency(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hook tests use POSIX shell commands")
+	}
+	runner := &hookRunner{config: HookConfig{MaxConcurrent: 1}, slots: make(chan struct{}, 1)}
+
+	// Hold the only slot, so that a hook has to wait for it.
+	runner.slots <- struct{}{}
+	var ran atomic.Bool
+	done := make(chan error, 1)
+	go func() {
+		err := runner.run(context.Background(), "true", nil)
+		ran.Store(true)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, ran.Load(), "The hook should wait for a free slot")
+	<-runner.slots
+	require.NoError(t, <-done)
+
+	// A cancelled context stops waiting for a slot.
+	runner.slots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, runner.run(ctx, "true", nil), context.Canceled)
+}
+
+func TestLastBytes(t *testing.T) {
+	assert.Equal(t, "short", lastBytes("short", 10))
+	assert.Equal(t, "...6789", lastBytes("0123456789", 4))
+	assert.True(t, strings.HasPrefix(lastBytes(strings.Repeat("x", 1000), maxHookOutput), "..."))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Inbox actions, which decide what happens to a local file once it has been
+// uploaded.
+const (
+	inboxDelete = "delete"
+	inboxMove   = "move"
+)
+
+// inboxForgetAfter is how long the inbox remembers the files it removed, so
+// that the file system events caused by their removal are ignored.
+const inboxForgetAfter = time.Minute
+
+// InboxConfig configures inbox mode, where the watched directory is a drop
+// folder that files leave once they have been uploaded.
+type InboxConfig struct {
+	Action     string // inboxDelete or inboxMove
+	ArchiveDir string // Where inboxMove puts uploaded files
+}
+
+// inbox removes files locally once their upload has been verified. All
+// methods are safe to call on a nil *inbox, which leaves files alone.
+type inbox struct {
+	config InboxConfig
+	root   string // Watched directory, used to place files in the archive
+
+	mu        sync.Mutex
+	collected map[string]time.Time // Files removed by the inbox, by path
+}
+
+// EnableInbox removes every successfully uploaded file below root, deleting it
+// or moving it to the archive directory. Uploads are sent with a Content-MD5
+// so that S3 verifies the data before the local copy is removed.
+func (p *UploadWorkerPool) EnableInbox(root string, config InboxConfig) {
+	p.inbox = &inbox{
+		config:    config,
+		root:      root,
+		collected: make(map[string]time.Time),
+	}
+}
+
+// contentMD5 returns the base64 encoded MD5 of the rest of file, and rewinds
+// it for the upload.
+func contentMD5(file *os.File) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// collect removes an uploaded file, unless it changed since before was taken
+// at the start of its upload.
+func (i *inbox) collect(result *JobResult, before os.FileInfo) {
+	if i == nil || before == nil {
+		return
+	}
+	if rel, err := filepath.Rel(i.root, result.LocalFile); err != nil || !filepath.IsLocal(rel) {
+		return // Not an inbox file, such as a batch manifest
+	}
+	logger := slog.With("path", result.LocalFile, "key", result.Key)
+
+	info, err := os.Stat(result.LocalFile)
+	if err != nil {
+		logger.Error("Could not stat uploaded file. Leaving it in place", "error", err)
+		return
+	}
+	if info.Size() != result.Size || localVersionOf(info) != localVersionOf(before) {
+		logger.Warn("File changed during its upload. Leaving it in place")
+		return
+	}
+
+	i.remember(result.LocalFile)
+	switch i.config.Action {
+	case inboxMove:
+		target, err := i.archive(result.LocalFile)
+		if err != nil {
+			logger.Error("Could not move uploaded file to the archive", "error", err)
+			return
+		}
+		logger.Info("Moved uploaded file to the archive", "target", target)
+	default:
+		if err := os.Remove(result.LocalFile); err != nil {
+			logger.Error("Could not delete uploaded file", "error", err)
+			return
+		}
+		logger.Info("Deleted uploaded file")
+	}
+}
+
+// archive moves a file to the same relative path below the archive directory,
+// adding a timestamp to its name if that path is taken.
+func (i *inbox) archive(localFile string) (string, error) {
+	rel, err := filepath.Rel(i.root, localFile)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(i.config.ArchiveDir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		ext := filepath.Ext(target)
+		target = strings.TrimSuffix(target, ext) + "." + time.Now().UTC().Format("20060102T150405.000000000Z") + ext
+	}
+
+	err = os.Rename(localFile, target)
+	if errors.Is(err, syscall.EXDEV) {
+		err = moveAcrossDevices(localFile, target)
+	}
+	return target, err
+}
+
+// moveAcrossDevices moves a file by copying it, for when the archive is on
+// another file system than the inbox.
+func moveAcrossDevices(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(target)
+		return err
+	}
+	_ = os.Chtimes(target, info.ModTime(), info.ModTime())
+	if err := os.Remove(source); err != nil {
+		return fmt.Errorf("copied to %s but could not remove the original: %w", target, err)
+	}
+	return nil
+}
+
+// remember records that the inbox is removing a file.
+func (i *inbox) remember(path string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	for p, at := range i.collected {
+		if now.Sub(at) > inboxForgetAfter {
+			delete(i.collected, p)
+		}
+	}
+	i.collected[path] = now
+}
+
+// removed reports whether a path no longer exists because the inbox removed
+// it. Its removal must not be propagated to S3.
+func (i *inbox) removed(path string) bool {
+	if i == nil {
+		return false
+	}
+	i.mu.Lock()
+	at, ok := i.collected[path]
+	i.mu.Unlock()
+	if !ok || time.Since(at) > inboxForgetAfter {
+		return false
+	}
+	// A new file dropped under the same name is not ignored.
+	_, err := os.Lstat(path)
+	return os.IsNotExist(err)
+}
+
+// checkInbox validates the inbox configuration for a watched path.
+func checkInbox(config InboxConfig, localPath string, isDir bool) error {
+	if !isDir {
+		return errors.New("--inbox requires a directory to watch")
+	}
+	if config.Action != inboxMove {
+		return nil
+	}
+	archiveDir, err := filepath.Abs(config.ArchiveDir)
+	if err != nil {
+		return fmt.Errorf("invalid inbox archive directory: %w", err)
+	}
+	if rel, err := filepath.Rel(localPath, archiveDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("inbox archive directory %s must be outside the watched directory %s", archiveDir, localPath)
+	}
+	return nil
+}
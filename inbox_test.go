@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newInboxTestPool creates a pool in inbox mode with a file in the inbox.
+func newInboxTestPool(t *testing.T, config InboxConfig) (*UploadWorkerPool, *MockS3Uploader, string) {
+	t.Helper()
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	root := t.TempDir()
+	pool.EnableInbox(root, config)
+	t.Cleanup(pool.Shutdown)
+
+	localFile := filepath.Join(root, "sub", "file.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(localFile), 0755))
+	require.NoError(t, os.WriteFile(localFile, []byte("12345"), 0644))
+	return pool, mockUploader, localFile
+}
+
+func TestUploadWorkerPool_inbox(t *testing.T) {
+	t.Run("Uploaded files are verified and deleted", func(t *testing.T) {
+		pool, mockUploader, localFile := newInboxTestPool(t, InboxConfig{Action: inboxDelete})
+
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.Equal(t, "12345", mockUploader.Bodies["key"])
+		sum := md5.Sum([]byte("12345"))
+		assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), aws.ToString(mockUploader.Uploads["key"].ContentMD5))
+		assert.NoFileExists(t, localFile)
+		assert.True(t, pool.inbox.removed(localFile), "The removal should not be propagated")
+	})
+
+	t.Run("Uploaded files are moved to the archive", func(t *testing.T) {
+		archive := t.TempDir()
+		pool, _, localFile := newInboxTestPool(t, InboxConfig{Action: inboxMove, ArchiveDir: archive})
+
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.NoFileExists(t, localFile)
+		assert.Equal(t, "12345", readLocal(t, filepath.Join(archive, "sub", "file.txt")))
+
+		// A second file with the same name does not replace the first.
+		require.NoError(t, os.WriteFile(localFile, []byte("67890"), 0644))
+		assert.False(t, pool.inbox.removed(localFile), "A new file under the same name is not ignored")
+		require.NoError(t, uploadNow(t, pool, localFile, "key").Err)
+		archived, err := filepath.Glob(filepath.Join(archive, "sub", "file.*.txt"))
+		require.NoError(t, err)
+		require.Len(t, archived, 1)
+		assert.Equal(t, "67890", readLocal(t, archived[0]))
+		assert.Equal(t, "12345", readLocal(t, filepath.Join(archive, "sub", "file.txt")))
+	})
+
+	t.Run("Files are kept when the upload fails", func(t *testing.T) {
+		pool, mockUploader, localFile := newInboxTestPool(t, InboxConfig{Action: inboxDelete})
+		mockUploader.UploadErr = assert.AnError
+
+		require.Error(t, uploadNow(t, pool, localFile, "key").Err)
+		assert.FileExists(t, localFile)
+	})
+
+	t.Run("Files changed during the upload are kept", func(t *testing.T) {
+		pool, _, localFile := newInboxTestPool(t, InboxConfig{Action: inboxDelete})
+
+		before, err := os.Stat(localFile)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(localFile, []byte("54321"), 0644))
+		future := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(localFile, future, future))
+
+		pool.inbox.collect(&JobResult{LocalFile: localFile, Key: "key", Size: 5}, before)
+		assert.FileExists(t, localFile, "A changed mtime means the file changed")
+		before, err = os.Stat(localFile)
+		require.NoError(t, err)
+		pool.inbox.collect(&JobResult{LocalFile: localFile, Key: "key", Size: 4}, before)
+		assert.FileExists(t, localFile, "A different size means the file changed")
+		pool.inbox.collect(&JobResult{LocalFile: localFile, Key: "key", Size: 5}, before)
+		assert.NoFileExists(t, localFile)
+	})
+}
+
+func TestApp_handleEvent_inbox(t *testing.T) {
+	watcher, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer func() { _ = watcher.Close() }()
+
+	app, mockUploader, tmpDir := newTestApp(t, true, true) // delete = true, isDir = true
+	app.workerPool.EnableInbox(tmpDir, InboxConfig{Action: inboxDelete})
+	testFile := filepath.Join(tmpDir, "drop.txt")
+	require.NoError(t, os.WriteFile(testFile, []byte("content"), 0644))
+
+	app.handleEvent(context.Background(), fsnotify.Event{Name: testFile, Op: fsnotify.Create}, watcher)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(testFile)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+
+	app.handleEvent(context.Background(), fsnotify.Event{Name: testFile, Op: fsnotify.Remove}, watcher)
+	app.workerPool.Shutdown()
+	assert.Contains(t, mockUploader.Uploads, "test-prefix/drop.txt")
+	assert.Empty(t, mockUploader.Deletes, "Removals by the inbox must not delete from S3")
+}
+
+func TestCheckInbox(t *testing.T) {
+	root := t.TempDir()
+
+	assert.NoError(t, checkInbox(InboxConfig{Action: inboxDelete}, root, true))
+	assert.NoError(t, checkInbox(InboxConfig{Action: inboxMove, ArchiveDir: t.TempDir()}, root, true))
+	assert.Error(t, checkInbox(InboxConfig{Action: inboxDelete}, filepath.Join(root, "file.txt"), false))
+	assert.ErrorContains(t, checkInbox(InboxConfig{Action: inboxMove, ArchiveDir: filepath.Join(root, "archive")}, root, true), "outside the watched directory")
+	assert.ErrorContains(t, checkInbox(InboxConfig{Action: inboxMove, ArchiveDir: root}, root, true), "outside the watched directory")
+}
+
+func TestParseFlags_Inbox(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	parse := func(args ...string) (*AppConfig, error) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		os.Args = append(append([]string{"echos3"}, args...), "local/path", "s3://bucket/key")
+		_, config, _, err := parseFlags()
+		return config, err
+	}
+
+	config, err := parse("--inbox", "move", "--inbox-archive-dir", "/archive")
+	require.NoError(t, err)
+	assert.Equal(t, InboxConfig{Action: inboxMove, ArchiveDir: "/archive"}, config.Inbox)
+	assert.Equal(t, completeStable, config.Completion.Default, "Inboxes wait for files to be complete")
+
+	for _, args := range [][]string{
+		{"--inbox", "shred"},
+		{"--inbox", "move"},
+		{"--inbox", "delete", "--inbox-archive-dir", "/archive"},
+		{"--inbox-archive-dir", "/archive"},
+		{"--inbox", "delete", "--once"},
+		{"--inbox", "delete", "--direction", "both"},
+	} {
+		_, err := parse(args...)
+		assert.Error(t, err, "%v", args)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states reported by the control API.
+const (
+	jobQueued   = "queued"
+	jobInFlight = "in-flight"
+	jobFailed   = "failed"
+)
+
+// maxFailedJobs bounds the number of failed jobs kept for retrying. The
+// oldest failures are dropped first.
+const maxFailedJobs = 1000
+
+// errPoolClosed is reported for jobs queued after the pool was shut down.
+var errPoolClosed = errors.New("worker pool is shut down")
+
+// errQueueFull is returned when a job cannot be queued without waiting.
+var errQueueFull = errors.New("job queue is full")
+
+// JobInfo describes a job known to the worker pool.
+type JobInfo struct {
+	ID    uint64    `json:"id"`
+	Op    string    `json:"op"`
+	Key   string    `json:"key"`
+	Path  string    `json:"path,omitempty"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"` // When the job entered its current state
+	Error string    `json:"error,omitempty"`
+}
+
+// trackedJob pairs a job with the information reported about it.
+type trackedJob struct {
+	job  UploadJob
+	info JobInfo
+}
+
+// jobTracker keeps track of queued and in-flight jobs, and of failed jobs so
+// that they can be retried.
+type jobTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*trackedJob
+	failed []trackedJob
+	now    func() time.Time
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{active: make(map[uint64]*trackedJob), now: time.Now}
+}
+
+// add assigns the job an ID and records it as queued.
+func (t *jobTracker) add(job UploadJob) UploadJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	job.id = t.nextID
+	t.active[job.id] = &trackedJob{job: job, info: JobInfo{
+		ID:    job.id,
+		Op:    job.op.String(),
+		Key:   job.s3Key,
+		Path:  job.localFile,
+		State: jobQueued,
+		Since: t.now(),
+	}}
+	return job
+}
+
+// forget drops a job that was never queued.
+func (t *jobTracker) forget(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, id)
+}
+
+// start records that a worker has picked the job up.
+func (t *jobTracker) start(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tracked, ok := t.active[id]; ok {
+		tracked.info.State = jobInFlight
+		tracked.info.Since = t.now()
+	}
+}
+
+// finish forgets a processed job, keeping it for retrying if it failed.
+func (t *jobTracker) finish(id uint64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked, ok := t.active[id]
+	if !ok {
+		return
+	}
+	delete(t.active, id)
+	if err == nil {
+		return
+	}
+
+	tracked.job.done = nil // The original caller has already been told
+	tracked.info.State = jobFailed
+	tracked.info.Since = t.now()
+	tracked.info.Error = err.Error()
+	t.failed = append(t.failed, *tracked)
+	if len(t.failed) > maxFailedJobs {
+		t.failed = t.failed[len(t.failed)-maxFailedJobs:]
+	}
+}
+
+// list returns every queued, in-flight and failed job, ordered by ID.
+func (t *jobTracker) list() []JobInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]JobInfo, 0, len(t.active)+len(t.failed))
+	for _, tracked := range t.active {
+		jobs = append(jobs, tracked.info)
+	}
+	for _, tracked := range t.failed {
+		jobs = append(jobs, tracked.info)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// counts returns the number of queued, in-flight and failed jobs.
+func (t *jobTracker) counts() (queued, inFlight, failed int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tracked := range t.active {
+		if tracked.info.State == jobInFlight {
+			inFlight++
+		} else {
+			queued++
+		}
+	}
+	return queued, inFlight, len(t.failed)
+}
+
+// takeFailed removes and returns the failed jobs.
+func (t *jobTracker) takeFailed() []trackedJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failed := t.failed
+	t.failed = nil
+	return failed
+}
+
+// keepFailed puts back failed jobs that could not be retried, ahead of those
+// that failed since.
+func (t *jobTracker) keepFailed(jobs []trackedJob) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed = append(jobs, t.failed...)
+	if len(t.failed) > maxFailedJobs {
+		t.failed = t.failed[len(t.failed)-maxFailedJobs:]
+	}
+}
+
+// pauseGate blocks workers while the pool is paused.
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	stopped bool          // Set on shutdown, after which the gate never closes
+	resumed chan struct{} // Closed when the pool is resumed
+}
+
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		return false
+	}
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+	return true
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+// stop resumes the gate and prevents it from being paused again.
+func (g *pauseGate) stop() {
+	g.resume()
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks while the gate is paused.
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if paused {
+		<-resumed
+	}
+}
+
+// Pause stops workers from starting new jobs. Jobs already in flight run to
+// completion. It returns false if the pool is shutting down.
+func (p *UploadWorkerPool) Pause() bool {
+	if !p.gate.pause() {
+		return false
+	}
+	slog.Info("Worker pool paused")
+	return true
+}
+
+// Resume lets workers start new jobs again.
+func (p *UploadWorkerPool) Resume() {
+	p.gate.resume()
+	slog.Info("Worker pool resumed")
+}
+
+// Paused reports whether the pool is paused.
+func (p *UploadWorkerPool) Paused() bool {
+	return p.gate.isPaused()
+}
+
+// Jobs returns the queued, in-flight and failed jobs.
+func (p *UploadWorkerPool) Jobs() []JobInfo {
+	return p.jobs.list()
+}
+
+// RetryFailed queues the failed jobs again and returns how many were queued.
+// It does not wait for room in the queue: the jobs that do not fit are kept
+// as failed, and errQueueFull is returned.
+func (p *UploadWorkerPool) RetryFailed() (int, error) {
+	failed := p.jobs.takeFailed()
+	for i, tracked := range failed {
+		if err := p.tryQueue(tracked.job); err != nil {
+			p.jobs.keepFailed(failed[i:])
+			return i, err
+		}
+	}
+	return len(failed), nil
+}
+
+// Drained returns a channel that is closed once the pool has been shut down
+// and every queued job has been processed.
+func (p *UploadWorkerPool) Drained() <-chan struct{} {
+	return p.drained
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobTracker(t *testing.T) {
+	tracker := newJobTracker()
+	first := tracker.add(UploadJob{op: opUpload, localFile: "/tmp/a", s3Key: "a"})
+	second := tracker.add(UploadJob{op: opDelete, s3Key: "b"})
+	assert.Equal(t, uint64(1), first.id)
+	assert.Equal(t, uint64(2), second.id)
+
+	tracker.start(first.id)
+	queued, inFlight, failed := tracker.counts()
+	assert.Equal(t, []int{1, 1, 0}, []int{queued, inFlight, failed})
+
+	jobs := tracker.list()
+	require.Len(t, jobs, 2)
+	assert.Equal(t, JobInfo{ID: 1, Op: "upload", Key: "a", Path: "/tmp/a", State: jobInFlight, Since: jobs[0].Since}, jobs[0])
+	assert.Equal(t, jobQueued, jobs[1].State)
+
+	tracker.finish(first.id, nil)
+	tracker.start(second.id)
+	tracker.finish(second.id, os.ErrPermission)
+	jobs = tracker.list()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, jobFailed, jobs[0].State)
+	assert.Equal(t, os.ErrPermission.Error(), jobs[0].Error)
+
+	retry := tracker.takeFailed()
+	require.Len(t, retry, 1)
+	assert.Equal(t, "b", retry[0].job.s3Key)
+	assert.Empty(t, tracker.list())
+}
+
+func TestJobTracker_failedJobsAreBounded(t *testing.T) {
+	tracker := newJobTracker()
+	for i := 0; i < maxFailedJobs+10; i++ {
+		job := tracker.add(UploadJob{s3Key: "key"})
+		tracker.finish(job.id, os.ErrNotExist)
+	}
+	jobs := tracker.list()
+	require.Len(t, jobs, maxFailedJobs)
+	assert.Equal(t, uint64(11), jobs[0].ID, "The oldest failures should be dropped")
+}
+
+func TestUploadWorkerPool_pause(t *testing.T) {
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localFile, []byte("data"), 0644))
+
+	require.True(t, pool.Pause())
+	assert.True(t, pool.Paused())
+	done := make(chan JobResult, 1)
+	pool.queue(UploadJob{op: opUpload, localFile: localFile, s3Key: "key", done: func(result JobResult) {
+		done <- result
+	}})
+
+	select {
+	case <-done:
+		t.Fatal("Job should not run while the pool is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Len(t, pool.Jobs(), 1)
+
+	pool.Resume()
+	require.NoError(t, (<-done).Err)
+	assert.Equal(t, "data", mockUploader.Bodies["key"])
+
+	// Shutting down resumes a paused pool so that the queue drains, and the
+	// pool cannot be paused again.
+	require.True(t, pool.Pause())
+	pool.QueueUpload(localFile, "other")
+	pool.Shutdown()
+	assert.Equal(t, int64(2), pool.Stats().Uploaded)
+	assert.False(t, pool.Pause())
+
+	select {
+	case <-pool.Drained():
+	case <-time.After(time.Second):
+		t.Fatal("Pool should be drained after shutdown")
+	}
+}
+
+func TestUploadWorkerPool_retryFailed(t *testing.T) {
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	defer pool.Shutdown()
+
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.Error(t, uploadNow(t, pool, localFile, "key").Err)
+	require.Len(t, pool.Jobs(), 1)
+
+	require.NoError(t, os.WriteFile(localFile, []byte("data"), 0644))
+	n, err := pool.RetryFailed()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	pool.Shutdown()
+
+	assert.Equal(t, "data", mockUploader.Bodies["key"])
+	assert.Empty(t, pool.Jobs())
+}
+
+func TestUploadWorkerPool_queueAfterShutdown(t *testing.T) {
+	pool := NewUploadWorkerPool(newMockS3Uploader(), "test-bucket", types.StorageClassStandard, 1)
+	pool.Shutdown()
+
+	result := uploadNow(t, pool, "/tmp/file.txt", "key")
+	assert.ErrorIs(t, result.Err, errPoolClosed)
+}
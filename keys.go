@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pathMetadata is the user metadata recording the path of an uploaded file
+// relative to the watched directory, when keys are mapped from templates or
+// rewrite rules.
+const pathMetadata = "echos3-path"
+
+// pathHashMetadata is the user metadata recording the hex encoded SHA-256 of
+// a relative path too long for pathMetadata.
+const pathHashMetadata = "echos3-path-sha256"
+
+// maxMetadataBytes is S3's limit on user metadata, counted over the UTF-8
+// bytes of every name and value.
+const maxMetadataBytes = 2048
+
+// errKeyIrreversible is returned when a key cannot be mapped back to a local
+// path without the object's metadata.
+var errKeyIrreversible = errors.New("rewritten or sanitised keys cannot be reversed")
+
+// keyVariables maps the variables of key templates to regular expressions
+// matching their values. Path components {1} to {9} match [^/]+.
+var keyVariables = map[string]string{
+	"path":     `.+`,
+	"dir":      `(?:.+/)?`,
+	"file":     `[^/]+`,
+	"name":     `[^/]*?`,
+	"ext":      `(?:\.[^./]*)?`,
+	"hostname": `[^/]+`,
+	"year":     `\d{4}`,
+	"month":    `\d{2}`,
+	"day":      `\d{2}`,
+	"hour":     `\d{2}`,
+}
+
+// keyVariable matches a variable in a key template.
+var keyVariable = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// KeyConfig configures how files below a watched directory map to keys below
+// the key prefix.
+type KeyConfig struct {
+	Template string         // Template of the keys, {path} if empty
+	Rewrites []KeyRewrite   // Applied in order after the template
+	Sanitize SanitizeConfig // Applied last
+}
+
+// KeyRewrite replaces the matches of a regular expression in keys.
+type KeyRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string // May refer to submatches as $1 or ${name}
+}
+
+// parseKeyRewrite parses a rewrite rule of the form PATTERN=>REPLACEMENT.
+func parseKeyRewrite(value string) (KeyRewrite, error) {
+	pattern, replacement, ok := strings.Cut(value, "=>")
+	if !ok || pattern == "" {
+		return KeyRewrite{}, fmt.Errorf("invalid key rewrite %q: must be PATTERN=>REPLACEMENT", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return KeyRewrite{}, fmt.Errorf("invalid key rewrite %q: %w", value, err)
+	}
+	return KeyRewrite{Pattern: re, Replacement: replacement}, nil
+}
+
+// parseKeyConfig parses the key template and rewrite rules given as flags.
+func parseKeyConfig(template string, rewrites []string) (KeyConfig, error) {
+	config := KeyConfig{Template: template}
+	for _, value := range rewrites {
+		rewrite, err := parseKeyRewrite(value)
+		if err != nil {
+			return config, err
+		}
+		config.Rewrites = append(config.Rewrites, rewrite)
+	}
+	return config, nil
+}
+
+// keyFlags registers the flags of a subcommand that map files to keys like a
+// watch with the same flags does, and returns a function parsing them.
+func keyFlags(flags *flag.FlagSet) func() (KeyConfig, error) {
+	template := flags.String("key-template", "", "Key template of the watch, to map files to keys like it does.")
+	var rewrites stringListFlag
+	flags.Var(&rewrites, "key-rewrite", "Key rewrite rule of the watch. Can be repeated.")
+	sanitize := flags.Bool("sanitize-keys", false, "Whether the watch sanitised keys.")
+	unsafe := flags.String("sanitize-unsafe-chars", defaultUnsafeKeyChars, "Characters the watch's --sanitize-keys replaced.")
+	replacement := flags.String("sanitize-replacement", "_", "What the watch's --sanitize-keys replaced unsafe characters with.")
+	return func() (KeyConfig, error) {
+		config, err := parseKeyConfig(*template, rewrites)
+		if err != nil {
+			return config, err
+		}
+		config.Sanitize = SanitizeConfig{Enabled: *sanitize, Unsafe: *unsafe, Replacement: *replacement}
+		return config, checkSanitize(config.Sanitize)
+	}
+}
+
+// enabled reports whether keys are made from a template, rewritten or
+// sanitised.
+func (c KeyConfig) enabled() bool {
+	return c.Template != "" || len(c.Rewrites) > 0 || c.Sanitize.Enabled
+}
+
+// mapKeys maps the files below the watched directory to keys as configured.
+func (a *App) mapKeys(config KeyConfig) error {
+	if !a.isDir {
+		return errors.New("--key-template, --key-rewrite and --sanitize-keys require a directory")
+	}
+	keys, err := newKeyMapper(config)
+	if err != nil {
+		return err
+	}
+	// Sanitised keys are shortened to fit S3's limit after the key prefix.
+	keys.maxBytes = maxKeyBytes - len(a.remotePrefix())
+	if config.Sanitize.Enabled && keys.maxBytes < 100 {
+		return fmt.Errorf("key prefix %s is too long to sanitise keys below it", a.keyPrefix)
+	}
+	a.keys = keys
+	return nil
+}
+
+// keySegment is a literal part or a variable of a key template.
+type keySegment struct {
+	text     string // Literal text, used if variable is empty
+	variable string
+}
+
+// keyMapper maps relative paths to keys and back.
+type keyMapper struct {
+	config   KeyConfig
+	segments []keySegment
+	pattern  *regexp.Regexp // Matches keys made from the template
+	groups   []string       // Variable captured by each group of pattern
+	hostname string
+	usesTime bool // The template uses the file's modification time
+	maxBytes int  // Longest key below the key prefix, when sanitising keys
+}
+
+// newKeyMapper parses a key configuration. The template must contain enough
+// of the relative path for keys to be mapped back to it: {path}, or {dir}
+// with {file} or with {name} and {ext}.
+func newKeyMapper(config KeyConfig) (*keyMapper, error) {
+	template := config.Template
+	if template == "" {
+		template = "{path}"
+	}
+	m := &keyMapper{config: config}
+	used := make(map[string]bool)
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, match := range keyVariable.FindAllStringSubmatchIndex(template, -1) {
+		if text := template[last:match[0]]; text != "" {
+			m.segments = append(m.segments, keySegment{text: text})
+			pattern.WriteString(regexp.QuoteMeta(text))
+		}
+		last = match[1]
+		name := template[match[2]:match[3]]
+		expr, ok := keyVariables[name]
+		if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= 9 {
+			expr, ok = `[^/]+`, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid key template %q: unknown variable {%s}", template, name)
+		}
+		m.segments = append(m.segments, keySegment{variable: name})
+		m.groups = append(m.groups, name)
+		pattern.WriteString("(" + expr + ")")
+		used[name] = true
+	}
+	if text := template[last:]; text != "" {
+		m.segments = append(m.segments, keySegment{text: text})
+		pattern.WriteString(regexp.QuoteMeta(text))
+	}
+	pattern.WriteString("$")
+
+	if !used["path"] && !(used["dir"] && (used["file"] || used["name"] && used["ext"])) {
+		return nil, fmt.Errorf("invalid key template %q: must contain {path}, or {dir} with {file} or {name}{ext}, to be reversible", template)
+	}
+	m.pattern = regexp.MustCompile(pattern.String())
+	m.usesTime = used["year"] || used["month"] || used["day"] || used["hour"]
+	if used["hostname"] {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not determine hostname for key template: %w", err)
+		}
+		m.hostname = hostname
+	}
+	return m, nil
+}
+
+// pathVariables returns the variables describing a slash separated relative
+// path.
+func pathVariables(relPath string) map[string]string {
+	dir, file := path.Split(relPath)
+	ext := path.Ext(file)
+	vars := map[string]string{
+		"path": relPath,
+		"dir":  dir,
+		"file": file,
+		"name": strings.TrimSuffix(file, ext),
+		"ext":  ext,
+	}
+	for i, component := range strings.Split(relPath, "/") {
+		if i < 9 {
+			vars[strconv.Itoa(i+1)] = component
+		}
+	}
+	return vars
+}
+
+// expand fills in the template.
+func (m *keyMapper) expand(vars map[string]string) (string, error) {
+	var b strings.Builder
+	for _, s := range m.segments {
+		if s.variable == "" {
+			b.WriteString(s.text)
+			continue
+		}
+		value, ok := vars[s.variable]
+		if !ok {
+			return "", fmt.Errorf("path %s has no component {%s}", vars["path"], s.variable)
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// key returns the key of a file below the key prefix, given its slash
+// separated path relative to the watched directory. Date partitions are taken
+// from the file's modification time, in UTC.
+func (m *keyMapper) key(localFile, relPath string) (string, error) {
+	vars := pathVariables(relPath)
+	vars["hostname"] = m.hostname
+	if m.usesTime {
+		info, err := os.Stat(localFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read modification time for key template: %w", err)
+		}
+		modTime := info.ModTime().UTC()
+		vars["year"] = modTime.Format("2006")
+		vars["month"] = modTime.Format("01")
+		vars["day"] = modTime.Format("02")
+		vars["hour"] = modTime.Format("15")
+	}
+	key, err := m.expand(vars)
+	if err != nil {
+		return "", err
+	}
+	for _, rewrite := range m.config.Rewrites {
+		key = rewrite.Pattern.ReplaceAllString(key, rewrite.Replacement)
+	}
+	if m.config.Sanitize.Enabled {
+		key = m.config.Sanitize.sanitize(key, m.maxBytes)
+	}
+	return key, nil
+}
+
+// relPath maps a key below the key prefix back to the slash separated path it
+// was made from. Keys made with rewrite rules or sanitised return
+// errKeyIrreversible, and must be mapped with the path recorded in their
+// metadata instead.
+func (m *keyMapper) relPath(key string) (string, error) {
+	if len(m.config.Rewrites) > 0 || m.config.Sanitize.Enabled {
+		return "", errKeyIrreversible
+	}
+	match := m.pattern.FindStringSubmatch(key)
+	if match == nil {
+		return "", fmt.Errorf("key %s does not match the key template", key)
+	}
+	captured := make(map[string]string)
+	for i, name := range m.groups {
+		if _, ok := captured[name]; !ok {
+			captured[name] = match[i+1]
+		}
+	}
+
+	var relPath string
+	if p, ok := captured["path"]; ok {
+		relPath = p
+	} else if file, ok := captured["file"]; ok {
+		relPath = captured["dir"] + file
+	} else {
+		relPath = captured["dir"] + captured["name"] + captured["ext"]
+	}
+
+	// Regular expressions cannot tell that a variable used twice has the
+	// same value both times, so make sure the path maps back to the key.
+	vars := pathVariables(relPath)
+	for _, name := range []string{"hostname", "year", "month", "day", "hour"} {
+		vars[name] = captured[name]
+	}
+	if expanded, err := m.expand(vars); err != nil || expanded != key {
+		return "", fmt.Errorf("key %s does not match the key template", key)
+	}
+	return relPath, nil
+}
+
+// escapeMetadata URL encodes a path for user metadata, which S3 only keeps
+// intact in ASCII, leaving its slashes readable.
+func escapeMetadata(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// recordPath records a relative path in the echos3-path metadata. A path that
+// would take the metadata over S3's size limit is recorded as its hash
+// instead, and recordPath returns false.
+func recordPath(metadata map[string]string, relPath string) bool {
+	escaped := escapeMetadata(relPath)
+	size := len(pathMetadata) + len(escaped)
+	for name, value := range metadata {
+		size += len(name) + len(value)
+	}
+	if size <= maxMetadataBytes {
+		metadata[pathMetadata] = escaped
+		return true
+	}
+	sum := sha256.Sum256([]byte(relPath))
+	metadata[pathHashMetadata] = hex.EncodeToString(sum[:])
+	return false
+}
+
+// RecordPaths records the path of every uploaded file below root, relative to
+// it, in the echos3-path metadata, so that keys that cannot be mapped back to
+// their files can still be restored.
+func (p *UploadWorkerPool) RecordPaths(root string) {
+	p.pathRoot = root
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newKeysTestApp creates a test app mapping keys with the given template and
+// rewrite rules.
+func newKeysTestApp(t *testing.T, template string, rewrites ...string) (*App, *MockS3Uploader, string) {
+	t.Helper()
+	app, mockUploader, tmpDir := newTestApp(t, false, true)
+	config, err := parseKeyConfig(template, rewrites)
+	require.NoError(t, err)
+	require.NoError(t, app.mapKeys(config))
+	app.workerPool.RecordPaths(tmpDir)
+	return app, mockUploader, tmpDir
+}
+
+func TestKeyMapper(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	modTime := time.Date(2026, 10, 16, 23, 30, 0, 0, time.FixedZone("EDT", -4*60*60))
+
+	testCases := []struct {
+		template string
+		relPath  string
+		want     string
+	}{
+		{"{path}", "a/b.csv", "a/b.csv"},
+		{"year={year}/month={month}/day={day}/hour={hour}/{path}", "a/b.csv", "year=2026/month=10/day=17/hour=03/a/b.csv"},
+		{"{ext}/{dir}{name}{ext}", "a/b.tar.gz", ".gz/a/b.tar.gz"},
+		{"{dir}{hostname}-{file}", "b.csv", hostname + "-b.csv"},
+		{"source={1}/{path}", "sensors/x/b.csv", "source=sensors/sensors/x/b.csv"},
+		{"{dir}{name}{ext}", ".bashrc", ".bashrc"},
+	}
+	for _, tc := range testCases {
+		localFile := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(localFile, nil, 0644))
+		require.NoError(t, os.Chtimes(localFile, modTime, modTime))
+
+		m, err := newKeyMapper(KeyConfig{Template: tc.template})
+		require.NoError(t, err, tc.template)
+		key, err := m.key(localFile, tc.relPath)
+		require.NoError(t, err, tc.template)
+		assert.Equal(t, tc.want, key, tc.template)
+
+		relPath, err := m.relPath(key)
+		require.NoError(t, err, tc.template)
+		assert.Equal(t, tc.relPath, relPath, tc.template)
+	}
+
+	t.Run("Templates must be reversible and known", func(t *testing.T) {
+		for template, msg := range map[string]string{
+			"{year}/{file}":        "to be reversible",
+			"{dir}{name}":          "to be reversible",
+			"{dir}{file}{bananas}": "unknown variable {bananas}",
+			"{10}/{path}":          "unknown variable {10}",
+		} {
+			_, err := newKeyMapper(KeyConfig{Template: template})
+			assert.ErrorContains(t, err, msg, template)
+		}
+	})
+
+	t.Run("Keys that do not match the template are not mapped back", func(t *testing.T) {
+		m, err := newKeyMapper(KeyConfig{Template: "{name}/{dir}{name}{ext}"})
+		require.NoError(t, err)
+		_, err = m.relPath("other/a/b.csv")
+		assert.ErrorContains(t, err, "does not match the key template", "Both {name} must agree")
+		_, err = m.relPath("b/a/b.csv")
+		assert.NoError(t, err)
+
+		m, err = newKeyMapper(KeyConfig{Template: "year={year}/{path}"})
+		require.NoError(t, err)
+		_, err = m.relPath("a/b.csv")
+		assert.ErrorContains(t, err, "does not match the key template")
+	})
+
+	t.Run("Missing path components are an error", func(t *testing.T) {
+		m, err := newKeyMapper(KeyConfig{Template: "{3}/{path}"})
+		require.NoError(t, err)
+		_, err = m.key("", "a/b.csv")
+		assert.ErrorContains(t, err, "has no component {3}")
+	})
+
+	t.Run("Rewritten keys cannot be reversed", func(t *testing.T) {
+		config, err := parseKeyConfig("", []string{`^([^/]+)/=>source=$1/`, `\.CSV$=>.csv`})
+		require.NoError(t, err)
+		m, err := newKeyMapper(config)
+		require.NoError(t, err)
+		key, err := m.key("", "sensors/b.CSV")
+		require.NoError(t, err)
+		assert.Equal(t, "source=sensors/b.csv", key)
+		_, err = m.relPath(key)
+		assert.ErrorIs(t, err, errKeyIrreversible)
+	})
+}
+
+func TestParseKeyRewrite(t *testing.T) {
+	rewrite, err := parseKeyRewrite(`(\d+)=>n=$1=>`)
+	require.NoError(t, err)
+	assert.Equal(t, `(\d+)`, rewrite.Pattern.String())
+	assert.Equal(t, "n=$1=>", rewrite.Replacement)
+
+	for _, value := range []string{"no-arrow", "=>empty", "([=>x"} {
+		_, err := parseKeyRewrite(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestApp_keyTemplate(t *testing.T) {
+	t.Run("Files are uploaded to and restored from templated keys", func(t *testing.T) {
+		app, mockUploader, tmpDir := newKeysTestApp(t, "kind={ext}/{dir}{name}{ext}")
+		localFile := filepath.Join(tmpDir, "a", "b.csv")
+		writeLocal(t, localFile, "1,2")
+
+		s3Key, err := app.s3KeyFor(localFile)
+		require.NoError(t, err)
+		assert.Equal(t, "test-prefix/kind=.csv/a/b.csv", s3Key)
+		require.NoError(t, uploadNow(t, app.workerPool, localFile, s3Key).Err)
+		assert.Equal(t, "a/b.csv", mockUploader.Uploads[s3Key].Metadata[pathMetadata])
+
+		back, err := app.localPathFor(s3Key)
+		require.NoError(t, err)
+		assert.Equal(t, localFile, back)
+
+		report, err := app.verify(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, report.Drift)
+		assert.Equal(t, 1, report.Matched)
+	})
+
+	t.Run("Rewritten keys are restored from their metadata", func(t *testing.T) {
+		app, mockUploader, tmpDir := newKeysTestApp(t, "", `^([^/]+)/=>source=$1/`)
+		localFile := filepath.Join(tmpDir, "sensors", "b c.csv")
+		writeLocal(t, localFile, "1,2")
+		s3Key, err := app.s3KeyFor(localFile)
+		require.NoError(t, err)
+		assert.Equal(t, "test-prefix/source=sensors/b c.csv", s3Key)
+		require.NoError(t, uploadNow(t, app.workerPool, localFile, s3Key).Err)
+		putRemote(t, mockUploader, "test-prefix/source=other/d.csv", "no metadata")
+
+		_, err = app.localPathFor(s3Key)
+		assert.ErrorIs(t, err, errKeyIrreversible)
+
+		r, _, dest := newTestRestorer(t, restoreOptions{})
+		r.app.uploader = mockUploader
+		r.app.keys = app.keys
+		assert.Equal(t, RestoreSummary{Restored: 1, Failed: 1}, restoreAll(t, r))
+		assert.Equal(t, "1,2", readLocal(t, filepath.Join(dest, "sensors", "b c.csv")))
+	})
+
+	t.Run("Paths too long for the metadata are recorded as a hash", func(t *testing.T) {
+		app, mockUploader, tmpDir := newKeysTestApp(t, "", `^([^/]+)/=>source=$1/`)
+		relPath := strings.Repeat("データ/", 80) + "ファイル.csv"
+		localFile := filepath.Join(tmpDir, filepath.FromSlash(relPath))
+		writeLocal(t, localFile, "1,2")
+		s3Key, err := app.s3KeyFor(localFile)
+		require.NoError(t, err)
+		require.NoError(t, uploadNow(t, app.workerPool, localFile, s3Key).Err)
+
+		metadata := mockUploader.Uploads[s3Key].Metadata
+		assert.NotContains(t, metadata, pathMetadata)
+		sum := sha256.Sum256([]byte(relPath))
+		assert.Equal(t, hex.EncodeToString(sum[:]), metadata[pathHashMetadata])
+		size := 0
+		for name, value := range metadata {
+			size += len(name) + len(value)
+		}
+		assert.LessOrEqual(t, size, maxMetadataBytes)
+
+		r, _, _ := newTestRestorer(t, restoreOptions{})
+		r.app.uploader = mockUploader
+		r.app.keys = app.keys
+		_, err = r.localPathFor(context.Background(), restoreObject{key: s3Key})
+		assert.ErrorContains(t, err, "too long to record")
+	})
+}
+
+func TestParseFlags_Keys(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	parse := func(args ...string) (*AppConfig, error) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		os.Args = append(append([]string{"echos3"}, args...), "local/path", "s3://bucket/key")
+		_, config, _, err := parseFlags()
+		return config, err
+	}
+
+	config, err := parse("--key-template", "year={year}/{path}", "--key-rewrite", `\.CSV$=>.csv`, "--key-rewrite", "^a/=>b/")
+	require.NoError(t, err)
+	assert.Equal(t, "year={year}/{path}", config.Keys.Template)
+	require.Len(t, config.Keys.Rewrites, 2)
+	assert.Equal(t, "b/", config.Keys.Rewrites[1].Replacement)
+
+	for _, args := range [][]string{
+		{"--key-rewrite", "no-arrow"},
+		{"--key-template", "{path}", "--direction", "pull"},
+		{"--key-rewrite", "^a/=>b/", "--direction", "both"},
+	} {
+		_, err := parse(args...)
+		assert.Error(t, err, "%v", args)
+	}
+}
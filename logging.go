@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log formats accepted by the --log-format flag.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// LoggingConfig holds the logging options.
+type LoggingConfig struct {
+	Level      slog.Level
+	Format     string
+	File       string // Log to stderr if empty
+	MaxSizeMB  int    // Size at which the log file is rotated
+	MaxBackups int    // Rotated files to keep, 0 keeps them all
+}
+
+// parseLogLevel parses a --log-level value.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// newLogHandler creates a handler writing to w in the configured format.
+func newLogHandler(w io.Writer, config LoggingConfig) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: config.Level}
+	switch strings.ToLower(config.Format) {
+	case logFormatText, "":
+		return slog.NewTextHandler(w, opts), nil
+	case logFormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q: must be text or json", config.Format)
+}
+
+// setupLogging installs the default logger. The returned function closes the
+// log file, if any.
+func setupLogging(config LoggingConfig) (func(), error) {
+	var (
+		w       io.Writer = os.Stderr
+		closeFn           = func() {}
+	)
+	if config.File != "" {
+		file := &lumberjack.Logger{
+			Filename:   config.File,
+			MaxSize:    config.MaxSizeMB,
+			MaxBackups: config.MaxBackups,
+		}
+		w = file
+		closeFn = func() { _ = file.Close() }
+	}
+
+	handler, err := newLogHandler(w, config)
+	if err != nil {
+		closeFn()
+		return nil, err
+	}
+	slog.SetDefault(slog.New(handler))
+	return closeFn, nil
+}
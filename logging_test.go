@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	testCases := []struct {
+		input     string
+		expect    slog.Level
+		expectErr bool
+	}{
+		{"debug", slog.LevelDebug, false},
+		{"info", slog.LevelInfo, false},
+		{"WARN", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			level, err := parseLogLevel(tc.input)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, level)
+		})
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	t.Run("JSON output carries structured fields", func(t *testing.T) {
+		var buf bytes.Buffer
+		handler, err := newLogHandler(&buf, LoggingConfig{Level: slog.LevelInfo, Format: logFormatJSON})
+		require.NoError(t, err)
+
+		slog.New(handler).Info("Completed upload", "op", "upload", "key", "a.txt", "bytes", 3)
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		assert.Equal(t, "INFO", entry["level"])
+		assert.Equal(t, "Completed upload", entry["msg"])
+		assert.Equal(t, "upload", entry["op"])
+		assert.Equal(t, "a.txt", entry["key"])
+		assert.Equal(t, float64(3), entry["bytes"])
+	})
+
+	t.Run("Messages below the level are dropped", func(t *testing.T) {
+		var buf bytes.Buffer
+		handler, err := newLogHandler(&buf, LoggingConfig{Level: slog.LevelWarn, Format: logFormatText})
+		require.NoError(t, err)
+
+		logger := slog.New(handler)
+		logger.Info("ignored")
+		logger.Warn("kept")
+		assert.NotContains(t, buf.String(), "ignored")
+		assert.Contains(t, buf.String(), "kept")
+	})
+
+	t.Run("Unknown formats are rejected", func(t *testing.T) {
+		_, err := newLogHandler(&bytes.Buffer{}, LoggingConfig{Format: "xml"})
+		assert.Error(t, err)
+	})
+}
+
+func TestSetupLogging_file(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	logFile := filepath.Join(t.TempDir(), "echos3.log")
+	closeLog, err := setupLogging(LoggingConfig{Level: slog.LevelInfo, Format: logFormatJSON, File: logFile, MaxSizeMB: 1})
+	require.NoError(t, err)
+
+	slog.Info("hello", "path", "/tmp/a")
+	closeLog()
+
+	content, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"msg":"hello"`)
+	assert.Contains(t, string(content), `"path":"/tmp/a"`)
+}
+
+func TestParseFlags_InvalidLogOptions(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	testCases := []struct {
+		name   string
+		args   []string
+		expect string
+	}{
+		{"Level", []string{"--log-level", "loud"}, "invalid log level"},
+		{"Format", []string{"--log-format", "xml"}, "invalid log format"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+			os.Args = append(append([]string{"echos3"}, tc.args...), "local/path", "s3://bucket/key")
+
+			_, _, _, err := parseFlags()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expect)
+		})
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -28,6 +29,13 @@ var Version = "dev"
 type S3Uploader interface {
 	Upload(ctx context.Context, input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
 	DeleteObject(ctx context.Context, input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error)
+	RestoreObject(ctx context.Context, input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error)
+	CopyObject(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	HeadBucket(ctx context.Context, input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error)
 }
 
 // S3Client is a wrapper for the official AWS S3 client that implements our S3Uploader interface.
@@ -45,6 +53,54 @@ func (c *S3Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput
 	return c.client.DeleteObject(ctx, input)
 }
 
+// ListObjectsV2 lists a single page of objects in an S3 bucket.
+func (c *S3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return c.client.ListObjectsV2(ctx, input)
+}
+
+// GetObject retrieves an object from an S3 bucket.
+func (c *S3Client) GetObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return c.client.GetObject(ctx, input)
+}
+
+// HeadObject retrieves the metadata of an object from an S3 bucket.
+func (c *S3Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return c.client.HeadObject(ctx, input)
+}
+
+// ListObjectVersions lists a single page of object versions and delete
+// markers in an S3 bucket.
+func (c *S3Client) ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	return c.client.ListObjectVersions(ctx, input)
+}
+
+// RestoreObject requests a temporary copy of an archived object.
+func (c *S3Client) RestoreObject(ctx context.Context, input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	return c.client.RestoreObject(ctx, input)
+}
+
+// CopyObject copies an object within S3.
+func (c *S3Client) CopyObject(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return c.client.CopyObject(ctx, input)
+}
+
+// HeadBucket checks that a bucket exists and can be accessed.
+func (c *S3Client) HeadBucket(ctx context.Context, input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return c.client.HeadBucket(ctx, input)
+}
+
+// Region returns the region requests are sent to.
+func (c *S3Client) Region() string {
+	return c.client.Options().Region
+}
+
+// SetRegion sends further requests to the given region.
+func (c *S3Client) SetRegion(region string) {
+	c.client = s3.New(c.client.Options(), func(o *s3.Options) {
+		o.Region = region
+	})
+}
+
 // S3ClientCreator is a function type for creating S3 clients
 type S3ClientCreator func(ctx context.Context) (*S3Client, error)
 
@@ -57,10 +113,43 @@ var newS3Client S3ClientCreator = func(ctx context.Context) (*S3Client, error) {
 	return &S3Client{client: s3.NewFromConfig(cfg)}, nil
 }
 
+// jobOp identifies the S3 operation performed by a job.
+type jobOp int
+
+const (
+	opUpload jobOp = iota
+	opDelete
+	opDownload
+)
+
 // UploadJob represents a file upload task
 type UploadJob struct {
+	id        uint64 // Assigned when the job is queued
+	op        jobOp
 	localFile string
 	s3Key     string
+	done      func(result JobResult) // Optional, called once the job has been processed
+}
+
+// JobResult describes the outcome of a processed job.
+type JobResult struct {
+	Op        jobOp
+	LocalFile string
+	Key       string
+	ETag      string
+	VersionID string // Set when the bucket has versioning enabled
+	Checksum  string // Base64 SHA-256 of an upload as computed by S3, set when checksums are enabled
+	Size      int64  // Bytes transferred by uploads and downloads
+	Duration  time.Duration
+	Err       error
+}
+
+// PoolStats is a snapshot of the jobs processed by a worker pool.
+type PoolStats struct {
+	Uploaded   int64
+	Deleted    int64
+	Downloaded int64
+	Failed     int64
 }
 
 // UploadWorkerPool manages a pool of workers for concurrent uploads
@@ -70,6 +159,30 @@ type UploadWorkerPool struct {
 	storageClass types.StorageClass
 	jobQueue     chan UploadJob
 	wg           sync.WaitGroup
+	shutdownOnce sync.Once
+	drained      chan struct{} // Closed once every worker has exited and sinks are flushed
+	sinks        []EventSink
+	jobs         *jobTracker
+	gate         pauseGate
+	etags        *etagCache // Set when conditional writes are enabled
+	onConflict   string
+	metrics      *metrics    // Optional, set when --metrics-addr is used
+	hooks        *hookRunner // Optional, set when upload hooks are configured
+	inbox        *inbox      // Optional, set in inbox mode
+	archive      *archiver   // Optional, set in archive mode
+	pathRoot     string      // Set to record paths relative to it in upload metadata
+	checksums    bool        // Have S3 compute and verify a SHA-256 of every upload
+
+	// sendMu guards closing jobQueue against concurrent sends.
+	sendMu sync.RWMutex
+	closed bool
+
+	uploaded   atomic.Int64
+	deleted    atomic.Int64
+	downloaded atomic.Int64
+	failed     atomic.Int64
+
+	consecutiveFailures atomic.Int64 // S3 failures since the last success
 }
 
 // NewUploadWorkerPool creates a new worker pool for concurrent uploads
@@ -79,6 +192,8 @@ func NewUploadWorkerPool(uploader S3Uploader, bucket string, storageClass types.
 		bucket:       bucket,
 		storageClass: storageClass,
 		jobQueue:     make(chan UploadJob, maxWorkers*2), // Buffer size is 2x the number of workers
+		drained:      make(chan struct{}),
+		jobs:         newJobTracker(),
 	}
 
 	// Start the worker goroutines
@@ -86,6 +201,11 @@ func NewUploadWorkerPool(uploader S3Uploader, bucket string, storageClass types.
 	for i := 0; i < maxWorkers; i++ {
 		go pool.worker()
 	}
+	go func() {
+		pool.wg.Wait()
+		pool.closeSinks()
+		close(pool.drained)
+	}()
 
 	return pool
 }
@@ -95,75 +215,307 @@ func (p *UploadWorkerPool) worker() {
 	defer p.wg.Done()
 
 	for job := range p.jobQueue {
-		// Process the upload job
-		p.processUpload(context.Background(), job.localFile, job.s3Key)
+		p.gate.wait()
+		p.jobs.start(job.id)
+		result := p.process(context.Background(), job)
+		p.jobs.finish(job.id, result.Err)
+		if job.done != nil {
+			job.done(result)
+		}
+	}
+}
+
+// process runs a single job, records its outcome and logs the result.
+func (p *UploadWorkerPool) process(ctx context.Context, job UploadJob) JobResult {
+	p.metrics.workerStarted()
+	defer p.metrics.workerFinished()
+
+	logger := slog.With("op", job.op.String(), "bucket", p.bucket, "key", job.s3Key)
+	if job.localFile != "" {
+		logger = logger.With("path", job.localFile)
+	}
+	logger.Debug("Starting " + job.op.String())
+
+	result := JobResult{Op: job.op, LocalFile: job.localFile, Key: job.s3Key}
+	start := time.Now()
+	var counter *atomic.Int64
+	switch job.op {
+	case opDelete:
+		result.Err, counter = p.processDelete(ctx, &result), &p.deleted
+	case opDownload:
+		result.Err, counter = p.processDownload(ctx, &result), &p.downloaded
+	default:
+		result.Err, counter = p.uploadWithHooks(ctx, &result), &p.uploaded
+	}
+	result.Duration = time.Since(start)
+
+	if result.Err != nil {
+		p.failed.Add(1)
+		if isS3Failure(result.Err) {
+			p.consecutiveFailures.Add(1)
+		}
+		logger.Error("Failed to "+job.op.String(), "duration", result.Duration, "error", result.Err)
+	} else {
+		counter.Add(1)
+		p.consecutiveFailures.Store(0)
+		if result.Key != job.s3Key {
+			logger = logger.With("target", result.Key)
+		}
+		if result.VersionID != "" {
+			logger = logger.With("version_id", result.VersionID)
+		}
+		logger.Info("Completed "+job.op.String(), "bytes", result.Size, "duration", result.Duration)
 	}
+	p.metrics.observeJob(result)
+	p.publish(result)
+	return result
 }
 
-// processUpload handles the actual upload of a file to S3
-func (p *UploadWorkerPool) processUpload(ctx context.Context, localFile, s3Key string) {
-	file, err := os.Open(localFile)
+// processUpload handles the actual upload of result.LocalFile to S3 and
+// records the ETag and version of the new object and the number of bytes
+// uploaded in result.
+func (p *UploadWorkerPool) processUpload(ctx context.Context, result *JobResult) error {
+	file, err := os.Open(result.LocalFile)
 	if err != nil {
-		log.Printf("ERROR: Could not open file for upload %s: %v", localFile, err)
-		return
+		return fmt.Errorf("could not open file for upload: %w", err)
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
-			log.Printf("ERROR: Could not close file %s: %v", localFile, err)
+			slog.Error("Could not close file", "path", result.LocalFile, "error", err)
 		}
 	}()
 
-	s3URI := fmt.Sprintf("s3://%s/%s", p.bucket, s3Key)
-	log.Printf("UPLOAD: %s -> %s", filepath.Base(localFile), s3URI)
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat file for upload: %w", err)
+	}
 
 	input := &s3.PutObjectInput{
 		Bucket:       aws.String(p.bucket),
-		Key:          aws.String(s3Key),
+		Key:          aws.String(result.Key),
 		Body:         file,
 		StorageClass: p.storageClass,
+		Metadata:     uploadMetadata(info),
+	}
+	if p.pathRoot != "" {
+		if rel, err := filepath.Rel(p.pathRoot, result.LocalFile); err == nil && filepath.IsLocal(rel) {
+			if !recordPath(input.Metadata, filepath.ToSlash(rel)) {
+				slog.Warn("Path is too long for the object metadata, recording its hash", "path", result.LocalFile, "key", result.Key)
+			}
+		}
+	}
+	// In inbox mode the local file is removed after the upload, so have S3
+	// verify that it received exactly what was read.
+	if p.inbox != nil {
+		sum, err := contentMD5(file)
+		if err != nil {
+			return fmt.Errorf("could not read file for upload: %w", err)
+		}
+		input.ContentMD5 = aws.String(sum)
+	}
+	if p.checksums {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+
+	output, key, err := p.put(ctx, input, file)
+	if err != nil {
+		return err
+	}
+	p.rememberETag(key, aws.ToString(output.ETag))
+	result.ETag = aws.ToString(output.ETag)
+	result.VersionID = aws.ToString(output.VersionId)
+	result.Checksum = aws.ToString(output.ChecksumSHA256)
+	result.Size = info.Size()
+	return nil
+}
+
+// processDelete handles the deletion of result.Key from S3
+func (p *UploadWorkerPool) processDelete(ctx context.Context, result *JobResult) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(result.Key),
 	}
 
-	_, err = p.uploader.Upload(ctx, input)
+	output, err := p.uploader.DeleteObject(ctx, input)
 	if err != nil {
-		log.Printf("ERROR: Failed to upload %s: %v", localFile, err)
+		return err
 	}
+	p.forgetETag(result.Key)
+	result.VersionID = aws.ToString(output.VersionId)
+	return nil
 }
 
 // QueueUpload adds a new upload job to the queue
 func (p *UploadWorkerPool) QueueUpload(localFile, s3Key string) {
-	p.jobQueue <- UploadJob{
+	p.queue(UploadJob{
+		op:        opUpload,
+		localFile: localFile,
+		s3Key:     s3Key,
+	})
+}
+
+// QueueDelete adds a new delete job to the queue
+func (p *UploadWorkerPool) QueueDelete(s3Key string) {
+	p.queue(UploadJob{
+		op:    opDelete,
+		s3Key: s3Key,
+	})
+}
+
+// QueueDownload adds a new download job to the queue. The optional done
+// callback is invoked with the result once the download has been processed.
+func (p *UploadWorkerPool) QueueDownload(s3Key, localFile string, done func(result JobResult)) {
+	p.queue(UploadJob{
+		op:        opDownload,
 		localFile: localFile,
 		s3Key:     s3Key,
+		done:      done,
+	})
+}
+
+// queue adds a job to the queue. Jobs queued after shutdown are dropped and
+// reported as failed to their done callback.
+func (p *UploadWorkerPool) queue(job UploadJob) {
+	p.sendMu.RLock()
+	defer p.sendMu.RUnlock()
+	if p.closed {
+		slog.Warn("Dropping job queued after shutdown", "op", job.op.String(), "key", job.s3Key)
+		if job.done != nil {
+			job.done(JobResult{Op: job.op, LocalFile: job.localFile, Key: job.s3Key, Err: errPoolClosed})
+		}
+		return
+	}
+	p.jobQueue <- p.jobs.add(job)
+}
+
+// tryQueue adds a job to the queue if there is room in it. Unlike queue, it
+// never blocks, and returns errQueueFull or, after shutdown, errPoolClosed
+// instead.
+func (p *UploadWorkerPool) tryQueue(job UploadJob) error {
+	p.sendMu.RLock()
+	defer p.sendMu.RUnlock()
+	if p.closed {
+		return errPoolClosed
+	}
+	job = p.jobs.add(job)
+	select {
+	case p.jobQueue <- job:
+		return nil
+	default:
+		p.jobs.forget(job.id)
+		return errQueueFull
+	}
+}
+
+// runNow processes a job right away on the calling goroutine. It is tracked
+// like a queued job, so a failure can be retried through the queue.
+func (p *UploadWorkerPool) runNow(ctx context.Context, job UploadJob) JobResult {
+	job = p.jobs.add(job)
+	p.jobs.start(job.id)
+	result := p.process(ctx, job)
+	p.jobs.finish(job.id, result.Err)
+	return result
+}
+
+// Stats returns a snapshot of the jobs processed so far.
+func (p *UploadWorkerPool) Stats() PoolStats {
+	return PoolStats{
+		Uploaded:   p.uploaded.Load(),
+		Deleted:    p.deleted.Load(),
+		Downloaded: p.downloaded.Load(),
+		Failed:     p.failed.Load(),
 	}
 }
 
-// Shutdown gracefully shuts down the worker pool
+// Shutdown gracefully shuts down the worker pool. It is safe to call more
+// than once.
 func (p *UploadWorkerPool) Shutdown() {
-	close(p.jobQueue)
-	p.wg.Wait()
+	p.shutdownOnce.Do(func() {
+		// Paused workers would never drain the queue.
+		p.gate.stop()
+		p.sendMu.Lock()
+		p.closed = true
+		close(p.jobQueue)
+		p.sendMu.Unlock()
+	})
+	<-p.drained
 }
 
+// Sync directions accepted by the --direction flag.
+const (
+	directionPush = "push" // Upload local changes to S3
+	directionPull = "pull" // Download S3 changes to the local path
+	directionBoth = "both" // Sync changes in both directions
+)
+
 // App holds the application's configuration and dependencies.
 type App struct {
-	uploader      S3Uploader
-	localPath     string
-	isDir         bool // True if localPath is a directory
-	bucket        string
-	keyPrefix     string
-	delete        bool
-	storageClass  types.StorageClass
-	workerPool    *UploadWorkerPool
-	maxConcurrent int
+	uploader       S3Uploader
+	localPath      string
+	isDir          bool // True if localPath is a directory
+	direction      string
+	bucket         string
+	keyPrefix      string
+	delete         bool
+	dryRun         bool
+	storageClass   types.StorageClass
+	workerPool     *UploadWorkerPool
+	maxConcurrent  int
+	pollInterval   time.Duration
+	watcher        WatcherConfig
+	statePath      string
+	conflictPolicy string
+	metrics        *metrics          // Optional, set when --metrics-addr is used
+	health         *health           // Optional, set when --health-addr is used
+	completion     *completionWaiter // Optional, holds back files that are still being written
+	manifest       ManifestConfig
+	checksums      *checksumIndex // Optional, set when manifests are published
+	keys           *keyMapper     // Optional, set when keys are made from a template or rewritten
 }
 
 // AppConfig holds the configuration for the application.
 type AppConfig struct {
-	LocalPath     string
-	Bucket        string
-	KeyPrefix     string
-	Delete        bool
-	StorageClass  types.StorageClass
-	MaxConcurrent int
+	LocalPath         string
+	Bucket            string
+	KeyPrefix         string
+	Delete            bool
+	StorageClass      types.StorageClass
+	MaxConcurrent     int
+	Once              bool
+	DryRun            bool
+	Direction         string
+	PollInterval      time.Duration
+	Watcher           WatcherConfig
+	StatePath         string
+	ConflictPolicy    string
+	ConditionalWrites bool
+	OnConflict        string
+	MetricsAddr       string
+	HealthAddr        string
+	ControlSocket     string
+	Inbox             InboxConfig
+	Archive           ArchiveConfig
+	Preflight         PreflightConfig
+	Keys              KeyConfig
+	Completion        CompletionConfig
+	AuditLog          string
+	Manifest          ManifestConfig
+	WebhookURLs       []string
+	Webhook           WebhookConfig
+	Hooks             HookConfig
+	Logging           LoggingConfig
+}
+
+// stringListFlag is a flag that may be given more than once.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 // getDefaultConcurrency returns a reasonable default concurrency limit
@@ -171,7 +523,7 @@ type AppConfig struct {
 func getDefaultConcurrency() int {
 	// Use number of CPUs as a baseline
 	numCPU := runtime.NumCPU()
-	
+
 	// For systems with many cores, we don't want to create too many workers
 	// as network and disk I/O will become the bottleneck
 	switch {
@@ -194,12 +546,242 @@ func parseFlags() (showVersion bool, config *AppConfig, args []string, err error
 	storageClassFlag := flag.String("storage-class", string(types.StorageClassIntelligentTiering), "Specify the S3 storage class (e.g., STANDARD, GLACIER).")
 	versionFlag := flag.Bool("version", false, "Print the echos3 version and exit.")
 	concurrencyFlag := flag.Int("concurrency", getDefaultConcurrency(), "Maximum number of concurrent uploads.")
+	onceFlag := flag.Bool("once", false, "Sync the local path to S3 once and exit instead of watching for changes.")
+	dryRunFlag := flag.Bool("dry-run", false, "Log the S3 operations that would be performed without making any changes.")
+	directionFlag := flag.String("direction", directionPush, "Sync direction: push (local to S3), pull (S3 to local) or both.")
+	pollIntervalFlag := flag.Duration("poll-interval", 30*time.Second, "How often to check for changes in pull and both modes.")
+	watcherFlag := flag.String("watcher", watcherAuto, "How to watch the local path for changes: fsnotify, poll (for NFS, SMB and FUSE mounts, where fsnotify misses changes), fanotify (Linux only, needs CAP_SYS_ADMIN, watches huge trees without a watch per directory) or auto (poll on network filesystems, fsnotify elsewhere).")
+	watchIntervalFlag := flag.Duration("watch-interval", defaultWatchInterval, "Time between scans of the local path by --watcher poll.")
+	watchParallelismFlag := flag.Int("watch-parallelism", defaultWatchParallelism, "Number of directories --watcher poll scans at once.")
+	stateFileFlag := flag.String("state-file", "", "Path of the sync state database used by --direction both (default: in the user cache directory).")
+	conflictPolicyFlag := flag.String("conflict-policy", conflictNewest, "How --direction both resolves files changed on both sides: newest, keep-both or local.")
+	conditionalWritesFlag := flag.Bool("conditional-writes", false, "Only overwrite objects that have not been changed by another writer since echos3 last saw them.")
+	onConflictFlag := flag.String("on-conflict", onConflictSkip, "What to do when a conditional write conflicts: skip, overwrite or conflict-key.")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (e.g., :9090). Disabled if empty.")
+	healthAddrFlag := flag.String("health-addr", "", "Address to serve /healthz and /readyz on (e.g., :8080). May be the same as --metrics-addr. Disabled if empty.")
+	controlSocketFlag := flag.String("control-socket", "", "Path of a Unix socket serving the control API used by 'echos3 ctl'. Disabled if empty.")
+	inboxFlag := flag.String("inbox", "", "Treat the watched directory as a drop folder: delete or move each file once its upload is verified. Local removals are never propagated to S3.")
+	inboxArchiveDirFlag := flag.String("inbox-archive-dir", "", "Directory uploaded files are moved to by --inbox move. Must be outside the watched directory.")
+	archiveKeyFlag := flag.String("archive-key", "", "Upload a watched file to a new key every time, made from this template of {key}, {name}, {ext}, {time} and {sha256} (e.g., '{key}/{time}{ext}'). Disabled if empty.")
+	archiveLatestKeyFlag := flag.String("archive-latest-key", "", "Key kept as a copy of the newest archive by --archive-key. Disabled if empty.")
+	archiveRetentionFlag := flag.Int("archive-retention", 0, "Number of archives kept by --archive-key, deleting older ones (0 keeps all of them).")
+	skipPreflightFlag := flag.Bool("skip-preflight", false, "Start without checking that the bucket exists and can be accessed.")
+	preflightWriteFlag := flag.Bool("preflight-write", false, "Also check at startup that objects can be written, by putting and deleting a sentinel object below the S3 path.")
+	keyTemplateFlag := flag.String("key-template", "", "Template of the keys of files below the S3 path, of {path}, {dir}, {file}, {name}, {ext}, path components {1} to {9}, {hostname} and {year}, {month}, {day} and {hour} of the modification time (e.g., 'year={year}/month={month}/day={day}/{path}'). Default: {path}.")
+	var keyRewrites stringListFlag
+	flag.Var(&keyRewrites, "key-rewrite", "PATTERN=>REPLACEMENT rewriting the keys made by --key-template with a regular expression (e.g., '^([^/]+)/=>source=$1/'). May be given more than once; rules apply in order.")
+	sanitizeKeysFlag := flag.Bool("sanitize-keys", false, "Normalise keys to Unicode NFC, replace control and unsafe characters, and shorten keys longer than S3's 1024 byte limit with a hash. Uploads record the original path in their metadata for restores.")
+	sanitizeUnsafeFlag := flag.String("sanitize-unsafe-chars", defaultUnsafeKeyChars, "Characters --sanitize-keys replaces, besides control characters.")
+	sanitizeReplacementFlag := flag.String("sanitize-replacement", "_", "What --sanitize-keys replaces unsafe characters and invalid UTF-8 with.")
+	var completionRules stringListFlag
+	flag.Var(&completionRules, "complete-when", "PATTERN=STRATEGY deciding when matching files are complete and may be uploaded: immediate, stable, close-write, no-writers, marker:MARKER or batch:MARKER (e.g., '*.csv=marker:.done'). May be given more than once; the first match applies.")
+	stableChecksFlag := flag.Int("stable-checks", 3, "Consecutive checks without a change in size or modification time the stable strategy requires.")
+	stableIntervalFlag := flag.Duration("stable-interval", time.Second, "Time between checks of the stable and no-writers strategies.")
+	auditLogFlag := flag.String("audit-log", "", "Append a JSON line to this file for every upload and delete, with its key, size, SHA-256 checksum, version ID and time.")
+	manifestKeyFlag := flag.String("manifest-key", "", "Object key to periodically upload a signed JSON manifest of the mirrored objects to. Must be outside the mirrored prefix.")
+	manifestIntervalFlag := flag.Duration("manifest-interval", time.Hour, "How often to upload the manifest while watching.")
+	manifestSecretFlag := flag.String("manifest-secret", os.Getenv("ECHOS3_MANIFEST_SECRET"), "Key used to sign manifests with HMAC-SHA256 (default: $ECHOS3_MANIFEST_SECRET).")
+	var webhookURLs stringListFlag
+	flag.Var(&webhookURLs, "webhook-url", "URL to POST a JSON event to after every upload, delete and download. May be given more than once.")
+	webhookSecretFlag := flag.String("webhook-secret", os.Getenv("ECHOS3_WEBHOOK_SECRET"), "Key used to sign webhook requests with HMAC-SHA256 (default: $ECHOS3_WEBHOOK_SECRET).")
+	webhookBatchSizeFlag := flag.Int("webhook-batch-size", 10, "Maximum number of events sent in a single webhook request.")
+	webhookBatchIntervalFlag := flag.Duration("webhook-batch-interval", time.Second, "Maximum time an event waits for a webhook batch to fill.")
+	webhookTimeoutFlag := flag.Duration("webhook-timeout", defaultWebhookTimeout, "Timeout of a single webhook request.")
+	webhookRetriesFlag := flag.Int("webhook-retries", 3, "Number of times a failed webhook request is retried.")
+	preUploadHookFlag := flag.String("pre-upload-hook", "", "Shell command run before each upload. A non-zero exit status vetoes the upload.")
+	postUploadHookFlag := flag.String("post-upload-hook", "", "Shell command run after each successful upload, with the new ETag in ECHOS3_ETAG.")
+	hookTimeoutFlag := flag.Duration("hook-timeout", time.Minute, "Time an upload hook may run before it is killed (0 for no limit).")
+	hookConcurrencyFlag := flag.Int("hook-concurrency", 0, "Maximum number of upload hooks running at once (0 for one per worker).")
+	logLevelFlag := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error. Debug includes raw file system events.")
+	logFormatFlag := flag.String("log-format", logFormatText, "Log output format: text or json.")
+	logFileFlag := flag.String("log-file", "", "Write logs to this file instead of stderr.")
+	logMaxSizeFlag := flag.Int("log-max-size", 100, "Size in megabytes at which the log file is rotated.")
+	logMaxBackupsFlag := flag.Int("log-max-backups", 5, "Number of rotated log files to keep (0 keeps all of them).")
 	flag.Parse()
 
+	switch *directionFlag {
+	case directionPush, directionPull, directionBoth:
+	default:
+		return false, nil, nil, fmt.Errorf("invalid direction %q: must be push, pull or both", *directionFlag)
+	}
+
+	switch *watcherFlag {
+	case watcherAuto, watcherFsnotify, watcherPoll, watcherFanotify:
+	default:
+		return false, nil, nil, fmt.Errorf("invalid watcher %q: must be auto, fsnotify, poll or fanotify", *watcherFlag)
+	}
+	if *watchIntervalFlag <= 0 {
+		return false, nil, nil, fmt.Errorf("invalid watch interval %s: must be positive", *watchIntervalFlag)
+	}
+	if *watchParallelismFlag < 1 {
+		return false, nil, nil, fmt.Errorf("invalid watch parallelism %d: must be at least 1", *watchParallelismFlag)
+	}
+
+	switch *conflictPolicyFlag {
+	case conflictNewest, conflictKeepBoth, conflictLocal:
+	default:
+		return false, nil, nil, fmt.Errorf("invalid conflict policy %q: must be newest, keep-both or local", *conflictPolicyFlag)
+	}
+
+	switch *onConflictFlag {
+	case onConflictSkip, onConflictOverwrite, onConflictKey:
+	default:
+		return false, nil, nil, fmt.Errorf("invalid conflict handler %q: must be skip, overwrite or conflict-key", *onConflictFlag)
+	}
+
+	logLevel, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	switch *logFormatFlag {
+	case logFormatText, logFormatJSON:
+	default:
+		return false, nil, nil, fmt.Errorf("invalid log format %q: must be text or json", *logFormatFlag)
+	}
+
+	switch *inboxFlag {
+	case "":
+		if *inboxArchiveDirFlag != "" {
+			return false, nil, nil, errors.New("--inbox-archive-dir requires --inbox move")
+		}
+	case inboxDelete, inboxMove:
+		if *onceFlag || *directionFlag != directionPush {
+			return false, nil, nil, errors.New("--inbox requires watching with --direction push")
+		}
+		if (*inboxFlag == inboxMove) != (*inboxArchiveDirFlag != "") {
+			return false, nil, nil, errors.New("--inbox-archive-dir must be set with --inbox move, and only then")
+		}
+	default:
+		return false, nil, nil, fmt.Errorf("invalid inbox action %q: must be delete or move", *inboxFlag)
+	}
+
+	if *archiveKeyFlag == "" {
+		if *archiveLatestKeyFlag != "" || *archiveRetentionFlag != 0 {
+			return false, nil, nil, errors.New("--archive-latest-key and --archive-retention require --archive-key")
+		}
+	} else if *directionFlag != directionPush || *deleteFlag {
+		return false, nil, nil, errors.New("--archive-key requires --direction push without --delete")
+	}
+	if *archiveRetentionFlag < 0 {
+		return false, nil, nil, fmt.Errorf("invalid archive retention %d: must not be negative", *archiveRetentionFlag)
+	}
+
+	if *skipPreflightFlag && *preflightWriteFlag {
+		return false, nil, nil, errors.New("--preflight-write cannot be combined with --skip-preflight")
+	}
+
+	keys, err := parseKeyConfig(*keyTemplateFlag, keyRewrites)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	keys.Sanitize = SanitizeConfig{Enabled: *sanitizeKeysFlag, Unsafe: *sanitizeUnsafeFlag, Replacement: *sanitizeReplacementFlag}
+	if err := checkSanitize(keys.Sanitize); err != nil {
+		return false, nil, nil, err
+	}
+	if keys.enabled() && *directionFlag != directionPush {
+		return false, nil, nil, errors.New("--key-template, --key-rewrite and --sanitize-keys require --direction push")
+	}
+
+	completion := CompletionConfig{
+		Default:        completeImmediate,
+		StableChecks:   *stableChecksFlag,
+		StableInterval: *stableIntervalFlag,
+	}
+	if *inboxFlag != "" {
+		completion.Default = completeStable // Inboxes must never upload partial files
+	}
+	for _, value := range completionRules {
+		rule, err := parseCompletionRule(value)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		completion.Rules = append(completion.Rules, rule)
+	}
+	if *stableChecksFlag < 1 {
+		return false, nil, nil, fmt.Errorf("invalid stable checks %d: must be at least 1", *stableChecksFlag)
+	}
+	if *stableIntervalFlag <= 0 {
+		return false, nil, nil, fmt.Errorf("invalid stable interval %s: must be positive", *stableIntervalFlag)
+	}
+
+	if *manifestKeyFlag != "" && *directionFlag != directionPush {
+		return false, nil, nil, errors.New("--manifest-key requires --direction push")
+	}
+	if *manifestIntervalFlag <= 0 {
+		return false, nil, nil, fmt.Errorf("invalid manifest interval %s: must be positive", *manifestIntervalFlag)
+	}
+
+	if *webhookBatchSizeFlag < 1 {
+		return false, nil, nil, fmt.Errorf("invalid webhook batch size %d: must be at least 1", *webhookBatchSizeFlag)
+	}
+	if *webhookTimeoutFlag <= 0 {
+		return false, nil, nil, fmt.Errorf("invalid webhook timeout %s: must be positive", *webhookTimeoutFlag)
+	}
+
 	config = &AppConfig{
-		Delete:        *deleteFlag,
-		StorageClass:  types.StorageClass(*storageClassFlag),
-		MaxConcurrent: *concurrencyFlag,
+		Delete:            *deleteFlag,
+		StorageClass:      types.StorageClass(*storageClassFlag),
+		MaxConcurrent:     *concurrencyFlag,
+		Once:              *onceFlag,
+		DryRun:            *dryRunFlag,
+		Direction:         *directionFlag,
+		PollInterval:      *pollIntervalFlag,
+		StatePath:         *stateFileFlag,
+		ConflictPolicy:    *conflictPolicyFlag,
+		ConditionalWrites: *conditionalWritesFlag,
+		OnConflict:        *onConflictFlag,
+		MetricsAddr:       *metricsAddrFlag,
+		HealthAddr:        *healthAddrFlag,
+		ControlSocket:     *controlSocketFlag,
+		Watcher: WatcherConfig{
+			Backend:     *watcherFlag,
+			Interval:    *watchIntervalFlag,
+			Parallelism: *watchParallelismFlag,
+		},
+		Inbox: InboxConfig{
+			Action:     *inboxFlag,
+			ArchiveDir: *inboxArchiveDirFlag,
+		},
+		Archive: ArchiveConfig{
+			Key:       *archiveKeyFlag,
+			LatestKey: *archiveLatestKeyFlag,
+			Retention: *archiveRetentionFlag,
+		},
+		Preflight: PreflightConfig{
+			Enabled: !*skipPreflightFlag,
+			Write:   *preflightWriteFlag,
+		},
+		Keys:       keys,
+		Completion: completion,
+		AuditLog:   *auditLogFlag,
+		Manifest: ManifestConfig{
+			Key:      *manifestKeyFlag,
+			Interval: *manifestIntervalFlag,
+			Secret:   *manifestSecretFlag,
+		},
+		WebhookURLs: webhookURLs,
+		Webhook: WebhookConfig{
+			Secret:        *webhookSecretFlag,
+			BatchSize:     *webhookBatchSizeFlag,
+			BatchInterval: *webhookBatchIntervalFlag,
+			Timeout:       *webhookTimeoutFlag,
+			MaxRetries:    *webhookRetriesFlag,
+			RetryBackoff:  time.Second,
+		},
+		Hooks: HookConfig{
+			PreUpload:     *preUploadHookFlag,
+			PostUpload:    *postUploadHookFlag,
+			Timeout:       *hookTimeoutFlag,
+			MaxConcurrent: *hookConcurrencyFlag,
+		},
+		Logging: LoggingConfig{
+			Level:      logLevel,
+			Format:     *logFormatFlag,
+			File:       *logFileFlag,
+			MaxSizeMB:  *logMaxSizeFlag,
+			MaxBackups: *logMaxBackupsFlag,
+		},
 	}
 
 	return *versionFlag, config, flag.Args(), nil
@@ -235,29 +817,143 @@ func createApp(ctx context.Context, config *AppConfig, localPath string, isDir b
 		return nil, fmt.Errorf("failed to create S3 client: %w", err)
 	}
 
+	var uploader S3Uploader = s3Client
+	if config.DryRun {
+		slog.Info("Dry run enabled. No changes will be made to S3")
+		uploader = NewDryRunUploader(s3Client)
+	}
+
 	app := &App{
-		uploader:      s3Client,
-		localPath:     localPath,
-		isDir:         isDir,
-		bucket:        config.Bucket,
-		keyPrefix:     config.KeyPrefix,
-		delete:        config.Delete,
-		storageClass:  config.StorageClass,
-		maxConcurrent: config.MaxConcurrent,
+		uploader:       uploader,
+		localPath:      localPath,
+		isDir:          isDir,
+		direction:      config.Direction,
+		bucket:         config.Bucket,
+		keyPrefix:      config.KeyPrefix,
+		delete:         config.Delete,
+		dryRun:         config.DryRun,
+		storageClass:   config.StorageClass,
+		maxConcurrent:  config.MaxConcurrent,
+		pollInterval:   config.PollInterval,
+		watcher:        config.Watcher,
+		statePath:      config.StatePath,
+		conflictPolicy: config.ConflictPolicy,
+	}
+
+	// Fail fast if the bucket cannot be used, before anything is started.
+	if config.Preflight.Enabled {
+		if err := app.preflight(ctx, s3Client, config.Preflight); err != nil {
+			return nil, err
+		}
 	}
 
 	// Create the worker pool for concurrent uploads
-	app.workerPool = NewUploadWorkerPool(s3Client, config.Bucket, config.StorageClass, config.MaxConcurrent)
+	app.workerPool = NewUploadWorkerPool(uploader, config.Bucket, config.StorageClass, config.MaxConcurrent)
+	if config.ConditionalWrites {
+		app.workerPool.EnableConditionalWrites(config.OnConflict)
+	}
+	if config.Inbox.Action != "" {
+		if err := checkInbox(config.Inbox, localPath, isDir); err != nil {
+			return nil, err
+		}
+		if config.DryRun {
+			slog.Info("Dry run enabled. Uploaded files will not be removed from the inbox")
+		} else {
+			app.workerPool.EnableInbox(localPath, config.Inbox)
+		}
+	}
+	if config.Keys.enabled() {
+		if err := app.mapKeys(config.Keys); err != nil {
+			return nil, err
+		}
+		// The key of a removed file cannot be made from its modification time.
+		if app.keys.usesTime && config.Delete {
+			return nil, errors.New("--key-template with date variables cannot be combined with --delete")
+		}
+		app.workerPool.RecordPaths(localPath)
+	}
+	if config.Archive.Key != "" {
+		if isDir {
+			return nil, errors.New("--archive-key requires watching a single file")
+		}
+		if err := app.workerPool.EnableArchive(config.Archive, localPath, config.KeyPrefix); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Completion.Rules) > 0 || config.Completion.Default != completeImmediate {
+		root := localPath
+		if !isDir {
+			root = filepath.Dir(localPath)
+		}
+		if app.completion, err = newCompletionWaiter(config.Completion, root, app.s3KeyFor, app.workerPool); err != nil {
+			return nil, err
+		}
+	}
+	if config.AuditLog != "" {
+		if config.DryRun {
+			slog.Info("Dry run enabled. Nothing will be written to the audit log")
+		} else {
+			audit, err := openAuditLog(config.AuditLog)
+			if err != nil {
+				return nil, err
+			}
+			app.workerPool.AddEventSink(audit)
+			app.workerPool.EnableChecksums()
+		}
+	}
+	if config.Manifest.Key != "" {
+		if err := checkManifest(config.Manifest, app.remotePrefix(), app.isDir); err != nil {
+			return nil, err
+		}
+		app.manifest = config.Manifest
+		app.checksums = newChecksumIndex()
+		app.workerPool.AddEventSink(app.checksums)
+		app.workerPool.EnableChecksums()
+	}
+	if len(config.WebhookURLs) > 0 && config.DryRun {
+		slog.Info("Dry run enabled. Webhooks will not be called")
+	} else {
+		for _, url := range config.WebhookURLs {
+			app.workerPool.AddEventSink(newWebhookSink(url, config.Webhook))
+		}
+	}
+	if config.Hooks.PreUpload != "" || config.Hooks.PostUpload != "" {
+		if config.DryRun {
+			slog.Info("Dry run enabled. Upload hooks will not be run")
+		} else {
+			app.workerPool.EnableHooks(config.Hooks)
+		}
+	}
 
 	return app, nil
 }
 
+// fatal logs an error and exits with a non-zero status.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 // main is the entry point of the application.
 func main() {
+	// Subcommands have their own flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:], os.Stdout, os.Stderr))
+		case "verify":
+			os.Exit(runVerify(context.Background(), os.Args[2:], os.Stdout, os.Stderr))
+		case "restore":
+			os.Exit(runRestore(context.Background(), os.Args[2:], os.Stdout, os.Stderr))
+		case "history":
+			os.Exit(runHistory(context.Background(), os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	// Parse flags
 	showVersion, config, args, err := parseFlags()
 	if err != nil {
-		log.Fatalf("FATAL: Failed to parse flags: %v", err)
+		fatal("Failed to parse flags", err)
 	}
 
 	if showVersion {
@@ -265,93 +961,204 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Set up logging
+	closeLog, err := setupLogging(config.Logging)
+	if err != nil {
+		fatal("Failed to set up logging", err)
+	}
+	defer closeLog()
+
 	// Validate arguments
 	localPathArg, s3Path, err := validateArgs(args)
 	if err != nil {
-		log.Fatal("Usage: echos3 /path/to/watch s3://bucket/key [--delete] [--storage-class STORAGE_CLASS]")
+		fmt.Fprintln(os.Stderr, "Usage: echos3 /path/to/watch s3://bucket/key [--delete] [--storage-class STORAGE_CLASS] [--once] [--dry-run] [--direction push|pull|both]")
+		fmt.Fprintln(os.Stderr, "       echos3 ctl --socket PATH COMMAND")
+		fmt.Fprintln(os.Stderr, "       echos3 verify [--json] /path/to/watch s3://bucket/key")
+		fmt.Fprintln(os.Stderr, "       echos3 restore [--as-of TIME | --version-id ID] [--force] s3://bucket/key /path/to/restore")
+		fmt.Fprintln(os.Stderr, "       echos3 history [--socket PATH] FILE [/path/to/watch s3://bucket/key]")
+		os.Exit(1)
 	}
 
 	// Setup local path
 	localPath, pathInfo, err := setupLocalPath(localPathArg)
 	if err != nil {
-		log.Fatalf("FATAL: %v", err)
+		fatal("Invalid local path", err)
 	}
 
 	// Parse S3 path
 	bucket, keyPrefix, err := parseS3Path(s3Path)
 	if err != nil {
-		log.Fatalf("FATAL: Invalid S3 path: %v", err)
+		fatal("Invalid S3 path", err)
+	}
+	if !pathInfo.IsDir() {
+		keyPrefix = fileKey(keyPrefix, localPath)
 	}
 	config.Bucket = bucket
 	config.KeyPrefix = keyPrefix
 	config.LocalPath = localPath
 
-	// Create and run the application
-	ctx := context.Background()
+	// Create and run the application. The context is cancelled to stop the
+	// main loop when a flush is requested through the control socket.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
 	app, err := createApp(ctx, config, localPath, pathInfo.IsDir())
 	if err != nil {
-		log.Fatalf("FATAL: %v", err)
+		fatal("Failed to create application", err)
 	}
 
-	if err := app.run(ctx); err != nil {
-		log.Fatalf("FATAL: Application failed: %v", err)
+	if _, err := app.startHTTP(config.MetricsAddr, config.HealthAddr); err != nil {
+		fatal("Failed to start HTTP server", err)
+	}
+
+	if config.ControlSocket != "" {
+		control, err := app.serveControl(config.ControlSocket, stop)
+		if err != nil {
+			fatal("Failed to start control server", err)
+		}
+		// Give a pending flush request the chance to receive its response.
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = control.Shutdown(shutdownCtx)
+		}()
+	}
+
+	switch {
+	case config.Direction == directionPull && config.Once:
+		if _, err := app.pullOnce(ctx); err != nil {
+			fatal("Pull failed", err)
+		}
+	case config.Direction == directionPull:
+		if err := app.runPull(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			fatal("Application failed", err)
+		}
+	case config.Direction == directionBoth && config.Once:
+		if _, err := app.bisyncOnce(ctx); err != nil {
+			fatal("Sync failed", err)
+		}
+	case config.Direction == directionBoth:
+		if err := app.runBisync(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			fatal("Application failed", err)
+		}
+	case config.Once:
+		if _, err := app.syncOnce(ctx); err != nil {
+			fatal("Sync failed", err)
+		}
+		if config.Manifest.Key != "" {
+			if err := app.publishManifest(ctx); err != nil {
+				fatal("Could not publish manifest", err)
+			}
+		}
+	default:
+		if err := app.run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			fatal("Application failed", err)
+		}
 	}
 }
 
 // run starts the file watcher and handles events.
 func (a *App) run(ctx context.Context) error {
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := newFileWatcher(a.watcher, a.localPath)
 	if err != nil {
 		return fmt.Errorf("could not create file watcher: %w", err)
 	}
 	defer func() {
 		if err := watcher.Close(); err != nil {
-			log.Printf("ERROR: Could not close watcher: %v", err)
+			slog.Error("Could not close watcher", "error", err)
 		}
 		// Shutdown the worker pool when done
+		a.completion.stop()
 		a.workerPool.Shutdown()
 	}()
 
 	if a.isDir {
+		// Tree watchers watch the whole directory at once, so it only needs
+		// walking for the files in the inbox.
+		tree, isTree := watcher.(treeWatcher)
+		if isTree {
+			if err := tree.AddTree(a.localPath); err != nil {
+				return fmt.Errorf("failed to add path to watcher %s: %w", a.localPath, err)
+			}
+			a.metrics.directoryWatched()
+		}
 		// If the path is a directory, walk it and add all subdirectories.
-		log.Printf("INFO: Performing initial scan of directory %s...", a.localPath)
+		slog.Info("Performing initial scan of directory", "path", a.localPath)
 		err = filepath.Walk(a.localPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
+			if isTree && a.workerPool.inbox == nil {
+				return filepath.SkipAll
+			}
 			if info.IsDir() {
+				if isTree {
+					return nil
+				}
 				if err := watcher.Add(path); err != nil {
 					return fmt.Errorf("failed to add path to watcher %s: %w", path, err)
 				}
+				a.metrics.directoryWatched()
+			} else if a.workerPool.inbox != nil {
+				// Files dropped while echos3 was not running
+				s3Key, err := a.s3KeyFor(path)
+				if err != nil {
+					return err
+				}
+				a.handleUpload(ctx, path, s3Key)
 			}
 			return nil
 		})
 		if err != nil {
 			return fmt.Errorf("error during initial directory scan: %w", err)
 		}
-		log.Printf("INFO: Watching directory for changes. Uploading to s3://%s/%s", a.bucket, a.keyPrefix)
+		slog.Info("Watching directory for changes", "path", a.localPath, "bucket", a.bucket, "key", a.keyPrefix)
 	} else {
 		// If the path is a file, watch its parent directory.
 		parentDir := filepath.Dir(a.localPath)
-		log.Printf("INFO: Watching single file %s in directory %s", filepath.Base(a.localPath), parentDir)
+		slog.Info("Watching single file", "path", a.localPath, "bucket", a.bucket, "key", a.keyPrefix)
 		if err := watcher.Add(parentDir); err != nil {
 			return fmt.Errorf("failed to watch directory %s for file changes: %w", parentDir, err)
 		}
+		a.metrics.directoryWatched()
+	}
+
+	// Conditional writes need the current ETags of existing objects, otherwise
+	// the first upload of every existing key would be reported as a conflict.
+	if a.workerPool.etags != nil {
+		remote, err := a.listRemote(ctx)
+		if err != nil {
+			return fmt.Errorf("could not load ETags for conditional writes: %w", err)
+		}
+		a.workerPool.RememberObjects(remote)
+	}
+	a.health.initialScanDone()
+
+	if a.manifest.Key != "" {
+		go a.publishManifests(ctx)
 	}
 
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	a.health.loopStarted(heartbeatTimeout)
+	defer a.health.loopStopped()
+
 	// Main event loop
 	for {
 		select {
-		case event, ok := <-watcher.Events:
+		case <-heartbeat.C:
+			a.health.beat()
+		case event, ok := <-watcher.Events():
 			if !ok {
 				return nil
 			}
+			slog.Debug("File system event", "path", event.Name, "event", event.Op.String())
+			a.metrics.observeEvent(event)
 			a.handleEvent(ctx, event, watcher)
-		case err, ok := <-watcher.Errors:
+		case err, ok := <-watcher.Errors():
 			if !ok {
 				return nil
 			}
-			log.Printf("ERROR: Watcher error: %v", err)
+			slog.Error("Watcher error", "error", err)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -359,47 +1166,57 @@ func (a *App) run(ctx context.Context) error {
 }
 
 // handleEvent processes a single file system event.
-func (a *App) handleEvent(ctx context.Context, event fsnotify.Event, watcher *fsnotify.Watcher) {
+func (a *App) handleEvent(ctx context.Context, event fsnotify.Event, watcher directoryWatcher) {
 	// If watching a single file, ignore events for any other file.
 	if !a.isDir && event.Name != a.localPath {
 		return
 	}
 
-	var s3Key string
-	if a.isDir {
-		// For directories, the S3 key is relative to the watched directory.
-		relPath, err := filepath.Rel(a.localPath, event.Name)
-		if err != nil {
-			log.Printf("ERROR: Could not determine relative path for %s: %v", event.Name, err)
-			return
-		}
-		s3Key = filepath.ToSlash(filepath.Join(a.keyPrefix, relPath))
-	} else {
-		// For a single file, the S3 key is simply the key prefix provided.
-		s3Key = a.keyPrefix
+	// Files removed by the inbox after their upload must stay in S3.
+	if a.workerPool.inbox.removed(event.Name) {
+		slog.Debug("Ignoring removal of uploaded inbox file", "path", event.Name)
+		return
+	}
+
+	// Markers only tell that other files are complete, and are not synced.
+	if _, ok := a.completion.markedFiles(event.Name); ok {
+		a.completion.offer(event.Name)
+		return
+	}
+
+	s3Key, err := a.s3KeyFor(event.Name)
+	if err != nil {
+		slog.Error("Could not map file to an S3 key", "path", event.Name, "error", err)
+		return
 	}
 
 	op := event.Op
 	// Handle writes, creates, and renames as upload events
 	if op&fsnotify.Write == fsnotify.Write || op&fsnotify.Create == fsnotify.Create || op&fsnotify.Rename == fsnotify.Rename {
-		// Wait a moment to handle rapid writes (e.g., from editors saving)
-		time.Sleep(100 * time.Millisecond)
+		// Wait a moment to handle rapid writes (e.g., from editors saving),
+		// unless the completion waiter already waits for files to settle.
+		if a.completion == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
 		info, err := os.Stat(event.Name)
 		if err != nil {
 			if os.IsNotExist(err) {
 				a.handleRemove(ctx, s3Key)
 			} else {
-				log.Printf("ERROR: Could not stat file %s: %v", event.Name, err)
+				slog.Error("Could not stat file", "path", event.Name, "error", err)
 			}
 			return
 		}
 
 		if info.IsDir() {
-			if a.isDir { // Only add new directories if we are watching a directory tree
+			// Only add new directories if we are watching a directory tree,
+			// and tree watchers watch them already.
+			if _, isTree := watcher.(treeWatcher); a.isDir && !isTree {
 				if err := watcher.Add(event.Name); err != nil {
-					log.Printf("ERROR: Failed to add new directory to watcher %s: %v", event.Name, err)
+					slog.Error("Failed to add new directory to watcher", "path", event.Name, "error", err)
 				} else {
-					log.Printf("INFO: Watching new directory: %s", event.Name)
+					slog.Info("Watching new directory", "path", event.Name)
+					a.metrics.directoryWatched()
 				}
 			}
 		} else {
@@ -410,47 +1227,83 @@ func (a *App) handleEvent(ctx context.Context, event fsnotify.Event, watcher *fs
 	}
 }
 
-// handleUpload queues a file for upload to S3 using the worker pool.
-func (a *App) handleUpload(ctx context.Context, localFile, s3Key string) {
-	// Queue the upload job to be processed by the worker pool
-	a.workerPool.QueueUpload(localFile, s3Key)
+// s3KeyFor maps a local path under the watched path to its S3 key.
+func (a *App) s3KeyFor(localFile string) (string, error) {
+	if !a.isDir {
+		// For a single file, the S3 key is simply the key prefix provided.
+		return a.keyPrefix, nil
+	}
+
+	// For directories, the S3 key is relative to the watched directory.
+	relPath, err := filepath.Rel(a.localPath, localFile)
+	if err != nil {
+		return "", fmt.Errorf("could not determine relative path for %s: %w", localFile, err)
+	}
+	if a.keys != nil {
+		key, err := a.keys.key(localFile, filepath.ToSlash(relPath))
+		if err != nil {
+			return "", fmt.Errorf("could not map %s to a key: %w", localFile, err)
+		}
+		return a.remotePrefix() + key, nil
+	}
+	return a.remotePrefix() + filepath.ToSlash(relPath), nil
 }
 
-// handleRemove deletes a single object from S3 if the --delete flag is set.
-func (a *App) handleRemove(ctx context.Context, s3Key string) {
-	if !a.delete {
-		log.Printf("INFO: File removed locally but --delete is not set. Ignoring: %s", s3Key)
-		return
+// localPathFor maps an S3 key under the mirrored prefix back to a local path.
+// It is the inverse of s3KeyFor. Keys made with rewrite rules cannot be mapped
+// back, and return an error wrapping errKeyIrreversible.
+func (a *App) localPathFor(s3Key string) (string, error) {
+	if !a.isDir {
+		if s3Key != a.keyPrefix {
+			return "", fmt.Errorf("key %s does not match watched file key %s", s3Key, a.keyPrefix)
+		}
+		return a.localPath, nil
 	}
 
-	s3URI := fmt.Sprintf("s3://%s/%s", a.bucket, s3Key)
-	log.Printf("DELETE: %s", s3URI)
-	input := &s3.DeleteObjectInput{
-		Bucket: aws.String(a.bucket),
-		Key:    aws.String(s3Key),
+	prefix := a.remotePrefix()
+	if !strings.HasPrefix(s3Key, prefix) || s3Key == prefix {
+		return "", fmt.Errorf("key %s is outside of prefix %s", s3Key, prefix)
 	}
-	_, err := a.uploader.DeleteObject(ctx, input)
-	if err != nil {
-		log.Printf("ERROR: Failed to delete %s from S3: %v", s3Key, err)
+	relPath := strings.TrimPrefix(s3Key, prefix)
+	if a.keys != nil {
+		var err error
+		if relPath, err = a.keys.relPath(relPath); err != nil {
+			return "", fmt.Errorf("could not map key %s to a local path: %w", s3Key, err)
+		}
 	}
+	return a.localPathForRel(s3Key, relPath)
 }
 
-// parseS3Path parses an S3 path string (e.g., "s3://bucket/key/prefix")
-// into a bucket and a key prefix.
-func parseS3Path(s3Path string) (bucket, keyPrefix string, err error) {
-	if !strings.HasPrefix(s3Path, "s3://") {
-		return "", "", errors.New("S3 path must start with s3://")
+// localPathForRel returns the local path of a slash separated path relative
+// to the watched directory, which the object s3Key was uploaded from.
+func (a *App) localPathForRel(s3Key, relPath string) (string, error) {
+	localFile := filepath.Join(a.localPath, filepath.FromSlash(relPath))
+	// Refuse keys such as "prefix/../../etc/passwd" that escape the local path.
+	if rel, err := filepath.Rel(a.localPath, localFile); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %s maps outside of %s", s3Key, a.localPath)
 	}
-	trimmed := strings.TrimPrefix(s3Path, "s3://")
-	parts := strings.SplitN(trimmed, "/", 2)
-	if len(parts) == 0 || parts[0] == "" {
-		return "", "", errors.New("invalid S3 path format: missing bucket name")
+	return localFile, nil
+}
+
+// handleUpload queues a file for upload to S3 using the worker pool.
+func (a *App) handleUpload(ctx context.Context, localFile, s3Key string) {
+	// Hold files back until they are complete, if a strategy is configured.
+	if a.completion != nil {
+		a.completion.offer(localFile)
+		return
 	}
+	// Queue the upload job to be processed by the worker pool
+	a.workerPool.QueueUpload(localFile, s3Key)
+}
 
-	bucket = parts[0]
-	if len(parts) > 1 {
-		keyPrefix = parts[1]
+// handleRemove deletes a single object from S3 if the --delete flag is set.
+func (a *App) handleRemove(ctx context.Context, s3Key string) {
+	if !a.delete {
+		slog.Info("File removed locally but --delete is not set. Ignoring", "bucket", a.bucket, "key", s3Key)
+		return
 	}
 
-	return bucket, keyPrefix, nil
+	// Deletes run inline, but are tracked, logged, counted and reported like
+	// the pool's own jobs.
+	a.workerPool.runNow(ctx, UploadJob{op: opDelete, s3Key: s3Key})
 }
@@ -2,18 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/fsnotify/fsnotify"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -55,35 +66,303 @@ func TestMain(m *testing.M) {
 
 // MockS3Uploader is a mock implementation of the S3Uploader interface for testing.
 type MockS3Uploader struct {
-	Uploads   map[string]*s3.PutObjectInput
-	Deletes   map[string]*s3.DeleteObjectInput
+	mu      sync.Mutex
+	Uploads map[string]*s3.PutObjectInput
+	Deletes map[string]*s3.DeleteObjectInput
+	Objects []types.Object
+	Bodies  map[string]string
+	// Versions, DeleteMarkers and VersionBodies, keyed by version ID, make
+	// up the version history of a versioned bucket.
+	Versions      []types.ObjectVersion
+	DeleteMarkers []types.DeleteMarkerEntry
+	VersionBodies map[string]string
+	// Archived objects can only be read once a restore has been requested
+	// and seen in progress by one HeadObject.
+	Archived  map[string]bool
+	Restores  map[string]*s3.RestoreObjectInput
+	Copies    map[string]*s3.CopyObjectInput
 	UploadErr error
 	DeleteErr error
+	ListErr   error
+	GetErr    error
+	// BucketRegion is returned by HeadBucket, which fails with HeadBucketErr
+	// if set.
+	BucketRegion  string
+	HeadBucketErr error
 }
 
 func newMockS3Uploader() *MockS3Uploader {
 	return &MockS3Uploader{
 		Uploads: make(map[string]*s3.PutObjectInput),
 		Deletes: make(map[string]*s3.DeleteObjectInput),
+		Bodies:  make(map[string]string),
+
+		VersionBodies: make(map[string]string),
+		Archived:      make(map[string]bool),
+		Restores:      make(map[string]*s3.RestoreObjectInput),
+		Copies:        make(map[string]*s3.CopyObjectInput),
 	}
 }
 
 func (m *MockS3Uploader) Upload(_ context.Context, input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.UploadErr != nil {
 		return nil, m.UploadErr
 	}
+	if err := m.checkPreconditions(input); err != nil {
+		return nil, err
+	}
 	m.Uploads[*input.Key] = input
-	return &s3.PutObjectOutput{}, nil
+
+	// Store the body so the object can be listed and downloaded again.
+	var body []byte
+	if input.Body != nil {
+		var err error
+		if body, err = io.ReadAll(input.Body); err != nil {
+			return nil, err
+		}
+	}
+	sum := md5.Sum(body)
+	if input.ContentMD5 != nil && *input.ContentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, &smithy.GenericAPIError{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what we received."}
+	}
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	var checksum *string
+	if input.ChecksumAlgorithm == types.ChecksumAlgorithmSha256 {
+		sha := sha256.Sum256(body)
+		checksum = aws.String(base64.StdEncoding.EncodeToString(sha[:]))
+	}
+	var algorithms []types.ChecksumAlgorithm
+	if checksum != nil {
+		algorithms = append(algorithms, types.ChecksumAlgorithmSha256)
+	}
+	m.removeObject(*input.Key)
+	m.Objects = append(m.Objects, types.Object{
+		Key:               input.Key,
+		Size:              aws.Int64(int64(len(body))),
+		ETag:              aws.String(etag),
+		LastModified:      aws.Time(time.Now()),
+		ChecksumAlgorithm: algorithms,
+	})
+	m.Bodies[*input.Key] = string(body)
+	return &s3.PutObjectOutput{ETag: aws.String(etag), ChecksumSHA256: checksum}, nil
 }
 
 func (m *MockS3Uploader) DeleteObject(_ context.Context, input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.DeleteErr != nil {
 		return nil, m.DeleteErr
 	}
 	m.Deletes[*input.Key] = input
+	m.removeObject(*input.Key)
 	return &s3.DeleteObjectOutput{}, nil
 }
 
+// checkPreconditions applies If-Match and If-None-Match like S3 does. The
+// caller must hold m.mu.
+func (m *MockS3Uploader) checkPreconditions(input *s3.PutObjectInput) error {
+	var current *string
+	for _, obj := range m.Objects {
+		if *obj.Key == *input.Key {
+			current = obj.ETag
+		}
+	}
+	failed := &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	if aws.ToString(input.IfNoneMatch) == "*" && current != nil {
+		return failed
+	}
+	if input.IfMatch != nil && (current == nil || *current != *input.IfMatch) {
+		return failed
+	}
+	return nil
+}
+
+// removeObject drops a stored object. The caller must hold m.mu.
+func (m *MockS3Uploader) removeObject(key string) {
+	for i, obj := range m.Objects {
+		if *obj.Key == key {
+			m.Objects = append(m.Objects[:i], m.Objects[i+1:]...)
+			break
+		}
+	}
+	delete(m.Bodies, key)
+}
+
+func (m *MockS3Uploader) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ListErr != nil {
+		return nil, m.ListErr
+	}
+	output := &s3.ListObjectsV2Output{}
+	for _, obj := range m.Objects {
+		if strings.HasPrefix(*obj.Key, *input.Prefix) {
+			output.Contents = append(output.Contents, obj)
+		}
+	}
+	return output, nil
+}
+
+func (m *MockS3Uploader) GetObject(_ context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.GetErr != nil {
+		return nil, m.GetErr
+	}
+	if m.Archived[*input.Key] {
+		return nil, &types.InvalidObjectState{}
+	}
+	if input.VersionId != nil {
+		body, ok := m.VersionBodies[*input.VersionId]
+		if !ok {
+			return nil, &types.NoSuchKey{}
+		}
+		output := &s3.GetObjectOutput{
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: aws.Int64(int64(len(body))),
+			VersionId:     input.VersionId,
+		}
+		for _, v := range m.Versions {
+			if *v.VersionId == *input.VersionId {
+				output.LastModified = v.LastModified
+				output.ETag = v.ETag
+			}
+		}
+		return output, nil
+	}
+	body, ok := m.Bodies[*input.Key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	output := &s3.GetObjectOutput{
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+	}
+	if upload, ok := m.Uploads[*input.Key]; ok {
+		output.Metadata = upload.Metadata
+	}
+	for _, obj := range m.Objects {
+		if *obj.Key == *input.Key {
+			output.LastModified = obj.LastModified
+			output.ETag = obj.ETag
+		}
+	}
+	return output, nil
+}
+
+func (m *MockS3Uploader) HeadObject(_ context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if input.VersionId != nil {
+		for _, v := range m.Versions {
+			if *v.Key == *input.Key && *v.VersionId == *input.VersionId {
+				return &s3.HeadObjectOutput{ContentLength: v.Size, ETag: v.ETag, LastModified: v.LastModified, VersionId: v.VersionId}, nil
+			}
+		}
+		return nil, &types.NotFound{}
+	}
+	for _, obj := range m.Objects {
+		if *obj.Key != *input.Key {
+			continue
+		}
+		output := &s3.HeadObjectOutput{
+			ContentLength: obj.Size,
+			ETag:          obj.ETag,
+			LastModified:  obj.LastModified,
+			StorageClass:  types.StorageClass(obj.StorageClass),
+		}
+		if upload, ok := m.Uploads[*obj.Key]; ok {
+			output.Metadata = upload.Metadata
+		}
+		if _, ok := m.Restores[*obj.Key]; ok {
+			// The first check sees the restore in progress, later ones done.
+			if m.Archived[*obj.Key] {
+				output.Restore = aws.String(`ongoing-request="true"`)
+				delete(m.Archived, *obj.Key)
+			} else {
+				output.Restore = aws.String(`ongoing-request="false", expiry-date="Fri, 23 Dec 2026 00:00:00 GMT"`)
+			}
+		}
+		// Like S3, only return the checksum stored at upload when asked to.
+		if input.ChecksumMode == types.ChecksumModeEnabled && slices.Contains(obj.ChecksumAlgorithm, types.ChecksumAlgorithmSha256) {
+			sum := sha256.Sum256([]byte(m.Bodies[*obj.Key]))
+			output.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		return output, nil
+	}
+	return nil, &types.NotFound{}
+}
+
+func (m *MockS3Uploader) ListObjectVersions(_ context.Context, input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ListErr != nil {
+		return nil, m.ListErr
+	}
+	output := &s3.ListObjectVersionsOutput{}
+	for _, v := range m.Versions {
+		if strings.HasPrefix(*v.Key, *input.Prefix) {
+			output.Versions = append(output.Versions, v)
+		}
+	}
+	for _, marker := range m.DeleteMarkers {
+		if strings.HasPrefix(*marker.Key, *input.Prefix) {
+			output.DeleteMarkers = append(output.DeleteMarkers, marker)
+		}
+	}
+	return output, nil
+}
+
+func (m *MockS3Uploader) RestoreObject(_ context.Context, input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.Restores[*input.Key]; ok {
+		return nil, &smithy.GenericAPIError{Code: "RestoreAlreadyInProgress", Message: "Object restore is already in progress"}
+	}
+	m.Restores[*input.Key] = input
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (m *MockS3Uploader) HeadBucket(_ context.Context, input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.HeadBucketErr != nil {
+		return nil, m.HeadBucketErr
+	}
+	output := &s3.HeadBucketOutput{}
+	if m.BucketRegion != "" {
+		output.BucketRegion = aws.String(m.BucketRegion)
+	}
+	return output, nil
+}
+
+func (m *MockS3Uploader) CopyObject(_ context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	source, err := url.PathUnescape(strings.TrimPrefix(*input.CopySource, *input.Bucket+"/"))
+	if err != nil {
+		return nil, err
+	}
+	body, ok := m.Bodies[source]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	m.Copies[*input.Key] = input
+	m.removeObject(*input.Key)
+	for _, obj := range m.Objects {
+		if *obj.Key == source {
+			obj.Key = input.Key
+			obj.LastModified = aws.Time(time.Now())
+			m.Objects = append(m.Objects, obj)
+			break
+		}
+	}
+	m.Bodies[*input.Key] = body
+	return &s3.CopyObjectOutput{}, nil
+}
+
 // newTestApp is a helper to set up the App struct for testing.
 func newTestApp(t *testing.T, deleteFlag bool, isDir bool) (*App, *MockS3Uploader, string) {
 	t.Helper()
@@ -100,10 +379,10 @@ func newTestApp(t *testing.T, deleteFlag bool, isDir bool) (*App, *MockS3Uploade
 		storageClass:  types.StorageClassStandard,
 		maxConcurrent: 2, // Use a small value for testing
 	}
-	
+
 	// Initialize the worker pool for testing
 	app.workerPool = NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 2)
-	
+
 	return app, mockUploader, tmpDir
 }
 
@@ -157,7 +436,7 @@ func TestApp_handleEvent(t *testing.T) {
 
 			event := fsnotify.Event{Name: testFile, Op: fsnotify.Create}
 			app.handleEvent(context.Background(), event, watcher)
-			
+
 			// Wait for worker pool to process the upload
 			app.workerPool.Shutdown()
 
@@ -187,7 +466,7 @@ func TestApp_handleEvent(t *testing.T) {
 
 			event := fsnotify.Event{Name: watchedFile, Op: fsnotify.Write}
 			app.handleEvent(context.Background(), event, watcher)
-			
+
 			// Wait for worker pool to process the upload
 			app.workerPool.Shutdown()
 
@@ -204,7 +483,7 @@ func TestApp_handleEvent(t *testing.T) {
 
 			event := fsnotify.Event{Name: otherFile, Op: fsnotify.Write}
 			app.handleEvent(context.Background(), event, watcher)
-			
+
 			// Wait for worker pool to process any potential uploads
 			app.workerPool.Shutdown()
 
@@ -232,10 +511,10 @@ func TestApp_handleUpload_Errors(t *testing.T) {
 
 		// Queue the upload
 		app.handleUpload(context.Background(), nonExistentFile, "test-prefix/ghost.txt")
-		
+
 		// Wait for worker pool to process the job
 		app.workerPool.Shutdown()
-		
+
 		assert.Empty(t, mockUploader.Uploads, "Upload should not be attempted if file doesn't exist")
 	})
 
@@ -247,10 +526,10 @@ func TestApp_handleUpload_Errors(t *testing.T) {
 
 		// Queue the upload
 		app.handleUpload(context.Background(), testFile, "test-prefix/upload-fail.txt")
-		
+
 		// Wait for worker pool to process the job
 		app.workerPool.Shutdown()
-		
+
 		assert.Empty(t, mockUploader.Uploads)
 	})
 }
@@ -262,6 +541,19 @@ func TestApp_handleRemove_Errors(t *testing.T) {
 
 		app.handleRemove(context.Background(), "test-prefix/delete-fail.txt")
 		assert.Empty(t, mockUploader.Deletes)
+		assert.Equal(t, int64(1), app.workerPool.Stats().Failed, "Failed deletes are counted like the pool's own jobs")
+		assert.Equal(t, int64(1), app.workerPool.consecutiveFailures.Load(), "Failed deletes count towards readiness")
+
+		jobs := app.workerPool.Jobs()
+		require.Len(t, jobs, 1, "Failed deletes are kept for retrying")
+		assert.Equal(t, JobInfo{ID: jobs[0].ID, Op: "delete", Key: "test-prefix/delete-fail.txt", State: jobFailed, Since: jobs[0].Since, Error: "S3 is down"}, jobs[0])
+
+		mockUploader.DeleteErr = nil
+		n, err := app.workerPool.RetryFailed()
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		app.workerPool.Shutdown()
+		assert.Contains(t, mockUploader.Deletes, "test-prefix/delete-fail.txt")
 	})
 }
 
@@ -356,45 +648,45 @@ func TestParseFlags(t *testing.T) {
 	defer func() { os.Args = oldArgs }()
 
 	testCases := []struct {
-		name           string
-		args           []string
-		expectVersion  bool
-		expectDelete   bool
+		name               string
+		args               []string
+		expectVersion      bool
+		expectDelete       bool
 		expectStorageClass string
 	}{
 		{
-			name:           "Default flags",
-			args:           []string{"echos3", "local/path", "s3://bucket/key"},
-			expectVersion:  false,
-			expectDelete:   false,
+			name:               "Default flags",
+			args:               []string{"echos3", "local/path", "s3://bucket/key"},
+			expectVersion:      false,
+			expectDelete:       false,
 			expectStorageClass: string(types.StorageClassIntelligentTiering),
 		},
 		{
-			name:           "Version flag",
-			args:           []string{"echos3", "--version"},
-			expectVersion:  true,
-			expectDelete:   false,
+			name:               "Version flag",
+			args:               []string{"echos3", "--version"},
+			expectVersion:      true,
+			expectDelete:       false,
 			expectStorageClass: string(types.StorageClassIntelligentTiering),
 		},
 		{
-			name:           "Delete flag",
-			args:           []string{"echos3", "--delete", "local/path", "s3://bucket/key"},
-			expectVersion:  false,
-			expectDelete:   true,
+			name:               "Delete flag",
+			args:               []string{"echos3", "--delete", "local/path", "s3://bucket/key"},
+			expectVersion:      false,
+			expectDelete:       true,
 			expectStorageClass: string(types.StorageClassIntelligentTiering),
 		},
 		{
-			name:           "Storage class flag",
-			args:           []string{"echos3", "--storage-class", "GLACIER", "local/path", "s3://bucket/key"},
-			expectVersion:  false,
-			expectDelete:   false,
+			name:               "Storage class flag",
+			args:               []string{"echos3", "--storage-class", "GLACIER", "local/path", "s3://bucket/key"},
+			expectVersion:      false,
+			expectDelete:       false,
 			expectStorageClass: "GLACIER",
 		},
 		{
-			name:           "All flags",
-			args:           []string{"echos3", "--version", "--delete", "--storage-class", "STANDARD", "local/path", "s3://bucket/key"},
-			expectVersion:  true,
-			expectDelete:   true,
+			name:               "All flags",
+			args:               []string{"echos3", "--version", "--delete", "--storage-class", "STANDARD", "local/path", "s3://bucket/key"},
+			expectVersion:      true,
+			expectDelete:       true,
 			expectStorageClass: "STANDARD",
 		},
 	}
@@ -403,24 +695,24 @@ func TestParseFlags(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			// Reset flags for each test case
 			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-			
+
 			// Set up test arguments
 			os.Args = tc.args
-			
+
 			// Call the function
 			showVersion, config, args, err := parseFlags()
-			
+
 			// Check results
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectVersion, showVersion)
 			assert.Equal(t, tc.expectDelete, config.Delete)
 			assert.Equal(t, types.StorageClass(tc.expectStorageClass), config.StorageClass)
-			
+
 			// Check that args contains the non-flag arguments
 			expectedArgs := []string{}
 			for _, arg := range tc.args[1:] {
 				if !strings.HasPrefix(arg, "--") &&
-				   arg != "GLACIER" && arg != "STANDARD" { // Skip flag values
+					arg != "GLACIER" && arg != "STANDARD" { // Skip flag values
 					expectedArgs = append(expectedArgs, arg)
 				}
 			}
@@ -429,6 +721,18 @@ func TestParseFlags(t *testing.T) {
 	}
 }
 
+func TestParseFlags_InvalidDirection(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	os.Args = []string{"echos3", "--direction", "sideways", "local/path", "s3://bucket/key"}
+
+	_, _, _, err := parseFlags()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid direction")
+}
+
 func TestValidateArgs(t *testing.T) {
 	testCases := []struct {
 		name        string
@@ -470,7 +774,7 @@ func TestValidateArgs(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			localPath, s3Path, err := validateArgs(tc.args)
-			
+
 			if tc.expectErr {
 				assert.Error(t, err)
 			} else {
@@ -486,41 +790,41 @@ func TestSetupLocalPath(t *testing.T) {
 	t.Run("Valid path", func(t *testing.T) {
 		// Create a temporary directory for testing
 		tmpDir := t.TempDir()
-		
+
 		// Call the function
 		path, info, err := setupLocalPath(tmpDir)
-		
+
 		// Check results
 		assert.NoError(t, err)
 		assert.True(t, info.IsDir())
-		
+
 		// The path should be absolute
 		absPath, _ := filepath.Abs(tmpDir)
 		assert.Equal(t, absPath, path)
 	})
-	
+
 	t.Run("Valid file", func(t *testing.T) {
 		// Create a temporary file for testing
 		tmpFile, err := os.CreateTemp("", "test-file")
 		require.NoError(t, err)
 		defer os.Remove(tmpFile.Name())
-		
+
 		// Call the function
 		path, info, err := setupLocalPath(tmpFile.Name())
-		
+
 		// Check results
 		assert.NoError(t, err)
 		assert.False(t, info.IsDir())
-		
+
 		// The path should be absolute
 		absPath, _ := filepath.Abs(tmpFile.Name())
 		assert.Equal(t, absPath, path)
 	})
-	
+
 	t.Run("Non-existent path", func(t *testing.T) {
 		// Call the function with a non-existent path
 		_, _, err := setupLocalPath("/path/that/does/not/exist")
-		
+
 		// Check results
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "could not access path")
@@ -533,12 +837,12 @@ func TestCreateApp(t *testing.T) {
 	defer func() {
 		newS3Client = originalNewS3Client
 	}()
-	
+
 	// Set up a mock S3 client creator that returns a valid client
 	newS3Client = func(ctx context.Context) (*S3Client, error) {
 		return &S3Client{client: nil}, nil
 	}
-	
+
 	config := &AppConfig{
 		LocalPath:    "/test/path",
 		Bucket:       "test-bucket",
@@ -546,10 +850,10 @@ func TestCreateApp(t *testing.T) {
 		Delete:       true,
 		StorageClass: types.StorageClassStandard,
 	}
-	
+
 	t.Run("Create app with directory", func(t *testing.T) {
 		app, err := createApp(context.Background(), config, "/test/path", true)
-		
+
 		assert.NoError(t, err)
 		assert.NotNil(t, app)
 		assert.Equal(t, "/test/path", app.localPath)
@@ -559,24 +863,33 @@ func TestCreateApp(t *testing.T) {
 		assert.True(t, app.delete)
 		assert.Equal(t, types.StorageClassStandard, app.storageClass)
 	})
-	
+
 	t.Run("Create app with file", func(t *testing.T) {
 		app, err := createApp(context.Background(), config, "/test/path/file.txt", false)
-		
+
 		assert.NoError(t, err)
 		assert.NotNil(t, app)
 		assert.Equal(t, "/test/path/file.txt", app.localPath)
 		assert.False(t, app.isDir)
 	})
-	
+
+	t.Run("Create app with dry run", func(t *testing.T) {
+		dryRunConfig := *config
+		dryRunConfig.DryRun = true
+		app, err := createApp(context.Background(), &dryRunConfig, "/test/path", true)
+
+		assert.NoError(t, err)
+		assert.IsType(t, &DryRunUploader{}, app.uploader)
+	})
+
 	t.Run("S3 client creation failure", func(t *testing.T) {
 		// Make newS3Client return an error
 		newS3Client = func(ctx context.Context) (*S3Client, error) {
 			return nil, errors.New("failed to create S3 client")
 		}
-		
+
 		_, err := createApp(context.Background(), config, "/test/path", true)
-		
+
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "failed to create S3 client")
 	})
@@ -585,73 +898,73 @@ func TestCreateApp(t *testing.T) {
 func TestMainFlow(t *testing.T) {
 	// This test simulates the flow of the main function by calling the extracted functions
 	// in sequence, allowing us to test the main function's logic without directly testing main()
-	
+
 	// Save the original S3 client creator and restore it after the test
 	originalNewS3Client := newS3Client
-	defer func() { 
-		newS3Client = originalNewS3Client 
+	defer func() {
+		newS3Client = originalNewS3Client
 	}()
-	
+
 	// Create a mock S3 client creator
 	newS3Client = func(ctx context.Context) (*S3Client, error) {
 		return &S3Client{client: nil}, nil
 	}
-	
+
 	// Create a temporary directory and file for testing
 	tmpDir := t.TempDir()
 	testFile := filepath.Join(tmpDir, "test.txt")
 	require.NoError(t, os.WriteFile(testFile, []byte("test content"), 0644))
-	
+
 	// Save original command line arguments and restore them after the test
 	oldArgs := os.Args
 	defer func() { os.Args = oldArgs }()
-	
+
 	// Set up test arguments
-	os.Args = []string{"echos3", "--storage-class", "STANDARD", testFile, "s3://test-bucket/test-prefix"}
-	
+	os.Args = []string{"echos3", "--storage-class", "STANDARD", "--skip-preflight", testFile, "s3://test-bucket/test-prefix"}
+
 	// Reset flags for the test
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	
+
 	// Step 1: Parse flags
 	showVersion, config, args, err := parseFlags()
 	require.NoError(t, err)
 	assert.False(t, showVersion)
 	assert.Equal(t, types.StorageClassStandard, config.StorageClass)
-	
+
 	// Step 2: Validate arguments
 	localPathArg, s3Path, err := validateArgs(args)
 	require.NoError(t, err)
 	assert.Equal(t, testFile, localPathArg)
 	assert.Equal(t, "s3://test-bucket/test-prefix", s3Path)
-	
+
 	// Step 3: Setup local path
 	localPath, pathInfo, err := setupLocalPath(localPathArg)
 	require.NoError(t, err)
 	assert.False(t, pathInfo.IsDir())
-	
+
 	// Step 4: Parse S3 path
 	bucket, keyPrefix, err := parseS3Path(s3Path)
 	require.NoError(t, err)
 	assert.Equal(t, "test-bucket", bucket)
 	assert.Equal(t, "test-prefix", keyPrefix)
-	
+
 	// Update config with parsed values
 	config.Bucket = bucket
 	config.KeyPrefix = keyPrefix
 	config.LocalPath = localPath
-	
+
 	// Step 5: Create app
 	ctx := context.Background()
 	app, err := createApp(ctx, config, localPath, pathInfo.IsDir())
 	require.NoError(t, err)
-	
+
 	// Verify app configuration
 	assert.Equal(t, localPath, app.localPath)
 	assert.Equal(t, "test-bucket", app.bucket)
 	assert.Equal(t, "test-prefix", app.keyPrefix)
 	assert.Equal(t, types.StorageClassStandard, app.storageClass)
 	assert.False(t, app.isDir)
-	
+
 	// We don't call app.run() as it would start a long-running process
 	// Instead, we've verified that all the setup steps work correctly
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// manifestSignatureMetadata is the user metadata key that carries the
+// signature of an uploaded manifest, as x-amz-meta-echos3-signature.
+const manifestSignatureMetadata = "echos3-signature"
+
+// ManifestConfig configures the signed manifest of the mirrored state.
+type ManifestConfig struct {
+	Key      string        // Object key the manifest is uploaded to, disabled if empty
+	Interval time.Duration // Time between manifests while watching
+	Secret   string        // Key used to sign manifests with HMAC-SHA256
+}
+
+// mirrorManifest lists the objects under the mirrored prefix.
+type mirrorManifest struct {
+	Bucket      string           `json:"bucket"`
+	Prefix      string           `json:"prefix"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	Objects     []manifestObject `json:"objects"`
+}
+
+// manifestObject describes an object in a manifest. The checksum is only
+// known for objects uploaded by this echos3 process.
+type manifestObject struct {
+	Key            string    `json:"key"`
+	Size           int64     `json:"size"`
+	ETag           string    `json:"etag"`
+	LastModified   time.Time `json:"last_modified"`
+	ChecksumSHA256 string    `json:"checksum_sha256,omitempty"`
+}
+
+// checksumIndex is an EventSink that remembers the SHA-256 checksum S3
+// computed for each object uploaded, for the manifest.
+type checksumIndex struct {
+	mu        sync.Mutex
+	checksums map[string]string
+}
+
+func newChecksumIndex() *checksumIndex {
+	return &checksumIndex{checksums: make(map[string]string)}
+}
+
+// Publish records the checksum of an uploaded object, or forgets the checksum
+// of a deleted one.
+func (c *checksumIndex) Publish(event Event) {
+	if event.Status != eventSuccess {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case event.Op == opUpload.String() && event.Checksum != "":
+		c.checksums[event.Key] = event.Checksum
+	case event.Op == opUpload.String(), event.Op == opDelete.String():
+		delete(c.checksums, event.Key)
+	}
+}
+
+func (c *checksumIndex) Close() error { return nil }
+
+// get returns the checksum of an object, if this process uploaded it.
+func (c *checksumIndex) get(key string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checksums[key]
+}
+
+// checkManifest validates the manifest configuration for the mirrored prefix,
+// which is the key of the watched file unless isDir.
+func checkManifest(config ManifestConfig, remotePrefix string, isDir bool) error {
+	if config.Secret == "" {
+		return errors.New("--manifest-key requires --manifest-secret or ECHOS3_MANIFEST_SECRET")
+	}
+	if isDir && strings.HasPrefix(config.Key, remotePrefix) {
+		return fmt.Errorf("manifest key %s must be outside the mirrored prefix %s", config.Key, remotePrefix)
+	}
+	if !isDir && config.Key == remotePrefix {
+		return fmt.Errorf("manifest key %s must not be the key of the watched file", config.Key)
+	}
+	return nil
+}
+
+// publishManifest uploads a signed manifest of the objects under the
+// mirrored prefix.
+func (a *App) publishManifest(ctx context.Context) error {
+	remote, err := a.listRemote(ctx)
+	if err != nil {
+		return err
+	}
+
+	manifest := mirrorManifest{
+		Bucket:      a.bucket,
+		Prefix:      a.remotePrefix(),
+		GeneratedAt: time.Now().UTC(),
+		Objects:     make([]manifestObject, 0, len(remote)),
+	}
+	for key, obj := range remote {
+		manifest.Objects = append(manifest.Objects, manifestObject{
+			Key:            key,
+			Size:           aws.ToInt64(obj.Size),
+			ETag:           aws.ToString(obj.ETag),
+			LastModified:   aws.ToTime(obj.LastModified).UTC(),
+			ChecksumSHA256: a.checksums.get(key),
+		})
+	}
+	sort.Slice(manifest.Objects, func(i, j int) bool { return manifest.Objects[i].Key < manifest.Objects[j].Key })
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %w", err)
+	}
+	body = append(body, '\n')
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(a.bucket),
+		Key:         aws.String(a.manifest.Key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{manifestSignatureMetadata: signHMAC(a.manifest.Secret, body)},
+	}
+	if _, err := a.uploader.Upload(ctx, input); err != nil {
+		return fmt.Errorf("could not upload manifest to s3://%s/%s: %w", a.bucket, a.manifest.Key, err)
+	}
+	slog.Info("Published manifest", "bucket", a.bucket, "key", a.manifest.Key, "objects", len(manifest.Objects))
+	return nil
+}
+
+// publishManifests publishes a manifest right away, then every interval until
+// ctx is done.
+func (a *App) publishManifests(ctx context.Context) {
+	ticker := time.NewTicker(a.manifest.Interval)
+	defer ticker.Stop()
+	for {
+		if err := a.publishManifest(ctx); err != nil {
+			slog.Error("Could not publish manifest", "bucket", a.bucket, "key", a.manifest.Key, "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
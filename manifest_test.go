@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckManifest(t *testing.T) {
+	assert.NoError(t, checkManifest(ManifestConfig{Key: "manifests/photos.json", Secret: "s"}, "photos/", true))
+	assert.ErrorContains(t, checkManifest(ManifestConfig{Key: "manifests/photos.json"}, "photos/", true), "requires --manifest-secret")
+	assert.ErrorContains(t, checkManifest(ManifestConfig{Key: "photos/manifest.json", Secret: "s"}, "photos/", true), "outside the mirrored prefix")
+	assert.ErrorContains(t, checkManifest(ManifestConfig{Key: "manifest.json", Secret: "s"}, "", true), "outside the mirrored prefix")
+	assert.NoError(t, checkManifest(ManifestConfig{Key: "reports/report.csv.manifest", Secret: "s"}, "reports/report.csv", false), "Manifests may sit next to a watched file")
+	assert.ErrorContains(t, checkManifest(ManifestConfig{Key: "reports/report.csv", Secret: "s"}, "reports/report.csv", false), "must not be the key of the watched file")
+}
+
+func TestPublishManifest(t *testing.T) {
+	app, mockUploader, tmpDir := newTestApp(t, true, true)
+	app.manifest = ManifestConfig{Key: "manifests/test.json", Secret: "secret"}
+	app.checksums = newChecksumIndex()
+	app.workerPool.AddEventSink(app.checksums)
+	app.workerPool.EnableChecksums()
+
+	putRemote(t, mockUploader, "test-prefix/old.txt", "uploaded elsewhere")
+	localFile := filepath.Join(tmpDir, "new.txt")
+	writeLocal(t, localFile, "uploaded here")
+	uploadNow(t, app.workerPool, localFile, "test-prefix/new.txt")
+
+	require.NoError(t, app.publishManifest(context.Background()))
+	input := mockUploader.Uploads["manifests/test.json"]
+	require.NotNil(t, input)
+	body := []byte(mockUploader.Bodies["manifests/test.json"])
+	assert.Equal(t, signHMAC("secret", body), input.Metadata[manifestSignatureMetadata])
+
+	var manifest mirrorManifest
+	require.NoError(t, json.Unmarshal(body, &manifest))
+	assert.Equal(t, "test-bucket", manifest.Bucket)
+	assert.Equal(t, "test-prefix/", manifest.Prefix)
+	assert.WithinDuration(t, time.Now(), manifest.GeneratedAt, time.Minute)
+	require.Len(t, manifest.Objects, 2)
+
+	sum := sha256.Sum256([]byte("uploaded here"))
+	assert.Equal(t, "test-prefix/new.txt", manifest.Objects[0].Key)
+	assert.Equal(t, int64(len("uploaded here")), manifest.Objects[0].Size)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), manifest.Objects[0].ChecksumSHA256)
+	assert.NotEmpty(t, manifest.Objects[0].ETag)
+	assert.Equal(t, "test-prefix/old.txt", manifest.Objects[1].Key)
+	assert.Empty(t, manifest.Objects[1].ChecksumSHA256, "Checksums are only known for objects uploaded by echos3")
+
+	app.handleRemove(context.Background(), "test-prefix/new.txt")
+	assert.Empty(t, app.checksums.get("test-prefix/new.txt"), "Deleted objects are forgotten")
+}
+
+func TestPublishManifests(t *testing.T) {
+	app, mockUploader, _ := newTestApp(t, false, true)
+	app.manifest = ManifestConfig{Key: "manifests/test.json", Secret: "secret", Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		app.publishManifests(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		mockUploader.mu.Lock()
+		defer mockUploader.mu.Unlock()
+		return mockUploader.Uploads["manifests/test.json"] != nil
+	}, 5*time.Second, 10*time.Millisecond, "The first manifest does not wait for the interval")
+	cancel()
+	<-done
+}
+
+func TestParseFlags_Manifest(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	t.Setenv("ECHOS3_MANIFEST_SECRET", "from-env")
+
+	parse := func(args ...string) (*AppConfig, error) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		os.Args = append(append([]string{"echos3"}, args...), "local/path", "s3://bucket/key")
+		_, config, _, err := parseFlags()
+		return config, err
+	}
+
+	config, err := parse("--manifest-key", "manifests/key.json", "--audit-log", "/var/log/echos3.audit")
+	require.NoError(t, err)
+	assert.Equal(t, ManifestConfig{Key: "manifests/key.json", Interval: time.Hour, Secret: "from-env"}, config.Manifest)
+	assert.Equal(t, "/var/log/echos3.audit", config.AuditLog)
+
+	_, err = parse("--manifest-key", "manifests/key.json", "--direction", "pull")
+	assert.ErrorContains(t, err, "requires --direction push")
+	_, err = parse("--manifest-interval", "0s")
+	assert.ErrorContains(t, err, "invalid manifest interval")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/aws/smithy-go"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// jobOpNames are the values of the "op" label for worker pool jobs.
+var jobOpNames = map[jobOp]string{
+	opUpload:   "upload",
+	opDelete:   "delete",
+	opDownload: "download",
+}
+
+// String returns the name of the operation.
+func (op jobOp) String() string {
+	if name, ok := jobOpNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("jobOp(%d)", int(op))
+}
+
+// metrics holds the Prometheus collectors exported on --metrics-addr. All
+// methods are safe to call on a nil *metrics, which disables collection.
+type metrics struct {
+	eventsReceived     *prometheus.CounterVec
+	operations         *prometheus.CounterVec
+	bytesUploaded      prometheus.Counter
+	uploadDuration     prometheus.Histogram
+	activeWorkers      prometheus.Gauge
+	watchedDirectories prometheus.Counter
+}
+
+// newMetrics creates the collectors and registers them, along with a gauge
+// reporting the depth of the pool's job queue.
+func newMetrics(reg prometheus.Registerer, pool *UploadWorkerPool) *metrics {
+	m := &metrics{
+		eventsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "echos3_fs_events_total",
+			Help: "File system events received, by operation.",
+		}, []string{"op"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "echos3_operations_total",
+			Help: "S3 operations processed by the worker pool, by operation, result and error class.",
+		}, []string{"op", "result", "error_class"}),
+		bytesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "echos3_uploaded_bytes_total",
+			Help: "Bytes successfully uploaded to S3.",
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "echos3_upload_duration_seconds",
+			Help:    "Time taken to upload a file to S3.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 15), // 10ms to ~2.7m
+		}),
+		activeWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "echos3_active_workers",
+			Help: "Workers currently processing a job.",
+		}),
+		watchedDirectories: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "echos3_watched_directories_total",
+			Help: "Directories registered with the file watcher, including ones since removed.",
+		}),
+	}
+
+	reg.MustRegister(
+		m.eventsReceived,
+		m.operations,
+		m.bytesUploaded,
+		m.uploadDuration,
+		m.activeWorkers,
+		m.watchedDirectories,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "echos3_queue_depth",
+			Help: "Jobs waiting in the worker pool queue.",
+		}, func() float64 { return float64(len(pool.jobQueue)) }),
+	)
+	return m
+}
+
+// observeEvent counts a file system event once per operation it carries.
+func (m *metrics) observeEvent(event fsnotify.Event) {
+	if m == nil {
+		return
+	}
+	for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod} {
+		if event.Has(op) {
+			m.eventsReceived.WithLabelValues(op.String()).Inc()
+		}
+	}
+}
+
+// observeJob records the outcome of a worker pool job.
+func (m *metrics) observeJob(result JobResult) {
+	if m == nil {
+		return
+	}
+	if result.Err != nil {
+		m.operations.WithLabelValues(result.Op.String(), "failure", errorClass(result.Err)).Inc()
+		return
+	}
+	m.operations.WithLabelValues(result.Op.String(), "success", "none").Inc()
+	if result.Op == opUpload {
+		m.bytesUploaded.Add(float64(result.Size))
+		m.uploadDuration.Observe(result.Duration.Seconds())
+	}
+}
+
+func (m *metrics) workerStarted() {
+	if m != nil {
+		m.activeWorkers.Inc()
+	}
+}
+
+func (m *metrics) workerFinished() {
+	if m != nil {
+		m.activeWorkers.Dec()
+	}
+}
+
+// directoryWatched counts a directory added to the watcher. Removed
+// directories are not subtracted, as their removal does not tell whether they
+// were watched.
+func (m *metrics) directoryWatched() {
+	if m != nil {
+		m.watchedDirectories.Inc()
+	}
+}
+
+// errorClass groups errors into a small set of label values.
+func errorClass(err error) string {
+	var (
+		apiErr  smithy.APIError
+		netErr  net.Error
+		pathErr *os.PathError
+	)
+	switch {
+	case errors.Is(err, errUploadConflict) || isConditionalConflict(err):
+		return "conflict"
+	case errors.Is(err, errUploadVetoed):
+		return "vetoed"
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.As(err, &apiErr):
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+			return "access_denied"
+		case "NoSuchBucket", "NoSuchKey", "NotFound":
+			return "not_found"
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return "throttled"
+		}
+		if apiErr.ErrorFault() == smithy.FaultServer {
+			return "server"
+		}
+		return "client"
+	case errors.As(err, &pathErr):
+		// Checked before net.Error, which *os.PathError also satisfies.
+		return "local_io"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// metricsHandler serves the registry in the Prometheus exposition format.
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+// enableMetrics registers the app's collectors and returns the handler for
+// /metrics.
+func (a *App) enableMetrics() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	a.metrics = newMetrics(registry, a.workerPool)
+	a.workerPool.metrics = a.metrics
+	return metricsHandler(registry)
+}
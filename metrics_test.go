@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_pool(t *testing.T) {
+	mockUploader := newMockS3Uploader()
+	pool := NewUploadWorkerPool(mockUploader, "test-bucket", types.StorageClassStandard, 1)
+	registry := prometheus.NewRegistry()
+	m := newMetrics(registry, pool)
+	pool.metrics = m
+
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localFile, []byte("12345"), 0644))
+	pool.QueueUpload(localFile, "ok.txt")
+	pool.QueueUpload(filepath.Join(t.TempDir(), "missing.txt"), "missing.txt")
+	pool.Shutdown()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.operations.WithLabelValues("upload", "success", "none")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.operations.WithLabelValues("upload", "failure", "local_io")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(m.bytesUploaded))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.activeWorkers))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.uploadDuration))
+
+	m.observeEvent(fsnotify.Event{Name: localFile, Op: fsnotify.Create | fsnotify.Write})
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.eventsReceived.WithLabelValues("CREATE")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.eventsReceived.WithLabelValues("WRITE")))
+
+	m.directoryWatched()
+	m.directoryWatched()
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.watchedDirectories))
+	count, err := testutil.GatherAndCount(registry, "echos3_watched_directories_total")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestMetrics_nilIsNoop(t *testing.T) {
+	var m *metrics
+	assert.NotPanics(t, func() {
+		m.observeEvent(fsnotify.Event{Op: fsnotify.Create})
+		m.observeJob(JobResult{Op: opUpload})
+		m.workerStarted()
+		m.workerFinished()
+		m.directoryWatched()
+	})
+}
+
+func TestErrorClass(t *testing.T) {
+	_, openErr := os.Open(filepath.Join(t.TempDir(), "missing"))
+
+	testCases := []struct {
+		name   string
+		err    error
+		expect string
+	}{
+		{"Conflict", errUploadConflict, "conflict"},
+		{"Vetoed", fmt.Errorf("%w: exit status 1", errUploadVetoed), "vetoed"},
+		{"Canceled", context.Canceled, "canceled"},
+		{"Access denied", &smithy.GenericAPIError{Code: "AccessDenied"}, "access_denied"},
+		{"Missing bucket", &smithy.GenericAPIError{Code: "NoSuchBucket"}, "not_found"},
+		{"Throttled", &smithy.GenericAPIError{Code: "SlowDown"}, "throttled"},
+		{"Server fault", &smithy.GenericAPIError{Code: "InternalError", Fault: smithy.FaultServer}, "server"},
+		{"Client fault", &smithy.GenericAPIError{Code: "InvalidRequest", Fault: smithy.FaultClient}, "client"},
+		{"Local file", openErr, "local_io"},
+		{"Unknown", errors.New("boom"), "other"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, errorClass(tc.err))
+		})
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	pool := NewUploadWorkerPool(newMockS3Uploader(), "test-bucket", types.StorageClassStandard, 1)
+	defer pool.Shutdown()
+	registry := prometheus.NewRegistry()
+	newMetrics(registry, pool)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(registry))
+	server, err := serveMux("127.0.0.1:0", mux)
+	require.NoError(t, err)
+	defer func() { _ = server.Close() }()
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "echos3_queue_depth 0")
+
+	_, err = serveMux("256.0.0.1:bad", mux)
+	assert.Error(t, err)
+}
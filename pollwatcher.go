@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pollWatcher is the polling backend. It lists the watched directories every
+// interval and compares their entries' modification time, size and identity
+// (inode on Unix) with the previous scan, for filesystems that do not report
+// changes, such as NFS and SMB.
+type pollWatcher struct {
+	interval    time.Duration
+	parallelism int
+	events      chan fsnotify.Event
+	errors      chan error
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+
+	mu         sync.Mutex
+	dirs       map[string]map[string]os.FileInfo // Entries of each watched directory by name
+	discovered map[string]bool                   // Directories created since they were first scanned
+}
+
+// newPollWatcher starts a polling watcher scanning up to parallelism
+// directories at once.
+func newPollWatcher(interval time.Duration, parallelism int) *pollWatcher {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	w := &pollWatcher{
+		interval:    interval,
+		parallelism: max(parallelism, 1),
+		events:      make(chan fsnotify.Event),
+		errors:      make(chan error),
+		done:        make(chan struct{}),
+		dirs:        make(map[string]map[string]os.FileInfo),
+		discovered:  make(map[string]bool),
+	}
+	w.wg.Add(1)
+	go w.loop()
+	return w
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *pollWatcher) Errors() <-chan error          { return w.errors }
+
+// Add starts watching a directory. Only changes made after it was added are
+// reported, except for directories that were created while being watched,
+// whose existing entries are reported as created by the next scan, as they
+// were probably copied in before they could be added.
+func (w *pollWatcher) Add(dir string) error {
+	w.mu.Lock()
+	_, watched := w.dirs[dir]
+	discovered := w.discovered[dir]
+	delete(w.discovered, dir)
+	w.mu.Unlock()
+	if watched {
+		return nil
+	}
+
+	entries := make(map[string]os.FileInfo)
+	if !discovered {
+		var err error
+		if entries, err = readEntries(dir); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	w.dirs[dir] = entries
+	w.mu.Unlock()
+	return nil
+}
+
+// Close stops the watcher.
+func (w *pollWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	w.wg.Wait()
+	return nil
+}
+
+// loop scans the watched directories every interval until the watcher is
+// closed.
+func (w *pollWatcher) loop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.scan()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// scan lists every watched directory and reports the changes since the last
+// scan.
+func (w *pollWatcher) scan() {
+	w.mu.Lock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.mu.Unlock()
+	sort.Strings(dirs)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, w.parallelism)
+	for _, dir := range dirs {
+		select {
+		case sem <- struct{}{}:
+		case <-w.done:
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			w.scanDir(dir)
+		}()
+	}
+	wg.Wait()
+}
+
+// scanDir reports the changes to the entries of a directory. A directory
+// that no longer exists is no longer watched, and its entries are reported
+// as removed.
+func (w *pollWatcher) scanDir(dir string) {
+	entries, err := readEntries(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		w.sendError(err)
+		return
+	}
+
+	w.mu.Lock()
+	previous, ok := w.dirs[dir]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	if err != nil {
+		delete(w.dirs, dir)
+	} else {
+		w.dirs[dir] = entries
+	}
+	var events []fsnotify.Event
+	for name, info := range entries {
+		path := filepath.Join(dir, name)
+		old, existed := previous[name]
+		switch {
+		case !existed || !os.SameFile(old, info):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			if info.IsDir() {
+				w.discovered[path] = true
+			}
+		case !info.IsDir() && (!old.ModTime().Equal(info.ModTime()) || old.Size() != info.Size()):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+	for name := range previous {
+		if _, ok := entries[name]; !ok {
+			path := filepath.Join(dir, name)
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+			delete(w.discovered, path)
+		}
+	}
+	w.mu.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	for _, event := range events {
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// sendError reports an error unless the watcher is closed.
+func (w *pollWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}
+
+// readEntries returns the entries of a directory by name.
+func readEntries(dir string) (map[string]os.FileInfo, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]os.FileInfo, len(dirEntries))
+	for _, entry := range dirEntries {
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		entries[entry.Name()] = info
+	}
+	return entries, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPollWatcher creates a polling watcher that only scans when told to.
+func newTestPollWatcher(t *testing.T, dirs ...string) *pollWatcher {
+	t.Helper()
+	w := newPollWatcher(time.Hour, 2)
+	t.Cleanup(func() { _ = w.Close() })
+	for _, dir := range dirs {
+		require.NoError(t, w.Add(dir))
+	}
+	return w
+}
+
+// scanEvents scans the watched directories once and returns the events
+// reported, by path.
+func scanEvents(w *pollWatcher) []fsnotify.Event {
+	done := make(chan struct{})
+	go func() {
+		w.scan()
+		close(done)
+	}()
+	events := []fsnotify.Event{}
+	for {
+		select {
+		case event := <-w.Events():
+			events = append(events, event)
+		case <-done:
+			sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+			return events
+		}
+	}
+}
+
+func TestPollWatcher(t *testing.T) {
+	t.Run("Created, changed and removed files are reported", func(t *testing.T) {
+		dir := t.TempDir()
+		kept, changed, removed := filepath.Join(dir, "kept.txt"), filepath.Join(dir, "changed.txt"), filepath.Join(dir, "removed.txt")
+		for _, file := range []string{kept, changed, removed} {
+			require.NoError(t, os.WriteFile(file, []byte("v1"), 0644))
+		}
+		w := newTestPollWatcher(t, dir)
+		assert.Empty(t, scanEvents(w), "Existing files are not reported")
+
+		created := filepath.Join(dir, "created.txt")
+		require.NoError(t, os.WriteFile(created, []byte("v1"), 0644))
+		require.NoError(t, os.WriteFile(changed, []byte("version 2"), 0644))
+		require.NoError(t, os.Remove(removed))
+		assert.Equal(t, []fsnotify.Event{
+			{Name: changed, Op: fsnotify.Write},
+			{Name: created, Op: fsnotify.Create},
+			{Name: removed, Op: fsnotify.Remove},
+		}, scanEvents(w))
+		assert.Empty(t, scanEvents(w))
+	})
+
+	t.Run("Modification times are compared", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "file.txt")
+		require.NoError(t, os.WriteFile(file, []byte("v1"), 0644))
+		w := newTestPollWatcher(t, dir)
+
+		later := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(file, later, later))
+		assert.Equal(t, []fsnotify.Event{{Name: file, Op: fsnotify.Write}}, scanEvents(w))
+	})
+
+	t.Run("Replaced files are reported as created", func(t *testing.T) {
+		dir := t.TempDir()
+		file, replacement := filepath.Join(dir, "file.txt"), filepath.Join(t.TempDir(), "file.txt")
+		modTime := time.Now().Add(-time.Hour)
+		for _, f := range []string{file, replacement} {
+			require.NoError(t, os.WriteFile(f, []byte("v1"), 0644))
+			require.NoError(t, os.Chtimes(f, modTime, modTime))
+		}
+		w := newTestPollWatcher(t, dir)
+
+		require.NoError(t, os.Rename(replacement, file))
+		assert.Equal(t, []fsnotify.Event{{Name: file, Op: fsnotify.Create}}, scanEvents(w), "Same size and time, but another inode")
+	})
+
+	t.Run("Files in new directories are reported once they are added", func(t *testing.T) {
+		dir := t.TempDir()
+		w := newTestPollWatcher(t, dir)
+
+		sub := filepath.Join(dir, "sub")
+		require.NoError(t, os.MkdirAll(sub, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(sub, "copied.txt"), []byte("v1"), 0644))
+		assert.Equal(t, []fsnotify.Event{{Name: sub, Op: fsnotify.Create}}, scanEvents(w))
+
+		require.NoError(t, w.Add(sub))
+		assert.Equal(t, []fsnotify.Event{{Name: filepath.Join(sub, "copied.txt"), Op: fsnotify.Create}}, scanEvents(w))
+		assert.Empty(t, scanEvents(w))
+	})
+
+	t.Run("Removed directories stop being watched", func(t *testing.T) {
+		dir := t.TempDir()
+		sub := filepath.Join(dir, "sub")
+		require.NoError(t, os.MkdirAll(sub, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(sub, "file.txt"), []byte("v1"), 0644))
+		w := newTestPollWatcher(t, dir, sub)
+
+		require.NoError(t, os.RemoveAll(sub))
+		assert.Equal(t, []fsnotify.Event{
+			{Name: sub, Op: fsnotify.Remove},
+			{Name: filepath.Join(sub, "file.txt"), Op: fsnotify.Remove},
+		}, scanEvents(w))
+		assert.NotContains(t, w.dirs, sub)
+	})
+
+	t.Run("Directories are scanned periodically", func(t *testing.T) {
+		dir := t.TempDir()
+		w := newPollWatcher(10*time.Millisecond, 1)
+		require.NoError(t, w.Add(dir))
+		file := filepath.Join(dir, "file.txt")
+		require.NoError(t, os.WriteFile(file, []byte("v1"), 0644))
+
+		select {
+		case event := <-w.Events():
+			assert.Equal(t, file, event.Name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event reported")
+		}
+		require.NoError(t, w.Close())
+		require.NoError(t, w.Close(), "Closing twice is harmless")
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// preflightTimeout bounds the checks made before starting.
+const preflightTimeout = 30 * time.Second
+
+// PreflightConfig configures the checks of the bucket made before starting.
+type PreflightConfig struct {
+	Enabled bool
+	Write   bool // Also put and delete a sentinel object
+}
+
+// regionSetter is implemented by uploaders that can send their requests to
+// another region.
+type regionSetter interface {
+	Region() string
+	SetRegion(region string)
+}
+
+// preflight checks that the bucket exists and can be accessed with client,
+// redirecting the client to the bucket's region if needed, so that echos3
+// fails at startup instead of logging errors for every upload. With
+// config.Write, it also checks that objects can be written by putting and
+// deleting a sentinel object next to the mirrored ones.
+func (a *App) preflight(ctx context.Context, client S3Uploader, config PreflightConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	// The SDK sends requests for access points to the region in their ARN,
+	// but refuses to if the client is configured for another one.
+	if region := arnRegion(a.bucket); region != "" {
+		redirect(client, a.bucket, region)
+	}
+	input := &s3.HeadBucketInput{Bucket: aws.String(a.bucket)}
+	output, err := client.HeadBucket(ctx, input)
+	if region := bucketRegion(output, err); region != "" && redirect(client, a.bucket, region) && err != nil {
+		output, err = client.HeadBucket(ctx, input)
+	}
+	if err != nil {
+		switch errorClass(err) {
+		case "not_found":
+			return fmt.Errorf("preflight: bucket %s does not exist", a.bucket)
+		case "access_denied":
+			return fmt.Errorf("preflight: access to bucket %s denied, check the credentials and their s3:ListBucket permission: %w", a.bucket, err)
+		}
+		return fmt.Errorf("preflight: could not access bucket %s: %w", a.bucket, err)
+	}
+	slog.Info("Preflight found bucket", "bucket", a.bucket, "region", aws.ToString(output.BucketRegion))
+
+	if !config.Write || a.direction == directionPull {
+		return nil
+	}
+	if a.dryRun {
+		slog.Info("Dry run enabled. Preflight will not write to S3")
+		return nil
+	}
+	key := a.sentinelKey()
+	_, err = client.Upload(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(a.bucket),
+		Key:           aws.String(key),
+		Body:          strings.NewReader(""),
+		ContentLength: aws.Int64(0),
+		// Never overwrite an object that happens to have the same key.
+		IfNoneMatch: aws.String("*"),
+	})
+	if err != nil {
+		if errorClass(err) == "access_denied" {
+			return fmt.Errorf("preflight: could not write s3://%s/%s, check the s3:PutObject permission: %w", a.bucket, key, err)
+		}
+		return fmt.Errorf("preflight: could not write s3://%s/%s: %w", a.bucket, key, err)
+	}
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(a.bucket), Key: aws.String(key)}); err != nil {
+		// Deleting is only needed to mirror deletions.
+		if a.delete || a.direction == directionBoth {
+			return fmt.Errorf("preflight: could not delete s3://%s/%s, check the s3:DeleteObject permission: %w", a.bucket, key, err)
+		}
+		slog.Warn("Preflight could not delete its sentinel object", "bucket", a.bucket, "key", key, "error", err)
+		return nil
+	}
+	slog.Info("Preflight wrote and deleted a sentinel object", "bucket", a.bucket, "key", key)
+	return nil
+}
+
+// sentinelKey returns a key for the preflight's sentinel object, below the
+// mirrored prefix, or next to the key of a watched file.
+func (a *App) sentinelKey() string {
+	prefix := a.remotePrefix()
+	if !a.isDir {
+		if prefix = path.Dir(a.keyPrefix) + "/"; prefix == "./" {
+			prefix = ""
+		}
+	}
+	return fmt.Sprintf("%s.echos3-preflight-%d", prefix, time.Now().UnixNano())
+}
+
+// redirect sends further requests of client to region, if it can and they
+// go elsewhere, and reports whether it did.
+func redirect(client S3Uploader, bucket, region string) bool {
+	setter, ok := client.(regionSetter)
+	if !ok || setter.Region() == region {
+		return false
+	}
+	slog.Info("Redirecting S3 requests to the bucket's region", "bucket", bucket, "from", setter.Region(), "region", region)
+	setter.SetRegion(region)
+	return true
+}
+
+// bucketRegion returns the region of a bucket as reported by HeadBucket,
+// which S3 also reports when refusing requests sent to the wrong region.
+func bucketRegion(output *s3.HeadBucketOutput, err error) string {
+	if output != nil && output.BucketRegion != nil {
+		return *output.BucketRegion
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		return respErr.Response.Header.Get("X-Amz-Bucket-Region")
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// regionalUploader is a mock uploader in a region, whose HeadBucket requests
+// are refused like S3 does unless they are sent to the bucket's region.
+type regionalUploader struct {
+	*MockS3Uploader
+	region       string
+	bucketRegion string
+}
+
+func (r *regionalUploader) Region() string          { return r.region }
+func (r *regionalUploader) SetRegion(region string) { r.region = region }
+
+func (r *regionalUploader) HeadBucket(ctx context.Context, input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	if r.region != r.bucketRegion {
+		return nil, &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{
+				StatusCode: http.StatusMovedPermanently,
+				Header:     http.Header{"X-Amz-Bucket-Region": {r.bucketRegion}},
+			}},
+			Err: &smithy.GenericAPIError{Code: "PermanentRedirect"},
+		}}
+	}
+	return r.MockS3Uploader.HeadBucket(ctx, input)
+}
+
+func TestApp_preflight(t *testing.T) {
+	ctx := context.Background()
+	enabled := PreflightConfig{Enabled: true}
+	write := PreflightConfig{Enabled: true, Write: true}
+
+	t.Run("Requests are redirected to the bucket's region", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		client := &regionalUploader{MockS3Uploader: mockUploader, region: "us-east-1", bucketRegion: "eu-west-1"}
+		require.NoError(t, app.preflight(ctx, client, enabled))
+		assert.Equal(t, "eu-west-1", client.region)
+
+		mockUploader.BucketRegion = "eu-central-1"
+		client.bucketRegion = "eu-central-1"
+		client.region = "eu-central-1"
+		require.NoError(t, app.preflight(ctx, client, enabled))
+		assert.Equal(t, "eu-central-1", client.region)
+	})
+
+	t.Run("Access points are used in the region of their ARN", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		app.bucket = "arn:aws:s3:ap-south-1:123456789012:accesspoint/my-ap"
+		client := &regionalUploader{MockS3Uploader: mockUploader, region: "us-east-1", bucketRegion: "ap-south-1"}
+		require.NoError(t, app.preflight(ctx, client, enabled))
+		assert.Equal(t, "ap-south-1", client.region)
+	})
+
+	t.Run("Missing and inaccessible buckets fail", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		for code, msg := range map[string]string{
+			"NotFound":  "bucket test-bucket does not exist",
+			"Forbidden": "check the credentials and their s3:ListBucket permission",
+			"Throttled": "could not access bucket test-bucket",
+		} {
+			mockUploader.HeadBucketErr = &smithy.GenericAPIError{Code: code}
+			assert.ErrorContains(t, app.preflight(ctx, mockUploader, enabled), msg, code)
+		}
+	})
+
+	t.Run("A sentinel object is written and deleted", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		require.NoError(t, app.preflight(ctx, mockUploader, write))
+		require.Len(t, mockUploader.Deletes, 1)
+		for key := range mockUploader.Deletes {
+			assert.True(t, strings.HasPrefix(key, "test-prefix/.echos3-preflight-"), key)
+			assert.Equal(t, "*", *mockUploader.Uploads[key].IfNoneMatch, "Sentinels never overwrite objects")
+		}
+		assert.Empty(t, mockUploader.Bodies)
+	})
+
+	t.Run("Missing write permissions fail", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		mockUploader.UploadErr = &smithy.GenericAPIError{Code: "AccessDenied"}
+		assert.ErrorContains(t, app.preflight(ctx, mockUploader, write), "check the s3:PutObject permission")
+		assert.NoError(t, app.preflight(ctx, mockUploader, enabled))
+
+		app.direction = directionPull
+		assert.NoError(t, app.preflight(ctx, mockUploader, write), "Pulls never write")
+		app.direction = directionPush
+		app.dryRun = true
+		assert.NoError(t, app.preflight(ctx, mockUploader, write), "Dry runs never write")
+	})
+
+	t.Run("Delete permissions are only needed to mirror deletions", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		mockUploader.DeleteErr = errors.New("access denied")
+		assert.NoError(t, app.preflight(ctx, mockUploader, write))
+
+		app.delete = true
+		assert.ErrorContains(t, app.preflight(ctx, mockUploader, write), "check the s3:DeleteObject permission")
+	})
+}
+
+func TestApp_sentinelKey(t *testing.T) {
+	for keyPrefix, want := range map[string]string{
+		"reports/daily.csv": "reports/.echos3-preflight-",
+		"daily.csv":         ".echos3-preflight-",
+	} {
+		app := &App{keyPrefix: keyPrefix}
+		assert.True(t, strings.HasPrefix(app.sentinelKey(), want), keyPrefix)
+	}
+	app := &App{isDir: true}
+	assert.True(t, strings.HasPrefix(app.sentinelKey(), ".echos3-preflight-"))
+}
+
+func TestParseFlags_Preflight(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	parse := func(args ...string) (*AppConfig, error) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		os.Args = append(append([]string{"echos3"}, args...), "local/path", "s3://bucket/key")
+		_, config, _, err := parseFlags()
+		return config, err
+	}
+
+	config, err := parse()
+	require.NoError(t, err)
+	assert.Equal(t, PreflightConfig{Enabled: true}, config.Preflight)
+
+	config, err = parse("--preflight-write")
+	require.NoError(t, err)
+	assert.Equal(t, PreflightConfig{Enabled: true, Write: true}, config.Preflight)
+
+	config, err = parse("--skip-preflight")
+	require.NoError(t, err)
+	assert.False(t, config.Preflight.Enabled)
+
+	_, err = parse("--skip-preflight", "--preflight-write")
+	assert.Error(t, err)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// remoteVersion identifies a version of an object as seen in a listing.
+type remoteVersion struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// versionOf returns the version of a listed object.
+func versionOf(obj types.Object) remoteVersion {
+	return remoteVersion{
+		ETag:         aws.ToString(obj.ETag),
+		LastModified: aws.ToTime(obj.LastModified),
+	}
+}
+
+// needsDownload reports whether a remote object differs from its local copy.
+// Downloaded files take the object's LastModified time as their mtime, so an
+// unchanged object compares equal.
+func needsDownload(info os.FileInfo, obj types.Object) bool {
+	if aws.ToInt64(obj.Size) != info.Size() {
+		return true
+	}
+	return obj.LastModified == nil || obj.LastModified.After(info.ModTime())
+}
+
+// processDownload handles the download of result.Key from S3 to
+// result.LocalFile and records the ETag, version and size of the downloaded
+// object in result.
+func (p *UploadWorkerPool) processDownload(ctx context.Context, result *JobResult) error {
+	output, err := p.uploader.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(result.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := output.Body.Close(); err != nil {
+			slog.Error("Could not close response body", "bucket", p.bucket, "key", result.Key, "error", err)
+		}
+	}()
+
+	if err := writeFileAtomic(result.LocalFile, output.Body, aws.ToTime(output.LastModified), 0644); err != nil {
+		return fmt.Errorf("could not write downloaded file: %w", err)
+	}
+	p.rememberETag(result.Key, aws.ToString(output.ETag))
+	result.ETag = aws.ToString(output.ETag)
+	result.VersionID = aws.ToString(output.VersionId)
+	result.Size = aws.ToInt64(output.ContentLength)
+	return nil
+}
+
+// writeFileAtomic writes r to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file. The mode
+// and a non-zero modTime are applied to the file before it is renamed.
+func writeFileAtomic(path string, r io.Reader, modTime time.Time, mode os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".echos3-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		// Clean up the temporary file if it was not renamed into place.
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tmpName, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpName, path)
+}
+
+// pullChanges downloads new or changed objects and, if --delete is set,
+// removes local files that have no object. seen tracks the version
+// of every object that has been mirrored locally and is updated in place.
+func (a *App) pullChanges(ctx context.Context, seen map[string]remoteVersion) (SyncSummary, error) {
+	var summary SyncSummary
+
+	remote, err := a.listRemote(ctx)
+	if err != nil {
+		return summary, err
+	}
+	a.workerPool.RememberObjects(remote)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]error)
+		pending = make(map[string]remoteVersion)
+	)
+	for s3Key, obj := range remote {
+		version := versionOf(obj)
+		if prev, ok := seen[s3Key]; ok && prev == version {
+			summary.Unchanged++
+			continue
+		}
+
+		localFile, err := a.localPathFor(s3Key)
+		if err != nil {
+			slog.Error("Skipping download", "bucket", a.bucket, "key", s3Key, "error", err)
+			summary.Failed++
+			continue
+		}
+
+		// On the first sighting of a key, a local file that already matches
+		// the object does not need to be downloaded again.
+		if _, ok := seen[s3Key]; !ok {
+			if info, err := os.Stat(localFile); err == nil && !needsDownload(info, obj) {
+				seen[s3Key] = version
+				summary.Unchanged++
+				continue
+			}
+		}
+
+		if a.dryRun {
+			slog.Info("Would download", "dry_run", true, "op", opDownload.String(), "bucket", a.bucket, "key", s3Key, "path", localFile, "bytes", aws.ToInt64(obj.Size))
+			summary.Downloaded++
+			continue
+		}
+
+		pending[s3Key] = version
+		wg.Add(1)
+		a.workerPool.QueueDownload(s3Key, localFile, func(result JobResult) {
+			defer wg.Done()
+			mu.Lock()
+			results[s3Key] = result.Err
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for s3Key, err := range results {
+		if err != nil {
+			summary.Failed++
+			continue
+		}
+		summary.Downloaded++
+		seen[s3Key] = pending[s3Key]
+	}
+
+	for s3Key := range seen {
+		if _, exists := remote[s3Key]; !exists {
+			delete(seen, s3Key)
+		}
+	}
+	if a.delete {
+		// Files whose objects were deleted before echos3 started were never
+		// seen, so the local tree is compared with the listing instead.
+		locals, _, err := a.listLocal()
+		if err != nil {
+			return summary, err
+		}
+		for s3Key := range locals {
+			if _, exists := remote[s3Key]; !exists {
+				_ = a.removeLocal(s3Key, &summary)
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+// removeLocal deletes the local copy of an object that no longer exists in S3.
+// The error is logged and counted in summary before it is returned.
+func (a *App) removeLocal(s3Key string, summary *SyncSummary) error {
+	localFile, err := a.localPathFor(s3Key)
+	if err != nil {
+		slog.Error("Skipping local delete", "bucket", a.bucket, "key", s3Key, "error", err)
+		summary.Failed++
+		return err
+	}
+
+	if a.dryRun {
+		slog.Info("Would remove local file", "dry_run", true, "op", "remove", "path", localFile)
+		summary.Deleted++
+		return nil
+	}
+
+	if err := os.Remove(localFile); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove local file", "op", "remove", "path", localFile, "error", err)
+		summary.Failed++
+		return err
+	}
+	slog.Info("Removed local file", "op", "remove", "path", localFile)
+	summary.Deleted++
+	return nil
+}
+
+// pullOnce mirrors the S3 prefix to the local path a single time, then shuts
+// the worker pool down. An error is returned if any operation failed.
+func (a *App) pullOnce(ctx context.Context) (SyncSummary, error) {
+	defer a.workerPool.Shutdown()
+
+	slog.Info("Pulling from S3", "bucket", a.bucket, "key", a.keyPrefix, "path", a.localPath)
+	summary, err := a.pullChanges(ctx, make(map[string]remoteVersion))
+	if err != nil {
+		return summary, err
+	}
+
+	slog.Info("Pull complete", "downloaded", summary.Downloaded, "deleted", summary.Deleted,
+		"unchanged", summary.Unchanged, "failed", summary.Failed)
+
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d operation(s) failed", summary.Failed)
+	}
+	return summary, nil
+}
+
+// runPull polls S3 for changes and mirrors them to the local path until the
+// context is cancelled.
+func (a *App) runPull(ctx context.Context) error {
+	defer a.workerPool.Shutdown()
+
+	slog.Info("Polling S3 for changes", "bucket", a.bucket, "key", a.keyPrefix, "path", a.localPath, "interval", a.pollInterval)
+
+	seen := make(map[string]remoteVersion)
+	ticker := time.NewTicker(a.pollInterval)
+	defer ticker.Stop()
+
+	// A single poll may legitimately take longer than any fixed timeout, so
+	// the loop is not checked for staleness.
+	a.health.loopStarted(0)
+	defer a.health.loopStopped()
+
+	for {
+		summary, err := a.pullChanges(ctx, seen)
+		if err != nil {
+			slog.Error("Poll failed", "error", err)
+		} else {
+			a.health.initialScanDone()
+			if summary.Downloaded > 0 || summary.Deleted > 0 || summary.Failed > 0 {
+				slog.Info("Poll complete", "downloaded", summary.Downloaded, "deleted", summary.Deleted, "failed", summary.Failed)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
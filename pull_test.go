@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addRemoteObject stores an object in the mock so it can be listed and fetched.
+func addRemoteObject(m *MockS3Uploader, key, body, etag string, modTime time.Time) {
+	m.Objects = append(m.Objects, types.Object{
+		Key:          aws.String(key),
+		Size:         aws.Int64(int64(len(body))),
+		ETag:         aws.String(etag),
+		LastModified: aws.Time(modTime),
+	})
+	m.Bodies[key] = body
+}
+
+func TestApp_pullOnce(t *testing.T) {
+	t.Run("Downloads new objects and preserves LastModified", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha", `"1"`, modTime)
+		addRemoteObject(mockUploader, "test-prefix/nested/b.txt", "beta", `"2"`, modTime)
+
+		summary, err := app.pullOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), summary.Downloaded)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "nested", "b.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "beta", string(content))
+
+		info, err := os.Stat(filepath.Join(tmpDir, "a.txt"))
+		require.NoError(t, err)
+		assert.True(t, info.ModTime().Equal(modTime))
+	})
+
+	t.Run("Skips files that already match", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		localFile := filepath.Join(tmpDir, "a.txt")
+		require.NoError(t, os.WriteFile(localFile, []byte("alpha"), 0644))
+		require.NoError(t, os.Chtimes(localFile, modTime, modTime))
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha", `"1"`, modTime)
+
+		summary, err := app.pullOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Unchanged: 1}, summary)
+	})
+
+	t.Run("Returns an error when a download fails", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha", `"1"`, time.Now())
+		mockUploader.GetErr = errors.New("S3 is down")
+
+		summary, err := app.pullOnce(context.Background())
+		require.Error(t, err)
+		assert.Equal(t, int64(1), summary.Failed)
+	})
+
+	t.Run("Removes local files without objects with delete", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, true, true)
+		modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha", `"1"`, modTime)
+		localOnly := filepath.Join(tmpDir, "nested", "stale.txt")
+		require.NoError(t, os.MkdirAll(filepath.Dir(localOnly), 0755))
+		require.NoError(t, os.WriteFile(localOnly, []byte("deleted before the pull"), 0644))
+
+		summary, err := app.pullOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Downloaded: 1, Deleted: 1}, summary)
+		assert.NoFileExists(t, localOnly)
+		assert.FileExists(t, filepath.Join(tmpDir, "a.txt"))
+	})
+
+	t.Run("Dry run does not write local files", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		app.dryRun = true
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha", `"1"`, time.Now())
+
+		summary, err := app.pullOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), summary.Downloaded)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "a.txt"))
+	})
+}
+
+func TestApp_pullChanges(t *testing.T) {
+	t.Run("Downloads changed objects and removes deleted ones", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, true, true)
+		defer app.workerPool.Shutdown()
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha", `"1"`, time.Now().Add(-time.Hour))
+		addRemoteObject(mockUploader, "test-prefix/b.txt", "beta", `"2"`, time.Now().Add(-time.Hour))
+
+		seen := make(map[string]remoteVersion)
+		summary, err := app.pullChanges(context.Background(), seen)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), summary.Downloaded)
+
+		// Replace a.txt and remove b.txt remotely.
+		mockUploader.Objects = nil
+		addRemoteObject(mockUploader, "test-prefix/a.txt", "alpha-2", `"3"`, time.Now())
+		delete(mockUploader.Bodies, "test-prefix/b.txt")
+
+		summary, err = app.pullChanges(context.Background(), seen)
+		require.NoError(t, err)
+		assert.Equal(t, SyncSummary{Downloaded: 1, Deleted: 1}, summary)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "alpha-2", string(content))
+		assert.NoFileExists(t, filepath.Join(tmpDir, "b.txt"))
+	})
+
+	t.Run("Keeps local files without objects unless deleting", func(t *testing.T) {
+		app, _, tmpDir := newTestApp(t, false, true)
+		defer app.workerPool.Shutdown()
+		localOnly := filepath.Join(tmpDir, "local.txt")
+		require.NoError(t, os.WriteFile(localOnly, []byte("mine"), 0644))
+
+		_, err := app.pullChanges(context.Background(), make(map[string]remoteVersion))
+		require.NoError(t, err)
+		assert.FileExists(t, localOnly)
+	})
+}
+
+func TestApp_localPathFor(t *testing.T) {
+	dirApp := &App{isDir: true, localPath: "/data", keyPrefix: "backup"}
+	fileApp := &App{isDir: false, localPath: "/data/report.csv", keyPrefix: "reports/latest.csv"}
+
+	testCases := []struct {
+		name      string
+		app       *App
+		key       string
+		expect    string
+		expectErr bool
+	}{
+		{"Nested key", dirApp, "backup/a/b.txt", filepath.FromSlash("/data/a/b.txt"), false},
+		{"Key outside prefix", dirApp, "other/a.txt", "", true},
+		{"Key sharing prefix text", dirApp, "backup-old/a.txt", "", true},
+		{"Prefix itself", dirApp, "backup/", "", true},
+		{"Key escaping the local path", dirApp, "backup/../../etc/passwd", "", true},
+		{"Single file key", fileApp, "reports/latest.csv", "/data/report.csv", false},
+		{"Single file other key", fileApp, "reports/other.csv", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			localFile, err := tc.app.localPathFor(tc.key)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, localFile)
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir := t.TempDir()
+	target := filepath.Join(tmpDir, "sub", "file.txt")
+
+	require.NoError(t, writeFileAtomic(target, strings.NewReader("hello"), time.Time{}, 0644))
+
+	content, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	entries, err := os.ReadDir(filepath.Dir(target))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "Temporary files should not be left behind")
+}
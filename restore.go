@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// User metadata keys that record the local file an object was uploaded from,
+// so that restores can recreate it.
+const (
+	mtimeMetadata = "echos3-mtime" // Modification time, RFC 3339 with nanoseconds
+	modeMetadata  = "echos3-mode"  // Permission bits, in octal
+)
+
+const restoreUsage = `Usage: echos3 restore [flags] s3://bucket/key /path/to/restore
+
+Downloads the objects under an S3 prefix to a local directory, or a single
+object or object version to a local file, with the modification times and
+permissions they were uploaded with. Local files newer than their object are
+kept unless --force is given. Objects in Glacier storage classes are restored
+first.
+
+Flags:
+`
+
+// restoreOptions configures a restore.
+type restoreOptions struct {
+	AsOf         time.Time // Restore the versions that were current at this time, if set
+	VersionID    string    // Restore this version of a single object, if set
+	Force        bool      // Overwrite local files that are newer than their object
+	Tier         types.Tier
+	Days         int32         // How long restored Glacier copies are kept
+	PollInterval time.Duration // Time between checks of pending Glacier restores
+}
+
+// RestoreSummary reports the outcome of a restore.
+type RestoreSummary struct {
+	Restored int64
+	Skipped  int64 // Local files newer than their object
+	Archived int64 // Objects that had to be restored from Glacier first
+	Failed   int64
+}
+
+// restoreObject is an object version to restore.
+type restoreObject struct {
+	key          string
+	versionID    string // Empty for the current version
+	lastModified time.Time
+	storageClass string
+}
+
+// restorer downloads objects back to the local path.
+type restorer struct {
+	app     *App
+	options restoreOptions
+
+	mu      sync.Mutex
+	summary RestoreSummary
+	waiting []restoreObject // Archived objects being restored by S3
+}
+
+// runRestore implements the restore subcommand. It returns the process exit
+// status: 0 on success, 1 if any object could not be restored and 2 on
+// usage or listing errors.
+func runRestore(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asOf := flags.String("as-of", "", "Restore the object versions that were current at this RFC 3339 time. Requires bucket versioning.")
+	versionID := flags.String("version-id", "", "Restore this version of the object the S3 path names, as listed by echos3 history.")
+	force := flags.Bool("force", false, "Overwrite local files that are newer than their object.")
+	concurrency := flags.Int("concurrency", getDefaultConcurrency(), "Maximum number of concurrent downloads.")
+	tier := flags.String("glacier-tier", string(types.TierStandard), "Retrieval tier for objects in Glacier storage classes: Expedited, Standard or Bulk.")
+	days := flags.Int("glacier-days", 1, "Number of days restored Glacier copies are kept available.")
+	pollInterval := flags.Duration("glacier-poll-interval", time.Minute, "How often to check whether Glacier restores have completed.")
+	parseKeys := keyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, restoreUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 || *concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	options := restoreOptions{VersionID: *versionID, Force: *force, Tier: types.Tier(*tier), Days: int32(*days), PollInterval: *pollInterval}
+	if err := checkRestoreOptions(&options, *asOf); err != nil {
+		fmt.Fprintf(stderr, "echos3 restore: %v\n", err)
+		return 2
+	}
+
+	keys, err := parseKeys()
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 restore: %v\n", err)
+		return 2
+	}
+	app, err := newRestoreApp(ctx, flags.Arg(0), flags.Arg(1), keys, *concurrency)
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 restore: %v\n", err)
+		return 2
+	}
+	r := &restorer{app: app, options: options}
+	objects, err := r.list(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 restore: %v\n", err)
+		return 2
+	}
+
+	summary := r.run(ctx, objects)
+	fmt.Fprintf(stdout, "Restored %d file(s) to %s, %d from Glacier, %d newer local file(s) kept, %d failed\n",
+		summary.Restored, app.localPath, summary.Archived, summary.Skipped, summary.Failed)
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkRestoreOptions validates the restore options and parses asOf.
+func checkRestoreOptions(options *restoreOptions, asOf string) error {
+	if asOf != "" {
+		t, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			return fmt.Errorf("invalid --as-of time %q: must be RFC 3339, such as 2026-10-16T10:00:00Z", asOf)
+		}
+		options.AsOf = t
+	}
+	if options.VersionID != "" && !options.AsOf.IsZero() {
+		return errors.New("--version-id and --as-of cannot be combined")
+	}
+	switch options.Tier {
+	case types.TierExpedited, types.TierStandard, types.TierBulk:
+	default:
+		return fmt.Errorf("invalid Glacier tier %q: must be Expedited, Standard or Bulk", options.Tier)
+	}
+	if options.Days < 1 {
+		return fmt.Errorf("invalid Glacier days %d: must be at least 1", options.Days)
+	}
+	if options.PollInterval <= 0 {
+		return fmt.Errorf("invalid Glacier poll interval %s: must be positive", options.PollInterval)
+	}
+	return nil
+}
+
+// newRestoreApp creates an App that maps keys under the S3 path to files
+// under the local path, which need not exist yet.
+func newRestoreApp(ctx context.Context, s3Path, localPathArg string, keys KeyConfig, concurrency int) (*App, error) {
+	bucket, keyPrefix, err := parseS3Path(s3Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 path: %w", err)
+	}
+	localPath, err := filepath.Abs(localPathArg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local path: %w", err)
+	}
+	s3Client, err := newS3Client(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	// Restore into a directory unless the local path is an existing file.
+	info, err := os.Stat(localPath)
+	isDir := err != nil || info.IsDir()
+	app := &App{
+		uploader:      s3Client,
+		localPath:     localPath,
+		isDir:         isDir,
+		bucket:        bucket,
+		keyPrefix:     keyPrefix,
+		maxConcurrent: concurrency,
+	}
+	if keys.enabled() {
+		if err := app.mapKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+	return app, nil
+}
+
+// list returns the objects to restore. If nothing is found under the prefix
+// but the S3 path names an object, that object is restored as a single file:
+// to the local path, or into it if it is an existing directory.
+func (r *restorer) list(ctx context.Context) ([]restoreObject, error) {
+	if r.options.VersionID != "" {
+		return r.listVersion(ctx)
+	}
+	objects, err := r.listObjects(ctx)
+	if err != nil || len(objects) > 0 || !r.app.isDir {
+		return objects, err
+	}
+	if r.app.keyPrefix == "" || strings.HasSuffix(r.app.keyPrefix, "/") {
+		return objects, nil
+	}
+	r.app.isDir = false
+	if objects, err = r.listObjects(ctx); err != nil || len(objects) == 0 {
+		r.app.isDir = true
+		return objects, err
+	}
+	r.restoreSingleFile()
+	return objects, nil
+}
+
+// listVersion returns the version to restore of the object the S3 path
+// names.
+func (r *restorer) listVersion(ctx context.Context) ([]restoreObject, error) {
+	head, err := r.app.uploader.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(r.app.bucket),
+		Key:       aws.String(r.app.keyPrefix),
+		VersionId: aws.String(r.options.VersionID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not find version %s of s3://%s/%s: %w", r.options.VersionID, r.app.bucket, r.app.keyPrefix, err)
+	}
+	r.app.isDir = false
+	r.restoreSingleFile()
+	return []restoreObject{{
+		key:          r.app.keyPrefix,
+		versionID:    r.options.VersionID,
+		lastModified: aws.ToTime(head.LastModified),
+		storageClass: string(head.StorageClass),
+	}}, nil
+}
+
+// restoreSingleFile restores a single object into the local path if it is a
+// directory, under the object's base name.
+func (r *restorer) restoreSingleFile() {
+	if info, err := os.Stat(r.app.localPath); err == nil && info.IsDir() {
+		r.app.localPath = filepath.Join(r.app.localPath, path.Base(r.app.keyPrefix))
+	}
+}
+
+// listObjects returns the current objects under the mirrored prefix, or the
+// versions that were current at options.AsOf.
+func (r *restorer) listObjects(ctx context.Context) ([]restoreObject, error) {
+	if !r.options.AsOf.IsZero() {
+		return r.app.listVersionsAsOf(ctx, r.options.AsOf)
+	}
+	remote, err := r.app.listRemote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]restoreObject, 0, len(remote))
+	for key, obj := range remote {
+		objects = append(objects, restoreObject{key: key, lastModified: aws.ToTime(obj.LastModified), storageClass: string(obj.StorageClass)})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, nil
+}
+
+// listVersionsAsOf returns the version of each object under the mirrored
+// prefix that was current at asOf. Objects that did not exist or were deleted
+// at that time are left out.
+func (a *App) listVersionsAsOf(ctx context.Context, asOf time.Time) ([]restoreObject, error) {
+	type entry struct {
+		object  restoreObject
+		deleted bool
+	}
+	current := make(map[string]entry)
+	consider := func(key string, e entry) {
+		if e.object.lastModified.After(asOf) {
+			return
+		}
+		if prev, ok := current[key]; !ok || e.object.lastModified.After(prev.object.lastModified) {
+			current[key] = e
+		}
+	}
+
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(a.remotePrefix()),
+	}
+	for {
+		output, err := a.uploader.ListObjectVersions(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("could not list versions of s3://%s/%s: %w", a.bucket, a.remotePrefix(), err)
+		}
+		for _, v := range output.Versions {
+			key := aws.ToString(v.Key)
+			if a.ownsKey(key) {
+				consider(key, entry{object: restoreObject{
+					key:          key,
+					versionID:    aws.ToString(v.VersionId),
+					lastModified: aws.ToTime(v.LastModified),
+					storageClass: string(v.StorageClass),
+				}})
+			}
+		}
+		for _, marker := range output.DeleteMarkers {
+			key := aws.ToString(marker.Key)
+			if a.ownsKey(key) {
+				consider(key, entry{object: restoreObject{key: key, lastModified: aws.ToTime(marker.LastModified)}, deleted: true})
+			}
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+
+	var objects []restoreObject
+	for _, e := range current {
+		if !e.deleted {
+			objects = append(objects, e.object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, nil
+}
+
+// ownsKey reports whether a key listed under the mirrored prefix is mirrored
+// from the local path, like listRemote decides.
+func (a *App) ownsKey(key string) bool {
+	if !a.isDir {
+		return key == a.keyPrefix
+	}
+	return !strings.HasSuffix(key, "/")
+}
+
+// run restores objects concurrently, then waits for the Glacier restores it
+// had to request and downloads those objects too.
+func (r *restorer) run(ctx context.Context, objects []restoreObject) RestoreSummary {
+	sem := make(chan struct{}, max(r.app.maxConcurrent, 1))
+	var wg sync.WaitGroup
+	for _, obj := range objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.restore(ctx, obj)
+		}()
+	}
+	wg.Wait()
+
+	r.wait(ctx)
+	return r.summary
+}
+
+// count updates the summary under the lock.
+func (r *restorer) count(counter *int64) {
+	r.mu.Lock()
+	*counter++
+	r.mu.Unlock()
+}
+
+// restore downloads a single object unless its local file is newer. Archived
+// objects are queued to be downloaded once S3 has restored them.
+func (r *restorer) restore(ctx context.Context, obj restoreObject) {
+	logger := slog.With("op", "restore", "bucket", r.app.bucket, "key", obj.key)
+	if obj.versionID != "" {
+		logger = logger.With("version_id", obj.versionID)
+	}
+	localFile, err := r.localPathFor(ctx, obj)
+	if err != nil {
+		logger.Error("Skipping restore", "error", err)
+		r.count(&r.summary.Failed)
+		return
+	}
+	logger = logger.With("path", localFile)
+
+	if info, err := os.Stat(localFile); err == nil && !r.options.Force && info.ModTime().After(obj.lastModified) {
+		logger.Warn("Keeping local file that is newer than its object. Use --force to overwrite it", "mtime", info.ModTime())
+		r.count(&r.summary.Skipped)
+		return
+	}
+
+	if isArchived(obj.storageClass) {
+		r.archived(ctx, obj, logger)
+		return
+	}
+	err = r.app.downloadVersion(ctx, obj, localFile)
+	var archived *types.InvalidObjectState
+	switch {
+	case errors.As(err, &archived):
+		// Objects in the archive tiers of Intelligent-Tiering are only
+		// found out when they are read.
+		r.archived(ctx, obj, logger)
+	case err != nil:
+		logger.Error("Failed to restore", "error", err)
+		r.count(&r.summary.Failed)
+	default:
+		logger.Info("Restored file")
+		r.count(&r.summary.Restored)
+	}
+}
+
+// localPathFor returns the local path to restore an object to. Keys made with
+// rewrite rules are mapped back with the path recorded in their metadata.
+func (r *restorer) localPathFor(ctx context.Context, obj restoreObject) (string, error) {
+	localFile, err := r.app.localPathFor(obj.key)
+	if !errors.Is(err, errKeyIrreversible) {
+		return localFile, err
+	}
+	input := &s3.HeadObjectInput{Bucket: aws.String(r.app.bucket), Key: aws.String(obj.key)}
+	if obj.versionID != "" {
+		input.VersionId = aws.String(obj.versionID)
+	}
+	head, err := r.app.uploader.HeadObject(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := head.Metadata[pathHashMetadata]; ok {
+		return "", fmt.Errorf("key %s was rewritten or sanitised and its path was too long to record in its metadata", obj.key)
+	}
+	relPath, err := url.PathUnescape(head.Metadata[pathMetadata])
+	if err != nil || relPath == "" {
+		return "", fmt.Errorf("key %s was rewritten or sanitised and records no path in its %s metadata", obj.key, pathMetadata)
+	}
+	return r.app.localPathForRel(obj.key, relPath)
+}
+
+// isArchived reports whether objects of a storage class must be restored
+// before they can be read.
+func isArchived(storageClass string) bool {
+	return storageClass == string(types.StorageClassGlacier) || storageClass == string(types.StorageClassDeepArchive)
+}
+
+// archived requests the restore of an archived object and queues it to be
+// downloaded once the restore has completed.
+func (r *restorer) archived(ctx context.Context, obj restoreObject, logger *slog.Logger) {
+	if err := r.requestRestore(ctx, obj); err != nil {
+		logger.Error("Failed to request restore from Glacier", "error", err)
+		r.count(&r.summary.Failed)
+		return
+	}
+	logger.Info("Requested restore from Glacier", "tier", r.options.Tier)
+	r.mu.Lock()
+	r.waiting = append(r.waiting, obj)
+	r.mu.Unlock()
+}
+
+// requestRestore asks S3 to restore an archived object. Restores that are
+// already in progress or done are fine.
+func (r *restorer) requestRestore(ctx context.Context, obj restoreObject) error {
+	request := &types.RestoreRequest{GlacierJobParameters: &types.GlacierJobParameters{Tier: r.options.Tier}}
+	// Intelligent-Tiering moves restored objects back to its frequent access
+	// tier instead of keeping a temporary copy.
+	if isArchived(obj.storageClass) {
+		request.Days = aws.Int32(r.options.Days)
+	}
+	input := &s3.RestoreObjectInput{
+		Bucket:         aws.String(r.app.bucket),
+		Key:            aws.String(obj.key),
+		RestoreRequest: request,
+	}
+	if obj.versionID != "" {
+		input.VersionId = aws.String(obj.versionID)
+	}
+	_, err := r.app.uploader.RestoreObject(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "RestoreAlreadyInProgress" || apiErr.ErrorCode() == "ObjectAlreadyInActiveTierError") {
+		return nil
+	}
+	return err
+}
+
+// wait polls the archived objects until S3 has restored them, downloading
+// each as soon as it is available.
+func (r *restorer) wait(ctx context.Context) {
+	ticker := time.NewTicker(r.options.PollInterval)
+	defer ticker.Stop()
+	for len(r.waiting) > 0 {
+		slog.Info("Waiting for Glacier restores", "pending", len(r.waiting), "interval", r.options.PollInterval)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			r.summary.Failed += int64(len(r.waiting))
+			return
+		}
+
+		var pending []restoreObject
+		for _, obj := range r.waiting {
+			logger := slog.With("op", "restore", "bucket", r.app.bucket, "key", obj.key)
+			done, err := r.restoreDone(ctx, obj)
+			if err != nil {
+				logger.Error("Failed to check restore from Glacier", "error", err)
+				r.summary.Failed++
+				continue
+			}
+			if !done {
+				pending = append(pending, obj)
+				continue
+			}
+			localFile, err := r.localPathFor(ctx, obj)
+			if err != nil {
+				logger.Error("Skipping restore", "error", err)
+				r.summary.Failed++
+				continue
+			}
+			if err := r.app.downloadVersion(ctx, obj, localFile); err != nil {
+				logger.Error("Failed to restore", "path", localFile, "error", err)
+				r.summary.Failed++
+				continue
+			}
+			logger.Info("Restored file from Glacier", "path", localFile)
+			r.summary.Restored++
+			r.summary.Archived++
+		}
+		r.waiting = pending
+	}
+}
+
+// restoreDone reports whether S3 has finished restoring an archived object.
+func (r *restorer) restoreDone(ctx context.Context, obj restoreObject) (bool, error) {
+	input := &s3.HeadObjectInput{Bucket: aws.String(r.app.bucket), Key: aws.String(obj.key)}
+	if obj.versionID != "" {
+		input.VersionId = aws.String(obj.versionID)
+	}
+	head, err := r.app.uploader.HeadObject(ctx, input)
+	if err != nil {
+		return false, err
+	}
+	// Restored objects report `ongoing-request="false", expiry-date="..."`.
+	// Objects brought back to an active Intelligent-Tiering tier report
+	// neither a restore nor an archive status.
+	restore := aws.ToString(head.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return true, nil
+	case restore != "":
+		return false, nil
+	default:
+		return !isArchived(string(head.StorageClass)) && head.ArchiveStatus == "", nil
+	}
+}
+
+// downloadVersion downloads an object version to localFile and gives it the
+// modification time and permissions recorded when it was uploaded. Objects
+// uploaded by other tools get their LastModified time and mode 0644.
+func (a *App) downloadVersion(ctx context.Context, obj restoreObject, localFile string) error {
+	input := &s3.GetObjectInput{Bucket: aws.String(a.bucket), Key: aws.String(obj.key)}
+	if obj.versionID != "" {
+		input.VersionId = aws.String(obj.versionID)
+	}
+	output, err := a.uploader.GetObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := output.Body.Close(); err != nil {
+			slog.Error("Could not close response body", "bucket", a.bucket, "key", obj.key, "error", err)
+		}
+	}()
+
+	modTime, mode := fileAttributes(output.Metadata)
+	if modTime.IsZero() {
+		modTime = aws.ToTime(output.LastModified)
+	}
+	if err := writeFileAtomic(localFile, output.Body, modTime, mode); err != nil {
+		return fmt.Errorf("could not write restored file: %w", err)
+	}
+	return nil
+}
+
+// uploadMetadata returns the user metadata recording a local file's
+// modification time and permissions.
+func uploadMetadata(info os.FileInfo) map[string]string {
+	return map[string]string{
+		mtimeMetadata: info.ModTime().UTC().Format(time.RFC3339Nano),
+		modeMetadata:  strconv.FormatUint(uint64(info.Mode().Perm()), 8),
+	}
+}
+
+// fileAttributes returns the modification time and permissions recorded in
+// an object's metadata, defaulting to a zero time and mode 0644.
+func fileAttributes(metadata map[string]string) (time.Time, os.FileMode) {
+	modTime, _ := time.Parse(time.RFC3339Nano, metadata[mtimeMetadata])
+	mode := os.FileMode(0644)
+	if perm, err := strconv.ParseUint(metadata[modeMetadata], 8, 32); err == nil {
+		mode = os.FileMode(perm) & os.ModePerm
+	}
+	return modTime, mode
+}
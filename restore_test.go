@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRestorer creates a restorer for s3://test-bucket/test-prefix into an
+// empty directory.
+func newTestRestorer(t *testing.T, options restoreOptions) (*restorer, *MockS3Uploader, string) {
+	t.Helper()
+	app, mockUploader, _ := newTestApp(t, false, true)
+	app.localPath = filepath.Join(t.TempDir(), "restored")
+	if options.Tier == "" {
+		options.Tier = types.TierStandard
+	}
+	if options.Days == 0 {
+		options.Days = 1
+	}
+	if options.PollInterval == 0 {
+		options.PollInterval = 5 * time.Millisecond
+	}
+	return &restorer{app: app, options: options}, mockUploader, app.localPath
+}
+
+// putVersion adds a version to the mock's version history.
+func putVersion(m *MockS3Uploader, key, versionID, body string, modified time.Time) {
+	m.Versions = append(m.Versions, types.ObjectVersion{
+		Key:          aws.String(key),
+		VersionId:    aws.String(versionID),
+		Size:         aws.Int64(int64(len(body))),
+		LastModified: aws.Time(modified),
+	})
+	m.VersionBodies[versionID] = body
+}
+
+// archive moves a stored object to a storage class that must be restored
+// before it can be read.
+func (m *MockS3Uploader) archive(key string, storageClass types.ObjectStorageClass) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, obj := range m.Objects {
+		if *obj.Key == key {
+			m.Objects[i].StorageClass = storageClass
+		}
+	}
+	m.Archived[key] = true
+}
+
+// restoreAll lists and restores every object.
+func restoreAll(t *testing.T, r *restorer) RestoreSummary {
+	t.Helper()
+	objects, err := r.list(context.Background())
+	require.NoError(t, err)
+	return r.run(context.Background(), objects)
+}
+
+func TestRestorer(t *testing.T) {
+	t.Run("Files are restored with their mtime and mode", func(t *testing.T) {
+		r, mockUploader, dest := newTestRestorer(t, restoreOptions{})
+		source := filepath.Join(t.TempDir(), "secret.txt")
+		require.NoError(t, os.WriteFile(source, []byte("secret"), 0600))
+		mtime := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+		require.NoError(t, os.Chtimes(source, mtime, mtime))
+		require.NoError(t, uploadNow(t, r.app.workerPool, source, "test-prefix/dir/secret.txt").Err)
+		putRemote(t, mockUploader, "test-prefix/other.txt", "uploaded elsewhere")
+
+		summary := restoreAll(t, r)
+		assert.Equal(t, RestoreSummary{Restored: 2}, summary)
+
+		restored := filepath.Join(dest, "dir", "secret.txt")
+		assert.Equal(t, "secret", readLocal(t, restored))
+		info, err := os.Stat(restored)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		assert.True(t, mtime.Equal(info.ModTime()), "mtime %s should be %s", info.ModTime(), mtime)
+
+		info, err = os.Stat(filepath.Join(dest, "other.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "Objects without metadata get a default mode")
+	})
+
+	t.Run("Newer local files are kept unless forced", func(t *testing.T) {
+		r, mockUploader, dest := newTestRestorer(t, restoreOptions{})
+		putRemote(t, mockUploader, "test-prefix/a.txt", "remote")
+		writeLocal(t, filepath.Join(dest, "a.txt"), "local") // Modified in the future
+
+		assert.Equal(t, RestoreSummary{Skipped: 1}, restoreAll(t, r))
+		assert.Equal(t, "local", readLocal(t, filepath.Join(dest, "a.txt")))
+
+		r = &restorer{app: r.app, options: r.options}
+		r.options.Force = true
+		assert.Equal(t, RestoreSummary{Restored: 1}, restoreAll(t, r))
+		assert.Equal(t, "remote", readLocal(t, filepath.Join(dest, "a.txt")))
+	})
+
+	t.Run("Versions current at --as-of are restored", func(t *testing.T) {
+		asOf := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+		r, mockUploader, dest := newTestRestorer(t, restoreOptions{AsOf: asOf})
+		putVersion(mockUploader, "test-prefix/a.txt", "a1", "old", asOf.Add(-2*time.Hour))
+		putVersion(mockUploader, "test-prefix/a.txt", "a2", "then", asOf.Add(-time.Hour))
+		putVersion(mockUploader, "test-prefix/a.txt", "a3", "later", asOf.Add(time.Hour))
+		putVersion(mockUploader, "test-prefix/deleted.txt", "d1", "gone", asOf.Add(-2*time.Hour))
+		mockUploader.DeleteMarkers = append(mockUploader.DeleteMarkers, types.DeleteMarkerEntry{
+			Key: aws.String("test-prefix/deleted.txt"), VersionId: aws.String("d2"), LastModified: aws.Time(asOf.Add(-time.Hour)),
+		})
+		putVersion(mockUploader, "test-prefix/new.txt", "n1", "new", asOf.Add(time.Hour))
+
+		assert.Equal(t, RestoreSummary{Restored: 1}, restoreAll(t, r))
+		assert.Equal(t, "then", readLocal(t, filepath.Join(dest, "a.txt")))
+		assert.NoFileExists(t, filepath.Join(dest, "deleted.txt"))
+		assert.NoFileExists(t, filepath.Join(dest, "new.txt"))
+	})
+
+	t.Run("Glacier objects are restored before they are downloaded", func(t *testing.T) {
+		r, mockUploader, dest := newTestRestorer(t, restoreOptions{Tier: types.TierBulk, Days: 3})
+		putRemote(t, mockUploader, "test-prefix/cold.txt", "cold")
+		mockUploader.archive("test-prefix/cold.txt", types.ObjectStorageClassGlacier)
+		putRemote(t, mockUploader, "test-prefix/tiered.txt", "tiered")
+		mockUploader.archive("test-prefix/tiered.txt", types.ObjectStorageClassIntelligentTiering)
+
+		assert.Equal(t, RestoreSummary{Restored: 2, Archived: 2}, restoreAll(t, r))
+		assert.Equal(t, "cold", readLocal(t, filepath.Join(dest, "cold.txt")))
+		assert.Equal(t, "tiered", readLocal(t, filepath.Join(dest, "tiered.txt")))
+
+		request := mockUploader.Restores["test-prefix/cold.txt"].RestoreRequest
+		assert.Equal(t, types.TierBulk, request.GlacierJobParameters.Tier)
+		assert.Equal(t, int32(3), aws.ToInt32(request.Days))
+		assert.Nil(t, mockUploader.Restores["test-prefix/tiered.txt"].RestoreRequest.Days, "Intelligent-Tiering restores take no days")
+	})
+
+	t.Run("Restores already in progress are waited for", func(t *testing.T) {
+		r, mockUploader, _ := newTestRestorer(t, restoreOptions{})
+		putRemote(t, mockUploader, "test-prefix/cold.txt", "cold")
+		mockUploader.archive("test-prefix/cold.txt", types.ObjectStorageClassDeepArchive)
+		mockUploader.Restores["test-prefix/cold.txt"] = nil
+
+		assert.Equal(t, RestoreSummary{Restored: 1, Archived: 1}, restoreAll(t, r))
+	})
+
+	t.Run("A version chosen with --version-id is restored", func(t *testing.T) {
+		modified := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+		r, mockUploader, dest := newTestRestorer(t, restoreOptions{VersionID: "v1"})
+		r.app.keyPrefix = "test-prefix/report.csv"
+		putVersion(mockUploader, "test-prefix/report.csv", "v1", "old", modified)
+		putVersion(mockUploader, "test-prefix/report.csv", "v2", "new", modified.Add(time.Hour))
+
+		assert.Equal(t, RestoreSummary{Restored: 1}, restoreAll(t, r))
+		assert.Equal(t, "old", readLocal(t, dest))
+
+		r = &restorer{app: r.app, options: r.options}
+		r.options.VersionID = "v3"
+		_, err := r.list(context.Background())
+		assert.ErrorContains(t, err, "could not find version v3")
+	})
+
+	t.Run("A single object is restored as a file", func(t *testing.T) {
+		r, mockUploader, dest := newTestRestorer(t, restoreOptions{})
+		r.app.keyPrefix = "test-prefix/report.csv"
+		putRemote(t, mockUploader, "test-prefix/report.csv", "1,2")
+		require.NoError(t, os.MkdirAll(dest, 0755))
+
+		assert.Equal(t, RestoreSummary{Restored: 1}, restoreAll(t, r))
+		assert.Equal(t, "1,2", readLocal(t, filepath.Join(dest, "report.csv")), "Objects are restored into existing directories")
+	})
+}
+
+func TestFileAttributes(t *testing.T) {
+	info, err := os.Stat(t.TempDir())
+	require.NoError(t, err)
+	modTime, mode := fileAttributes(uploadMetadata(info))
+	assert.True(t, info.ModTime().Equal(modTime))
+	assert.Equal(t, info.Mode().Perm(), mode)
+
+	modTime, mode = fileAttributes(map[string]string{modeMetadata: "banana"})
+	assert.True(t, modTime.IsZero())
+	assert.Equal(t, os.FileMode(0644), mode)
+}
+
+func TestCheckRestoreOptions(t *testing.T) {
+	valid := restoreOptions{Tier: types.TierStandard, Days: 1, PollInterval: time.Minute}
+
+	options := valid
+	require.NoError(t, checkRestoreOptions(&options, "2026-10-16T10:00:00Z"))
+	assert.Equal(t, time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC), options.AsOf)
+
+	testCases := []struct {
+		modify func(*restoreOptions)
+		asOf   string
+		err    string
+	}{
+		{asOf: "yesterday", err: "invalid --as-of time"},
+		{modify: func(o *restoreOptions) { o.VersionID = "v1" }, asOf: "2026-10-16T10:00:00Z", err: "cannot be combined"},
+		{modify: func(o *restoreOptions) { o.Tier = "Fast" }, err: "invalid Glacier tier"},
+		{modify: func(o *restoreOptions) { o.Days = 0 }, err: "invalid Glacier days"},
+		{modify: func(o *restoreOptions) { o.PollInterval = 0 }, err: "invalid Glacier poll interval"},
+	}
+	for _, tc := range testCases {
+		options := valid
+		if tc.modify != nil {
+			tc.modify(&options)
+		}
+		assert.ErrorContains(t, checkRestoreOptions(&options, tc.asOf), tc.err)
+	}
+}
+
+func TestRunRestore_usage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"s3://bucket/key"},
+		{"--glacier-tier", "Fast", "s3://bucket/key", "local/path"},
+		{"--as-of", "yesterday", "s3://bucket/key", "local/path"},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 2, runRestore(context.Background(), args, &stdout, &stderr), "%v", args)
+		assert.Empty(t, stdout.String())
+	}
+}
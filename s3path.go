@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// bucketName matches the characters and length of bucket names.
+	bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	// accessPointName matches the names of access points.
+	accessPointName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,48}[a-z0-9]$`)
+	// mrapAlias matches the aliases of multi-Region access points.
+	mrapAlias = regexp.MustCompile(`^[a-z0-9]+\.mrap$`)
+	// outpostID matches the IDs of Outposts.
+	outpostID = regexp.MustCompile(`^op-[a-z0-9]+$`)
+	// awsRegion matches region names such as us-east-1.
+	awsRegion = regexp.MustCompile(`^[a-z]{2}(?:-[a-z]+)+-\d+$`)
+	// awsAccount matches account IDs.
+	awsAccount = regexp.MustCompile(`^\d{12}$`)
+	// awsPartition matches partitions such as aws, aws-cn and aws-us-gov.
+	awsPartition = regexp.MustCompile(`^aws(?:-[a-z]+)*$`)
+
+	// accessPointHost matches the host names of access points and Object
+	// Lambda access points, which are made of the access point's name and
+	// account ID.
+	accessPointHost = regexp.MustCompile(`^(.+)-(\d{12})\.(s3-accesspoint|s3-object-lambda)(?:\.dualstack)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+	// s3Host matches the host names of S3 endpoints, preceded by the bucket
+	// name for virtual-hosted style URLs.
+	s3Host = regexp.MustCompile(`^(?:(.+)\.)?s3(?:[.-][a-z0-9-]+)*\.amazonaws\.com(?:\.cn)?$`)
+)
+
+// reservedBucketPrefixes are the prefixes S3 does not allow bucket names to
+// start with.
+var reservedBucketPrefixes = []string{"xn--", "sthree-", "amzn-s3-demo-"}
+
+// parseS3Path parses the location of the objects to mirror into a bucket and
+// a key prefix. The location may be:
+//
+//   - an S3 URI, s3://bucket/prefix, where the bucket may also be an access
+//     point alias or any of the ARNs below
+//   - an access point, Object Lambda access point, multi-Region access point
+//     or Outposts access point ARN, followed by /prefix
+//   - a virtual-hosted style URL, https://bucket.s3.region.amazonaws.com/prefix
+//   - a path-style URL, https://s3.region.amazonaws.com/bucket/prefix
+//   - an access point URL, https://name-account.s3-accesspoint.region.amazonaws.com/prefix
+//
+// ARNs are returned as the bucket, which the SDK routes to the access point.
+// Repeated trailing slashes are reduced to one, so that s3://bucket/work// is
+// the same as s3://bucket/work/.
+func parseS3Path(s3Path string) (bucket, keyPrefix string, err error) {
+	switch {
+	case strings.HasPrefix(s3Path, "s3://arn:"):
+		bucket, keyPrefix, err = parseS3ARN(strings.TrimPrefix(s3Path, "s3://"))
+	case strings.HasPrefix(s3Path, "arn:"):
+		bucket, keyPrefix, err = parseS3ARN(s3Path)
+	case strings.HasPrefix(s3Path, "s3://"):
+		bucket, keyPrefix, _ = strings.Cut(strings.TrimPrefix(s3Path, "s3://"), "/")
+		if bucket == "" {
+			return "", "", errors.New("invalid S3 path format: missing bucket name")
+		}
+		err = checkBucketName(bucket)
+	case strings.HasPrefix(s3Path, "https://"):
+		bucket, keyPrefix, err = parseS3URL(s3Path)
+	default:
+		return "", "", errors.New("S3 path must be an s3:// URI, an S3 ARN or an https:// URL")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if trimmed := strings.TrimRight(keyPrefix, "/"); trimmed == "" {
+		keyPrefix = ""
+	} else if trimmed != keyPrefix {
+		keyPrefix = trimmed + "/"
+	}
+	return bucket, keyPrefix, nil
+}
+
+// checkBucketName validates a bucket name, or an access point alias used as
+// one, against S3's naming rules.
+func checkBucketName(bucket string) error {
+	if mrapAlias.MatchString(bucket) {
+		return fmt.Errorf("invalid bucket name %s: multi-Region access points must be given as their ARN, arn:aws:s3::ACCOUNT:accesspoint/%s", bucket, bucket)
+	}
+	if !bucketName.MatchString(bucket) {
+		return fmt.Errorf("invalid bucket name %s: must be 3 to 63 lowercase letters, numbers, dots and hyphens, starting and ending with a letter or number", bucket)
+	}
+	if strings.Contains(bucket, "..") {
+		return fmt.Errorf("invalid bucket name %s: must not contain two adjacent dots", bucket)
+	}
+	if net.ParseIP(bucket) != nil {
+		return fmt.Errorf("invalid bucket name %s: must not be formatted as an IP address", bucket)
+	}
+	for _, prefix := range reservedBucketPrefixes {
+		if strings.HasPrefix(bucket, prefix) {
+			return fmt.Errorf("invalid bucket name %s: must not start with %s", bucket, prefix)
+		}
+	}
+	return nil
+}
+
+// parseS3ARN parses an access point ARN followed by an optional /prefix. The
+// ARN is returned as the bucket.
+func parseS3ARN(s string) (bucket, keyPrefix string, err error) {
+	fields := strings.SplitN(s, ":", 6)
+	if len(fields) != 6 || fields[0] != "arn" {
+		return "", "", fmt.Errorf("invalid ARN %s: must be arn:PARTITION:SERVICE:REGION:ACCOUNT:RESOURCE", s)
+	}
+	partition, service, region, account, resource := fields[1], fields[2], fields[3], fields[4], fields[5]
+	if !awsPartition.MatchString(partition) {
+		return "", "", fmt.Errorf("invalid ARN %s: unknown partition %q", s, partition)
+	}
+	if !awsAccount.MatchString(account) {
+		return "", "", fmt.Errorf("invalid ARN %s: account ID must be 12 digits", s)
+	}
+	if region != "" && !awsRegion.MatchString(region) {
+		return "", "", fmt.Errorf("invalid ARN %s: invalid region %q", s, region)
+	}
+
+	// Resources are separated from their type by a slash or a colon, and
+	// followed by the key prefix after a slash.
+	next := func(rest string) (string, string) {
+		if i := strings.IndexAny(rest, "/:"); i >= 0 {
+			return rest[:i], rest[i+1:]
+		}
+		return rest, ""
+	}
+	kind, rest := next(resource)
+	switch service {
+	case "s3", "s3-object-lambda":
+	case "s3-outposts":
+		if kind != "outpost" {
+			return "", "", fmt.Errorf("invalid ARN %s: Outposts resources must be outpost/ID/accesspoint/NAME", s)
+		}
+		var id string
+		id, rest = next(rest)
+		if !outpostID.MatchString(id) {
+			return "", "", fmt.Errorf("invalid ARN %s: invalid Outpost ID %q", s, id)
+		}
+		kind, rest = next(rest)
+	default:
+		return "", "", fmt.Errorf("invalid ARN %s: service must be s3, s3-object-lambda or s3-outposts", s)
+	}
+	if kind != "accesspoint" {
+		return "", "", fmt.Errorf("invalid ARN %s: resource must be an access point", s)
+	}
+	name, keyPrefix, _ := strings.Cut(rest, "/")
+
+	switch {
+	case service == "s3" && region == "":
+		if !mrapAlias.MatchString(name) {
+			return "", "", fmt.Errorf("invalid ARN %s: multi-Region access point alias %q must end with .mrap", s, name)
+		}
+	case region == "":
+		return "", "", fmt.Errorf("invalid ARN %s: missing region", s)
+	case !accessPointName.MatchString(name):
+		return "", "", fmt.Errorf("invalid ARN %s: access point name %q must be 3 to 50 lowercase letters, numbers and hyphens", s, name)
+	}
+	return s[:len(s)-len(rest)+len(name)], keyPrefix, nil
+}
+
+// parseS3URL parses an HTTPS URL of an object or prefix on an S3 endpoint.
+func parseS3URL(s string) (bucket, keyPrefix string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid S3 URL %s: %w", s, err)
+	}
+	host := strings.ToLower(u.Hostname())
+	keyPrefix = strings.TrimPrefix(u.Path, "/")
+
+	if m := accessPointHost.FindStringSubmatch(host); m != nil {
+		name, account, service, region := m[1], m[2], m[3], m[4]
+		partition := "aws"
+		switch {
+		case m[5] != "":
+			partition = "aws-cn"
+		case strings.HasPrefix(region, "us-gov-"):
+			partition = "aws-us-gov"
+		}
+		if service == "s3-accesspoint" {
+			service = "s3"
+		}
+		return parseS3ARN(fmt.Sprintf("arn:%s:%s:%s:%s:accesspoint/%s/%s", partition, service, region, account, name, keyPrefix))
+	}
+	if strings.Contains(host, ".s3-global.") {
+		return "", "", fmt.Errorf("invalid S3 URL %s: multi-Region access points must be given as their ARN", s)
+	}
+	m := s3Host.FindStringSubmatch(host)
+	if m == nil {
+		return "", "", fmt.Errorf("invalid S3 URL %s: not an S3 endpoint", s)
+	}
+	bucket = m[1]
+	if bucket == "" {
+		// Path-style URLs start with the bucket.
+		bucket, keyPrefix, _ = strings.Cut(keyPrefix, "/")
+		if bucket == "" {
+			return "", "", fmt.Errorf("invalid S3 URL %s: missing bucket name", s)
+		}
+	}
+	return bucket, keyPrefix, checkBucketName(bucket)
+}
+
+// fileKey returns the key a single file is mirrored to: the key prefix, or
+// the file's name below it if the prefix is empty or ends with a slash, like
+// copying a file into a directory.
+func fileKey(keyPrefix, localPath string) string {
+	if keyPrefix == "" || strings.HasSuffix(keyPrefix, "/") {
+		return keyPrefix + filepath.Base(localPath)
+	}
+	return keyPrefix
+}
+
+// arnRegion returns the region of a bucket given as an ARN, or "" for bucket
+// names and multi-Region access points.
+func arnRegion(bucket string) string {
+	if fields := strings.SplitN(bucket, ":", 6); len(fields) == 6 && fields[0] == "arn" {
+		return fields[3]
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3Path_Locations(t *testing.T) {
+	const (
+		accessPoint  = "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap"
+		objectLambda = "arn:aws:s3-object-lambda:us-west-2:123456789012:accesspoint/my-olap"
+		outposts     = "arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap"
+		mrap         = "arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap"
+	)
+	testCases := []struct {
+		path         string
+		expectBucket string
+		expectKey    string
+	}{
+		{"s3://my-bucket/work", "my-bucket", "work"},
+		{"s3://my-bucket/work/", "my-bucket", "work/"},
+		{"s3://my-bucket/work//", "my-bucket", "work/"},
+		{"s3://my-bucket//", "my-bucket", ""},
+		{"s3://my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias/work", "my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias", "work"},
+		{accessPoint, accessPoint, ""},
+		{accessPoint + "/work/2026-10-16T10:00:00Z.csv", accessPoint, "work/2026-10-16T10:00:00Z.csv"},
+		{"s3://" + accessPoint + "/work", accessPoint, "work"},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint:my-ap/work", "arn:aws:s3:us-west-2:123456789012:accesspoint:my-ap", "work"},
+		{objectLambda + "/work", objectLambda, "work"},
+		{outposts + "/work", outposts, "work"},
+		{mrap + "/work", mrap, "work"},
+		{"https://my.bucket.s3.us-west-2.amazonaws.com/work/a%20b.csv", "my.bucket", "work/a b.csv"},
+		{"https://my-bucket.s3.amazonaws.com/work", "my-bucket", "work"},
+		{"https://my-bucket.s3-us-west-2.amazonaws.com/", "my-bucket", ""},
+		{"https://a.s3-b.s3.dualstack.cn-north-1.amazonaws.com.cn/work", "a.s3-b", "work"},
+		{"https://s3.us-west-2.amazonaws.com/my-bucket/work/", "my-bucket", "work/"},
+		{"https://s3.amazonaws.com/my-bucket", "my-bucket", ""},
+		{"https://my-ap-123456789012.s3-accesspoint.us-west-2.amazonaws.com/work", accessPoint, "work"},
+		{"https://my-olap-123456789012.s3-object-lambda.us-west-2.amazonaws.com/work", objectLambda, "work"},
+		{"https://my-ap-123456789012.s3-accesspoint.us-gov-west-1.amazonaws.com/", "arn:aws-us-gov:s3:us-gov-west-1:123456789012:accesspoint/my-ap", ""},
+	}
+	for _, tc := range testCases {
+		bucket, key, err := parseS3Path(tc.path)
+		require.NoError(t, err, tc.path)
+		assert.Equal(t, tc.expectBucket, bucket, tc.path)
+		assert.Equal(t, tc.expectKey, key, tc.path)
+	}
+
+	for path, msg := range map[string]string{
+		"s3://My-Bucket/work":                                                 "lowercase letters",
+		"s3://ab/work":                                                        "3 to 63",
+		"s3://my..bucket":                                                     "two adjacent dots",
+		"s3://192.168.1.1/work":                                               "IP address",
+		"s3://xn--bucket":                                                     "must not start with xn--",
+		"s3://mfzwi23gnjvgw.mrap/work":                                        "must be given as their ARN",
+		"arn:aws:s3:us-west-2:1234:accesspoint/my-ap":                         "12 digits",
+		"arn:aws:s3:us-west-2:123456789012:bucket/b":                          "must be an access point",
+		"arn:aws:s3-object-lambda::123456789012:accesspoint/my-olap":          "missing region",
+		"arn:aws:s3::123456789012:accesspoint/my-ap":                          "must end with .mrap",
+		"arn:aws:s3:us-west-2:123456789012:accesspoint/My_AP":                 "access point name",
+		"arn:aws:s3-outposts:us-west-2:123456789012:accesspoint/my-ap":        "outpost/ID/accesspoint/NAME",
+		"arn:aws:sqs:us-west-2:123456789012:queue":                            "service must be",
+		"https://example.com/my-bucket/work":                                  "not an S3 endpoint",
+		"https://s3.amazonaws.com/":                                           "missing bucket name",
+		"https://mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com/work": "must be given as their ARN",
+		"ftp://my-bucket/work":                                                "must be an s3:// URI",
+	} {
+		_, _, err := parseS3Path(path)
+		assert.ErrorContains(t, err, msg, path)
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "report.csv")
+	assert.Equal(t, "reports/daily.csv", fileKey("reports/daily.csv", localPath))
+	assert.Equal(t, "reports/report.csv", fileKey("reports/", localPath), "Files go below prefixes ending with a slash")
+	assert.Equal(t, "report.csv", fileKey("", localPath))
+}
+
+func TestApp_s3KeyFor_trailingSlash(t *testing.T) {
+	for _, s3Path := range []string{"s3://my-bucket/work", "s3://my-bucket/work/", "s3://my-bucket/work//"} {
+		_, keyPrefix, err := parseS3Path(s3Path)
+		require.NoError(t, err)
+		app, _, tmpDir := newTestApp(t, false, true)
+		app.keyPrefix = keyPrefix
+
+		key, err := app.s3KeyFor(filepath.Join(tmpDir, "a", "b.csv"))
+		require.NoError(t, err)
+		assert.Equal(t, "work/a/b.csv", key, s3Path)
+		back, err := app.localPathFor(key)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(tmpDir, "a", "b.csv"), back, s3Path)
+	}
+}
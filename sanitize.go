@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxKeyBytes is the longest object key S3 accepts, in bytes of UTF-8.
+const maxKeyBytes = 1024
+
+// defaultUnsafeKeyChars are the characters S3 recommends avoiding in keys.
+const defaultUnsafeKeyChars = "\\{}^%`[]\"<>~#|"
+
+// SanitizeConfig configures the sanitisation of keys.
+type SanitizeConfig struct {
+	Enabled     bool
+	Unsafe      string // Characters replaced in keys, besides control characters
+	Replacement string // What unsafe characters and invalid UTF-8 are replaced with
+}
+
+// checkSanitize validates the sanitisation configuration.
+func checkSanitize(config SanitizeConfig) error {
+	if strings.ContainsAny(config.Replacement, config.Unsafe+"/") || strings.IndexFunc(config.Replacement, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid key replacement %q: must not contain unsafe characters or slashes", config.Replacement)
+	}
+	return nil
+}
+
+// sanitize returns key in Unicode normalisation form C, with invalid UTF-8,
+// control characters and unsafe characters replaced. Keys longer than
+// maxBytes are shortened and given a hash of the original key, so that they
+// stay unique.
+func (c SanitizeConfig) sanitize(key string, maxBytes int) string {
+	var b strings.Builder
+	for _, r := range norm.NFC.String(strings.ToValidUTF8(key, c.Replacement)) {
+		if unicode.IsControl(r) || strings.ContainsRune(c.Unsafe, r) {
+			b.WriteString(c.Replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	sanitized := b.String()
+	if len(sanitized) <= maxBytes {
+		return sanitized
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	suffix := "-" + hex.EncodeToString(sum[:8])
+	if ext := path.Ext(sanitized); len(ext) <= 16 {
+		suffix += ext
+	}
+	cut := max(maxBytes-len(suffix), 0)
+	for cut > 0 && !utf8.RuneStart(sanitized[cut]) {
+		cut--
+	}
+	return sanitized[:cut] + suffix
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeConfig_sanitize(t *testing.T) {
+	config := SanitizeConfig{Enabled: true, Unsafe: defaultUnsafeKeyChars, Replacement: "_"}
+
+	testCases := []struct {
+		key  string
+		want string
+	}{
+		{"plain/file.txt", "plain/file.txt"},
+		{"cafe\u0301/r\u00e9sum\u00e9.txt", "caf\u00e9/r\u00e9sum\u00e9.txt"},
+		{`a\b{1}|c.txt`, "a_b_1__c.txt"},
+		{"tab\there\x7f.txt", "tab_here_.txt"},
+		{"bad\xffutf8.txt", "bad_utf8.txt"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, config.sanitize(tc.key, maxKeyBytes), "%q", tc.key)
+	}
+
+	t.Run("Long keys are shortened with a hash", func(t *testing.T) {
+		long := strings.Repeat("é", 600) + ".csv"
+		key := config.sanitize(long, 1000)
+		assert.LessOrEqual(t, len(key), 1000)
+		assert.True(t, utf8.ValidString(key))
+		assert.True(t, strings.HasSuffix(key, ".csv"))
+		assert.NotEqual(t, key, config.sanitize(strings.Repeat("é", 601)+".csv", 1000), "Shortened keys stay unique")
+		assert.Equal(t, key, config.sanitize(long, 1000))
+	})
+}
+
+func TestCheckSanitize(t *testing.T) {
+	assert.NoError(t, checkSanitize(SanitizeConfig{Unsafe: defaultUnsafeKeyChars, Replacement: "_"}))
+	assert.NoError(t, checkSanitize(SanitizeConfig{Unsafe: defaultUnsafeKeyChars, Replacement: ""}))
+	for _, replacement := range []string{"#", "/", "\n"} {
+		assert.Error(t, checkSanitize(SanitizeConfig{Unsafe: defaultUnsafeKeyChars, Replacement: replacement}), "%q", replacement)
+	}
+}
+
+func TestApp_sanitizeKeys(t *testing.T) {
+	app, mockUploader, tmpDir := newTestApp(t, false, true)
+	require.NoError(t, app.mapKeys(KeyConfig{Sanitize: SanitizeConfig{Enabled: true, Unsafe: defaultUnsafeKeyChars, Replacement: "_"}}))
+	app.workerPool.RecordPaths(tmpDir)
+
+	localFile := filepath.Join(tmpDir, "Re\u0301sume\u0301s", "draft #2.txt") // NFD, as on macOS
+	writeLocal(t, localFile, "cv")
+	s3Key, err := app.s3KeyFor(localFile)
+	require.NoError(t, err)
+	assert.Equal(t, "test-prefix/R\u00e9sum\u00e9s/draft _2.txt", s3Key)
+	require.NoError(t, uploadNow(t, app.workerPool, localFile, s3Key).Err)
+	assert.Equal(t, "Re%CC%81sume%CC%81s/draft%20%232.txt", mockUploader.Uploads[s3Key].Metadata[pathMetadata])
+
+	longFile := filepath.Join(tmpDir, strings.Repeat("x", 250), strings.Repeat("y", 250), strings.Repeat("z", 250), strings.Repeat("w", 250), strings.Repeat("v", 250)+".log")
+	longKey, err := app.s3KeyFor(longFile)
+	require.NoError(t, err)
+	assert.Len(t, longKey, maxKeyBytes)
+	assert.True(t, strings.HasPrefix(longKey, "test-prefix/xxx"))
+
+	r, _, dest := newTestRestorer(t, restoreOptions{})
+	r.app.uploader = mockUploader
+	r.app.keys = app.keys
+	assert.Equal(t, RestoreSummary{Restored: 1}, restoreAll(t, r))
+	assert.Equal(t, "cv", readLocal(t, filepath.Join(dest, "Re\u0301sume\u0301s", "draft #2.txt")), "Original names are restored")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveMux serves mux on addr. The listener is opened before returning so that
+// address errors are reported immediately, and the returned server's Addr
+// holds the address actually bound.
+func serveMux(addr string, mux *http.ServeMux) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", addr, err)
+	}
+
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "addr", server.Addr, "error", err)
+		}
+	}()
+	return server, nil
+}
+
+// startHTTP starts the metrics and health endpoints on their configured
+// addresses and returns the servers started. When both use the same address
+// they share a single server.
+func (a *App) startHTTP(metricsAddr, healthAddr string) ([]*http.Server, error) {
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if metricsAddr != "" {
+		muxFor(metricsAddr).Handle("/metrics", a.enableMetrics())
+	}
+	if healthAddr != "" {
+		a.health = a.newHealth()
+		a.health.register(muxFor(healthAddr))
+	}
+
+	var servers []*http.Server
+	for addr, mux := range muxes {
+		server, err := serveMux(addr, mux)
+		if err != nil {
+			for _, started := range servers {
+				_ = started.Close()
+			}
+			return nil, err
+		}
+		slog.Info("Serving HTTP endpoints", "addr", server.Addr,
+			"metrics", addr == metricsAddr, "health", addr == healthAddr)
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// SyncSummary reports the outcome of a one-shot sync.
+type SyncSummary struct {
+	Uploaded   int64
+	Deleted    int64
+	Downloaded int64
+	Unchanged  int64
+	Failed     int64
+}
+
+// remotePrefix returns the key prefix that holds every object mirrored from
+// the watched path.
+func (a *App) remotePrefix() string {
+	if !a.isDir || a.keyPrefix == "" || strings.HasSuffix(a.keyPrefix, "/") {
+		return a.keyPrefix
+	}
+	return a.keyPrefix + "/"
+}
+
+// listRemote returns the objects stored under the mirrored prefix, keyed by
+// object key.
+func (a *App) listRemote(ctx context.Context) (map[string]types.Object, error) {
+	objects := make(map[string]types.Object)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(a.remotePrefix()),
+	}
+
+	for {
+		output, err := a.uploader.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("could not list s3://%s/%s: %w", a.bucket, a.remotePrefix(), err)
+		}
+		for _, obj := range output.Contents {
+			key := aws.ToString(obj.Key)
+			// In single file mode only the exact key belongs to us.
+			if !a.isDir && key != a.keyPrefix {
+				continue
+			}
+			// Skip "folder" placeholder objects created by the S3 console.
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			objects[key] = obj
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			return objects, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// listLocal returns the regular files under the watched path, keyed by the S3
+// key they map to.
+func (a *App) listLocal() (map[string]os.FileInfo, map[string]string, error) {
+	infos := make(map[string]os.FileInfo)
+	paths := make(map[string]string)
+
+	err := filepath.Walk(a.localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		s3Key, err := a.s3KeyFor(path)
+		if err != nil {
+			return err
+		}
+		infos[s3Key] = info
+		paths[s3Key] = path
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error scanning %s: %w", a.localPath, err)
+	}
+	return infos, paths, nil
+}
+
+// needsUpload reports whether a local file differs from its remote copy.
+func needsUpload(info os.FileInfo, obj types.Object, exists bool) bool {
+	if !exists {
+		return true
+	}
+	if aws.ToInt64(obj.Size) != info.Size() {
+		return true
+	}
+	return obj.LastModified == nil || info.ModTime().After(*obj.LastModified)
+}
+
+// syncOnce mirrors the local path to S3 a single time using the worker pool,
+// then shuts the pool down. An error is returned if any operation failed.
+func (a *App) syncOnce(ctx context.Context) (SyncSummary, error) {
+	var summary SyncSummary
+	defer a.workerPool.Shutdown()
+
+	slog.Info("Syncing to S3", "path", a.localPath, "bucket", a.bucket, "key", a.keyPrefix)
+
+	remote, err := a.listRemote(ctx)
+	if err != nil {
+		return summary, err
+	}
+	a.workerPool.RememberObjects(remote)
+	locals, paths, err := a.listLocal()
+	if err != nil {
+		return summary, err
+	}
+
+	for s3Key, info := range locals {
+		obj, exists := remote[s3Key]
+		if needsUpload(info, obj, exists) {
+			a.workerPool.QueueUpload(paths[s3Key], s3Key)
+		} else {
+			summary.Unchanged++
+		}
+	}
+
+	if a.delete {
+		for s3Key := range remote {
+			if _, exists := locals[s3Key]; !exists {
+				a.workerPool.QueueDelete(s3Key)
+			}
+		}
+	}
+
+	// Wait for every queued job before reporting.
+	a.workerPool.Shutdown()
+
+	stats := a.workerPool.Stats()
+	summary.Uploaded = stats.Uploaded
+	summary.Deleted = stats.Deleted
+	summary.Failed = stats.Failed
+
+	slog.Info("Sync complete", "uploaded", summary.Uploaded, "deleted", summary.Deleted,
+		"unchanged", summary.Unchanged, "failed", summary.Failed)
+
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d operation(s) failed", summary.Failed)
+	}
+	return summary, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApp_syncOnce(t *testing.T) {
+	t.Run("Uploads new and changed files and skips unchanged ones", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "sub"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "new.txt"), []byte("new"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "sub", "changed.txt"), []byte("changed"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "same.txt"), []byte("same"), 0644))
+
+		future := time.Now().Add(time.Hour)
+		mockUploader.Objects = []types.Object{
+			{Key: aws.String("test-prefix/sub/changed.txt"), Size: aws.Int64(1), LastModified: aws.Time(future)},
+			{Key: aws.String("test-prefix/same.txt"), Size: aws.Int64(4), LastModified: aws.Time(future)},
+		}
+
+		summary, err := app.syncOnce(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, SyncSummary{Uploaded: 2, Unchanged: 1}, summary)
+		assert.Contains(t, mockUploader.Uploads, "test-prefix/new.txt")
+		assert.Contains(t, mockUploader.Uploads, "test-prefix/sub/changed.txt")
+		assert.NotContains(t, mockUploader.Uploads, "test-prefix/same.txt")
+	})
+
+	t.Run("Deletes remote objects missing locally only with the delete flag", func(t *testing.T) {
+		for _, deleteFlag := range []bool{false, true} {
+			app, mockUploader, _ := newTestApp(t, deleteFlag, true)
+			mockUploader.Objects = []types.Object{
+				{Key: aws.String("test-prefix/gone.txt"), Size: aws.Int64(1), LastModified: aws.Time(time.Now())},
+				{Key: aws.String("test-prefix/folder/"), Size: aws.Int64(0), LastModified: aws.Time(time.Now())},
+			}
+
+			summary, err := app.syncOnce(context.Background())
+			require.NoError(t, err)
+
+			if deleteFlag {
+				assert.Equal(t, int64(1), summary.Deleted)
+				assert.Contains(t, mockUploader.Deletes, "test-prefix/gone.txt")
+				assert.NotContains(t, mockUploader.Deletes, "test-prefix/folder/")
+			} else {
+				assert.Empty(t, mockUploader.Deletes)
+			}
+		}
+	})
+
+	t.Run("Single file uses the key prefix as the key", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, true, false)
+		app.localPath = filepath.Join(tmpDir, "report.csv")
+		require.NoError(t, os.WriteFile(app.localPath, []byte("a,b"), 0644))
+		mockUploader.Objects = []types.Object{
+			{Key: aws.String("test-prefix-other"), Size: aws.Int64(1), LastModified: aws.Time(time.Now())},
+		}
+
+		summary, err := app.syncOnce(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(1), summary.Uploaded)
+		assert.Contains(t, mockUploader.Uploads, "test-prefix")
+		assert.Empty(t, mockUploader.Deletes, "Objects sharing the prefix must not be deleted")
+	})
+
+	t.Run("Returns an error when an operation fails", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		mockUploader.UploadErr = errors.New("S3 is down")
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("x"), 0644))
+
+		summary, err := app.syncOnce(context.Background())
+		require.Error(t, err)
+		assert.Equal(t, int64(1), summary.Failed)
+	})
+
+	t.Run("Returns an error when listing fails", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		mockUploader.ListErr = errors.New("access denied")
+
+		_, err := app.syncOnce(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not list")
+	})
+}
+
+func TestApp_remotePrefix(t *testing.T) {
+	testCases := []struct {
+		name      string
+		isDir     bool
+		keyPrefix string
+		expect    string
+	}{
+		{"Directory without trailing slash", true, "work", "work/"},
+		{"Directory with trailing slash", true, "work/", "work/"},
+		{"Directory at bucket root", true, "", ""},
+		{"Single file", false, "report.csv", "report.csv"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &App{isDir: tc.isDir, keyPrefix: tc.keyPrefix}
+			assert.Equal(t, tc.expect, app.remotePrefix())
+		})
+	}
+}
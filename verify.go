@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Drift statuses reported by verify.
+const (
+	driftMissing = "missing" // The local file has no object
+	driftExtra   = "extra"   // The object has no local file
+	driftDiffers = "differs" // Both exist with a different size or checksum
+)
+
+// crc64NVME is the CRC-64/NVME table S3 uses for its default checksums.
+var crc64NVME = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+const verifyUsage = `Usage: echos3 verify [flags] /path/to/watch s3://bucket/key
+
+Compares the local path with S3 using the key mapping of watch mode, and
+reports files missing from S3, objects without a local file and files whose
+size or checksum differs. Exits with status 1 if anything differs.
+
+Flags:
+`
+
+// VerifyReport is the outcome of comparing the local path with S3.
+type VerifyReport struct {
+	LocalPath string  `json:"local_path"`
+	Bucket    string  `json:"bucket"`
+	Prefix    string  `json:"prefix"`
+	Matched   int     `json:"matched"`   // Files whose object has the same content
+	SizeOnly  int     `json:"size_only"` // Matched files compared by size only, for lack of a usable checksum
+	Drift     []Drift `json:"drift"`
+}
+
+// Drift describes a file that differs between the local path and S3.
+type Drift struct {
+	Status    string `json:"status"`
+	Key       string `json:"key"`
+	LocalPath string `json:"local_path,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+// objectChecksum is a checksum of an object and how to compute the same
+// checksum of a local file.
+type objectChecksum struct {
+	name   string
+	value  string
+	hash   func() hash.Hash
+	encode func([]byte) string
+}
+
+// runVerify implements the verify subcommand. It returns the process exit
+// status: 0 if both sides match, 1 if they differ and 2 if they could not be
+// compared.
+func runVerify(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	jsonOutput := flags.Bool("json", false, "Print the report as JSON.")
+	concurrency := flags.Int("concurrency", getDefaultConcurrency(), "Maximum number of files to compare at once.")
+	var completeWhen stringListFlag
+	flags.Var(&completeWhen, "complete-when", "Completion rule of the watch, so that markers that are not uploaded are not reported. Can be repeated.")
+	parseKeys := keyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, verifyUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 || *concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	keys, err := parseKeys()
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 verify: %v\n", err)
+		return 2
+	}
+	app, err := newVerifyApp(ctx, flags.Arg(0), flags.Arg(1), completeWhen, keys, *concurrency)
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 verify: %v\n", err)
+		return 2
+	}
+	report, err := app.verify(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 verify: %v\n", err)
+		return 2
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		err = printVerifyReport(stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "echos3 verify: %v\n", err)
+		return 2
+	}
+	if len(report.Drift) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// newVerifyApp creates an App that maps local files to keys like a watch of
+// the same paths with the given completion rules and key mapping would.
+func newVerifyApp(ctx context.Context, localPathArg, s3Path string, completeWhen []string, keys KeyConfig, concurrency int) (*App, error) {
+	var rules []CompletionRule
+	for _, value := range completeWhen {
+		rule, err := parseCompletionRule(value)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	localPath, pathInfo, err := setupLocalPath(localPathArg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local path: %w", err)
+	}
+	bucket, keyPrefix, err := parseS3Path(s3Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 path: %w", err)
+	}
+	if !pathInfo.IsDir() {
+		keyPrefix = fileKey(keyPrefix, localPath)
+	}
+	s3Client, err := newS3Client(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	app := &App{
+		uploader:      s3Client,
+		localPath:     localPath,
+		isDir:         pathInfo.IsDir(),
+		bucket:        bucket,
+		keyPrefix:     keyPrefix,
+		maxConcurrent: concurrency,
+	}
+	if keys.enabled() {
+		if err := app.mapKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+	if len(rules) > 0 {
+		root := localPath
+		if !app.isDir {
+			root = filepath.Dir(localPath)
+		}
+		// Only used to recognise markers, so nothing is ever queued.
+		app.completion = &completionWaiter{config: CompletionConfig{Rules: rules}, root: root}
+	}
+	return app, nil
+}
+
+// verify compares the local path with the objects under the mirrored prefix.
+// Files whose sizes match are compared by checksum, concurrently.
+func (a *App) verify(ctx context.Context) (VerifyReport, error) {
+	report := VerifyReport{LocalPath: a.localPath, Bucket: a.bucket, Prefix: a.remotePrefix(), Drift: []Drift{}}
+
+	remote, err := a.listRemote(ctx)
+	if err != nil {
+		return report, err
+	}
+	locals, paths, err := a.listLocal()
+	if err != nil {
+		return report, err
+	}
+
+	var both []string
+	for s3Key, info := range locals {
+		if !a.completion.mirrored(paths[s3Key]) {
+			continue
+		}
+		obj, exists := remote[s3Key]
+		switch {
+		case !exists:
+			report.Drift = append(report.Drift, Drift{Status: driftMissing, Key: s3Key, LocalPath: paths[s3Key],
+				Detail: fmt.Sprintf("local %d bytes", info.Size())})
+		case aws.ToInt64(obj.Size) != info.Size():
+			report.Drift = append(report.Drift, Drift{Status: driftDiffers, Key: s3Key, LocalPath: paths[s3Key],
+				Detail: fmt.Sprintf("size: local %d, remote %d", info.Size(), aws.ToInt64(obj.Size))})
+		default:
+			both = append(both, s3Key)
+		}
+	}
+	for s3Key, obj := range remote {
+		if _, exists := locals[s3Key]; exists {
+			continue
+		}
+		localFile, _ := a.localPathFor(s3Key)
+		if localFile != "" && a.completion.isBatchManifest(localFile) {
+			continue
+		}
+		report.Drift = append(report.Drift, Drift{Status: driftExtra, Key: s3Key, LocalPath: localFile,
+			Detail: fmt.Sprintf("remote %d bytes", aws.ToInt64(obj.Size))})
+	}
+
+	details := make([]string, len(both))
+	checked := make([]bool, len(both))
+	errs := make([]error, len(both))
+	sem := make(chan struct{}, max(a.maxConcurrent, 1))
+	var wg sync.WaitGroup
+	for i, s3Key := range both {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			details[i], checked[i], errs[i] = a.compareContent(ctx, paths[s3Key], remote[s3Key])
+		}()
+	}
+	wg.Wait()
+
+	for i, s3Key := range both {
+		switch {
+		case errs[i] != nil:
+			return report, errs[i]
+		case details[i] != "":
+			report.Drift = append(report.Drift, Drift{Status: driftDiffers, Key: s3Key, LocalPath: paths[s3Key], Detail: details[i]})
+		default:
+			report.Matched++
+			if !checked[i] {
+				report.SizeOnly++
+			}
+		}
+	}
+
+	sort.Slice(report.Drift, func(i, j int) bool { return report.Drift[i].Key < report.Drift[j].Key })
+	return report, nil
+}
+
+// compareContent compares a local file with an object of the same size. It
+// returns a description of the difference, if any, and whether the object had
+// a checksum to compare with.
+func (a *App) compareContent(ctx context.Context, localFile string, obj types.Object) (string, bool, error) {
+	checksum, err := a.remoteChecksum(ctx, aws.ToString(obj.Key))
+	if err != nil || checksum == nil {
+		return "", false, err
+	}
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		return "", false, fmt.Errorf("could not open file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+	h := checksum.hash()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", false, fmt.Errorf("could not read %s: %w", localFile, err)
+	}
+
+	local := checksum.encode(h.Sum(nil))
+	if local != checksum.value {
+		return fmt.Sprintf("%s: local %s, remote %s", checksum.name, local, checksum.value), true, nil
+	}
+	return "", true, nil
+}
+
+// remoteChecksum returns the checksum S3 stored for an object, preferring
+// SHA-256, or its ETag when that is the MD5 of its content. It returns nil if
+// the object has neither, as multipart uploads without a full object
+// checksum and objects encrypted with KMS or customer keys do.
+func (a *App) remoteChecksum(ctx context.Context, s3Key string) (*objectChecksum, error) {
+	head, err := a.uploader.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(a.bucket),
+		Key:          aws.String(s3Key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get the checksum of s3://%s/%s: %w", a.bucket, s3Key, err)
+	}
+
+	base64Encode := base64.StdEncoding.EncodeToString
+	for _, checksum := range []objectChecksum{
+		{name: "sha256", value: aws.ToString(head.ChecksumSHA256), hash: sha256.New, encode: base64Encode},
+		{name: "crc64nvme", value: aws.ToString(head.ChecksumCRC64NVME), hash: func() hash.Hash { return crc64.New(crc64NVME) }, encode: base64Encode},
+		{name: "crc32c", value: aws.ToString(head.ChecksumCRC32C), hash: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }, encode: base64Encode},
+		{name: "crc32", value: aws.ToString(head.ChecksumCRC32), hash: func() hash.Hash { return crc32.NewIEEE() }, encode: base64Encode},
+	} {
+		// Checksums of multipart uploads that end in "-<parts>" are
+		// checksums of the part checksums.
+		if checksum.value != "" && !strings.Contains(checksum.value, "-") {
+			return &checksum, nil
+		}
+	}
+
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	plain := head.ServerSideEncryption == "" || head.ServerSideEncryption == types.ServerSideEncryptionAes256
+	if _, err := hex.DecodeString(etag); err == nil && len(etag) == 2*md5.Size && plain && head.SSECustomerAlgorithm == nil {
+		return &objectChecksum{name: "etag", value: etag, hash: md5.New, encode: hex.EncodeToString}, nil
+	}
+	return nil, nil
+}
+
+// printVerifyReport prints a report as a table of the differences.
+func printVerifyReport(w io.Writer, report VerifyReport) error {
+	remote := fmt.Sprintf("s3://%s/%s", report.Bucket, report.Prefix)
+	if len(report.Drift) == 0 {
+		_, err := fmt.Fprintf(w, "%s matches %s: %d file(s), %d compared by size only\n", remote, report.LocalPath, report.Matched, report.SizeOnly)
+		return err
+	}
+
+	counts := make(map[string]int)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tKEY\tDETAIL")
+	for _, drift := range report.Drift {
+		counts[drift.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", drift.Status, drift.Key, drift.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s differs from %s: %d missing, %d extra, %d differing, %d matching (%d compared by size only)\n",
+		remote, report.LocalPath, counts[driftMissing], counts[driftExtra], counts[driftDiffers], report.Matched, report.SizeOnly)
+	return err
+}
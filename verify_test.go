@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setETag replaces the ETag of a stored object.
+func (m *MockS3Uploader) setETag(key, etag string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, obj := range m.Objects {
+		if *obj.Key == key {
+			m.Objects[i].ETag = aws.String(etag)
+		}
+	}
+}
+
+func TestApp_verify(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Matching sides report no drift", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		writeLocal(t, filepath.Join(tmpDir, "a.txt"), "a")
+		writeLocal(t, filepath.Join(tmpDir, "dir", "b.txt"), "b")
+		putRemote(t, mockUploader, "test-prefix/a.txt", "a")
+		putRemote(t, mockUploader, "test-prefix/dir/b.txt", "b")
+
+		report, err := app.verify(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, report.Drift)
+		assert.Equal(t, 2, report.Matched)
+		assert.Equal(t, 0, report.SizeOnly)
+		assert.Equal(t, "test-prefix/", report.Prefix)
+	})
+
+	t.Run("Missing, extra and differing files are reported", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		app.workerPool.EnableChecksums()
+		writeLocal(t, filepath.Join(tmpDir, "missing.txt"), "only here")
+		putRemote(t, mockUploader, "test-prefix/extra.txt", "only there")
+		writeLocal(t, filepath.Join(tmpDir, "size.txt"), "short")
+		putRemote(t, mockUploader, "test-prefix/size.txt", "longer")
+		writeLocal(t, filepath.Join(tmpDir, "etag.txt"), "local")
+		putRemote(t, mockUploader, "test-prefix/etag.txt", "remot")
+
+		checksummed := filepath.Join(tmpDir, "sha.txt")
+		writeLocal(t, checksummed, "before")
+		require.NoError(t, uploadNow(t, app.workerPool, checksummed, "test-prefix/sha.txt").Err)
+		writeLocal(t, checksummed, "after!")
+
+		report, err := app.verify(ctx)
+		require.NoError(t, err)
+		require.Len(t, report.Drift, 5)
+		assert.Equal(t, Drift{Status: driftDiffers, Key: "test-prefix/etag.txt", LocalPath: filepath.Join(tmpDir, "etag.txt"),
+			Detail: "etag: local " + md5Hex("local") + ", remote " + md5Hex("remot")}, report.Drift[0])
+		assert.Equal(t, Drift{Status: driftExtra, Key: "test-prefix/extra.txt", LocalPath: filepath.Join(tmpDir, "extra.txt"),
+			Detail: "remote 10 bytes"}, report.Drift[1])
+		assert.Equal(t, Drift{Status: driftMissing, Key: "test-prefix/missing.txt", LocalPath: filepath.Join(tmpDir, "missing.txt"),
+			Detail: "local 9 bytes"}, report.Drift[2])
+		assert.Equal(t, driftDiffers, report.Drift[3].Status)
+		assert.Contains(t, report.Drift[3].Detail, "sha256: local ", "The SHA-256 stored by S3 is preferred to the ETag")
+		assert.Equal(t, "size: local 5, remote 6", report.Drift[4].Detail)
+		assert.Equal(t, 0, report.Matched)
+	})
+
+	t.Run("Objects without a usable checksum are compared by size", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		writeLocal(t, filepath.Join(tmpDir, "big.bin"), "local")
+		putRemote(t, mockUploader, "test-prefix/big.bin", "parts")
+		mockUploader.setETag("test-prefix/big.bin", `"d41d8cd98f00b204e9800998ecf8427e-2"`)
+
+		report, err := app.verify(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, report.Drift)
+		assert.Equal(t, 1, report.Matched)
+		assert.Equal(t, 1, report.SizeOnly)
+	})
+
+	t.Run("Markers and batch manifests are not drift", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, true)
+		app.completion = &completionWaiter{root: tmpDir, config: CompletionConfig{Rules: []CompletionRule{
+			{Pattern: "exports/**", Strategy: completeBatch, Marker: "_SUCCESS"},
+			{Pattern: "*.csv", Strategy: completeMarker, Marker: ".done"},
+		}}}
+		writeLocal(t, filepath.Join(tmpDir, "a.csv"), "a,b")
+		writeLocal(t, filepath.Join(tmpDir, "a.csv.done"), "")
+		putRemote(t, mockUploader, "test-prefix/a.csv", "a,b")
+		writeLocal(t, filepath.Join(tmpDir, "exports", "part-0"), "0")
+		writeLocal(t, filepath.Join(tmpDir, "exports", "_SUCCESS"), "")
+		putRemote(t, mockUploader, "test-prefix/exports/part-0", "0")
+		putRemote(t, mockUploader, "test-prefix/exports/_manifest.json", "{}")
+
+		report, err := app.verify(ctx)
+		require.NoError(t, err)
+		require.Len(t, report.Drift, 1, "Batch markers are uploaded")
+		assert.Equal(t, Drift{Status: driftMissing, Key: "test-prefix/exports/_SUCCESS", LocalPath: filepath.Join(tmpDir, "exports", "_SUCCESS"),
+			Detail: "local 0 bytes"}, report.Drift[0])
+		assert.Equal(t, 2, report.Matched)
+	})
+
+	t.Run("A single file is compared with its key only", func(t *testing.T) {
+		app, mockUploader, tmpDir := newTestApp(t, false, false)
+		app.localPath = filepath.Join(tmpDir, "report.csv")
+		app.keyPrefix = "reports/latest.csv"
+		writeLocal(t, app.localPath, "1,2")
+		putRemote(t, mockUploader, "reports/latest.csv", "1,2")
+		putRemote(t, mockUploader, "reports/latest.csv.bak", "1")
+
+		report, err := app.verify(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, report.Drift)
+		assert.Equal(t, 1, report.Matched)
+	})
+
+	t.Run("Listing errors are returned", func(t *testing.T) {
+		app, mockUploader, _ := newTestApp(t, false, true)
+		mockUploader.ListErr = assert.AnError
+
+		_, err := app.verify(ctx)
+		assert.ErrorIs(t, err, assert.AnError)
+	})
+}
+
+// md5Hex returns the hex encoded MD5 of a body, as used in plain ETags.
+func md5Hex(body string) string {
+	sum := md5.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPrintVerifyReport(t *testing.T) {
+	var out bytes.Buffer
+	report := VerifyReport{LocalPath: "/data", Bucket: "bucket", Prefix: "backup/", Matched: 3, SizeOnly: 1}
+	require.NoError(t, printVerifyReport(&out, report))
+	assert.Equal(t, "s3://bucket/backup/ matches /data: 3 file(s), 1 compared by size only\n", out.String())
+
+	out.Reset()
+	report.Drift = []Drift{
+		{Status: driftMissing, Key: "backup/a", Detail: "local 1 bytes"},
+		{Status: driftExtra, Key: "backup/bb", Detail: "remote 2 bytes"},
+	}
+	require.NoError(t, printVerifyReport(&out, report))
+	assert.Equal(t, "STATUS   KEY        DETAIL\n"+
+		"missing  backup/a   local 1 bytes\n"+
+		"extra    backup/bb  remote 2 bytes\n"+
+		"s3://bucket/backup/ differs from /data: 1 missing, 1 extra, 0 differing, 3 matching (1 compared by size only)\n", out.String())
+
+	var decoded VerifyReport
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, report, decoded)
+}
+
+func TestRunVerify_usage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"local/path"},
+		{"--concurrency", "0", "local/path", "s3://bucket/key"},
+		{"--no-such-flag", "local/path", "s3://bucket/key"},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 2, runVerify(context.Background(), args, &stdout, &stderr), "%v", args)
+		assert.Empty(t, stdout.String())
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := runVerify(context.Background(), []string{"--complete-when", "*=eventually", t.TempDir(), "s3://bucket/key"}, &stdout, &stderr)
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr.String(), "unknown strategy")
+}
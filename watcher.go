@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher backends.
+const (
+	watcherAuto     = "auto"
+	watcherFsnotify = "fsnotify"
+	watcherPoll     = "poll"
+	watcherFanotify = "fanotify"
+)
+
+// Defaults of the polling watcher.
+const (
+	defaultWatchInterval    = 5 * time.Second
+	defaultWatchParallelism = 4
+)
+
+// WatcherConfig configures how the watched path is watched for changes.
+type WatcherConfig struct {
+	Backend     string        // auto, fsnotify, poll or fanotify; auto if empty
+	Interval    time.Duration // Time between scans of the polling watcher
+	Parallelism int           // Directories the polling watcher scans at once
+}
+
+// directoryWatcher watches directories for changes to their entries.
+type directoryWatcher interface {
+	Add(dir string) error
+}
+
+// fileWatcher reports changes to the entries of the directories added to it
+// as fsnotify events, whatever its backend.
+type fileWatcher interface {
+	directoryWatcher
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// treeWatcher is a fileWatcher that can watch a whole tree at once, without
+// adding each directory in it.
+type treeWatcher interface {
+	fileWatcher
+	AddTree(root string) error
+}
+
+// newFileWatcher creates the watcher configured for localPath. The auto
+// backend polls network filesystems, on which fsnotify does not see changes
+// made by other machines, and uses fsnotify everywhere else. The fanotify
+// backend falls back to fsnotify when fanotify is unavailable.
+func newFileWatcher(config WatcherConfig, localPath string) (fileWatcher, error) {
+	backend := config.Backend
+	if backend == "" || backend == watcherAuto {
+		backend = watcherFsnotify
+		if fsType := networkFilesystem(localPath); fsType != "" {
+			slog.Info("Polling for changes on network filesystem", "path", localPath, "filesystem", fsType)
+			backend = watcherPoll
+		}
+	}
+	if backend == watcherFanotify {
+		watcher, err := newFanotifyWatcher(localPath)
+		if err == nil {
+			return watcher, nil
+		}
+		slog.Warn("fanotify is not available, falling back to fsnotify", "error", err)
+		backend = watcherFsnotify
+	}
+	switch backend {
+	case watcherFsnotify:
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		return fsnotifyWatcher{watcher}, nil
+	case watcherPoll:
+		return newPollWatcher(config.Interval, config.Parallelism), nil
+	}
+	return nil, fmt.Errorf("invalid watcher %q: must be auto, fsnotify, poll or fanotify", backend)
+}
+
+// fsnotifyWatcher is the fsnotify backend.
+type fsnotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w fsnotifyWatcher) Events() <-chan fsnotify.Event { return w.Watcher.Events }
+func (w fsnotifyWatcher) Errors() <-chan error          { return w.Watcher.Errors }
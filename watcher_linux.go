@@ -0,0 +1,27 @@
+package main
+
+import "syscall"
+
+// networkFilesystems names the filesystems by the magic number statfs
+// reports for them, on which changes made by other machines are not seen by
+// inotify.
+var networkFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+	0x5346414f: "afs",
+}
+
+// networkFilesystem returns the name of the network filesystem path is on,
+// or "" if it is on a local filesystem or cannot be told.
+func networkFilesystem(path string) string {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	return networkFilesystems[uint32(stat.Type)]
+}
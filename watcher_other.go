@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// networkFilesystem is only implemented on Linux, elsewhere the auto watcher
+// always uses fsnotify.
+func networkFilesystem(string) string {
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+
+	watcher, err := newFileWatcher(WatcherConfig{Backend: watcherFsnotify}, dir)
+	require.NoError(t, err)
+	assert.IsType(t, fsnotifyWatcher{}, watcher)
+	require.NoError(t, watcher.Close())
+
+	watcher, err = newFileWatcher(WatcherConfig{Backend: watcherPoll, Interval: time.Minute, Parallelism: 8}, dir)
+	require.NoError(t, err)
+	require.IsType(t, &pollWatcher{}, watcher)
+	assert.Equal(t, time.Minute, watcher.(*pollWatcher).interval)
+	assert.Equal(t, 8, watcher.(*pollWatcher).parallelism)
+	require.NoError(t, watcher.Close())
+
+	if networkFilesystem(dir) == "" {
+		watcher, err = newFileWatcher(WatcherConfig{}, dir)
+		require.NoError(t, err)
+		assert.IsType(t, fsnotifyWatcher{}, watcher, "Local filesystems use fsnotify")
+		require.NoError(t, watcher.Close())
+	}
+
+	_, err = newFileWatcher(WatcherConfig{Backend: "kqueue"}, dir)
+	assert.ErrorContains(t, err, "invalid watcher")
+}
+
+func TestApp_run_poll(t *testing.T) {
+	app, mockUploader, tmpDir := newTestApp(t, false, true)
+	app.watcher = WatcherConfig{Backend: watcherPoll, Interval: 20 * time.Millisecond}
+	app.health = app.newHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- app.run(ctx) }()
+	defer func() {
+		cancel()
+		assert.True(t, errors.Is(<-done, context.Canceled))
+	}()
+
+	// Wait for the initial scan, after which new files are reported.
+	require.Eventually(t, app.health.started.Load, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "sub", "file.txt"), []byte("content"), 0644))
+	assert.Eventually(t, func() bool {
+		mockUploader.mu.Lock()
+		defer mockUploader.mu.Unlock()
+		return mockUploader.Bodies["test-prefix/sub/file.txt"] == "content"
+	}, 5*time.Second, 10*time.Millisecond, "Files in new directories are uploaded")
+}
+
+func TestParseFlags_Watcher(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	parse := func(args ...string) (*AppConfig, error) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		os.Args = append(append([]string{"echos3"}, args...), "local/path", "s3://bucket/key")
+		_, config, _, err := parseFlags()
+		return config, err
+	}
+
+	config, err := parse()
+	require.NoError(t, err)
+	assert.Equal(t, WatcherConfig{Backend: watcherAuto, Interval: defaultWatchInterval, Parallelism: defaultWatchParallelism}, config.Watcher)
+
+	config, err = parse("--watcher", "poll", "--watch-interval", "30s", "--watch-parallelism", "16")
+	require.NoError(t, err)
+	assert.Equal(t, WatcherConfig{Backend: watcherPoll, Interval: 30 * time.Second, Parallelism: 16}, config.Watcher)
+
+	config, err = parse("--watcher", "fanotify")
+	require.NoError(t, err)
+	assert.Equal(t, watcherFanotify, config.Watcher.Backend)
+
+	for _, args := range [][]string{
+		{"--watcher", "kqueue"},
+		{"--watch-interval", "0s"},
+		{"--watch-parallelism", "0"},
+	} {
+		_, err := parse(args...)
+		assert.Error(t, err, "%v", args)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookBufferSize is the number of events held for a webhook before new
+	// events are dropped, so that a slow endpoint never blocks the workers.
+	webhookBufferSize = 10000
+	// webhookSignatureHeader carries the HMAC-SHA256 of the request body when
+	// a secret is configured.
+	webhookSignatureHeader = "X-Echos3-Signature"
+	// defaultWebhookTimeout is used when no request timeout is configured.
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// WebhookConfig holds the options shared by every webhook sink.
+type WebhookConfig struct {
+	Secret        string        // Key used to sign requests, unsigned if empty
+	BatchSize     int           // Maximum number of events per request
+	BatchInterval time.Duration // Maximum time an event waits for a batch to fill
+	Timeout       time.Duration // Timeout of a single request
+	MaxRetries    int           // Retries after a failed request
+	RetryBackoff  time.Duration // Delay before the first retry, doubled for each retry
+}
+
+// webhookPayload is the body POSTed to a webhook.
+type webhookPayload struct {
+	Events []Event `json:"events"`
+}
+
+// webhookSink is an EventSink that POSTs batches of events as JSON to a URL.
+type webhookSink struct {
+	url    string
+	config WebhookConfig
+	client *http.Client
+
+	events    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWebhookSink creates a webhook sink and starts delivering events.
+func newWebhookSink(url string, config WebhookConfig) *webhookSink {
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	s := &webhookSink{
+		url:    url,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		events: make(chan Event, webhookBufferSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Publish queues an event for delivery, dropping it if the buffer is full.
+func (s *webhookSink) Publish(event Event) {
+	select {
+	case s.events <- event:
+	default:
+		slog.Warn("Webhook buffer is full. Dropping event", "url", s.url, "op", event.Op, "key", event.Key)
+	}
+}
+
+// Close delivers pending events and stops the sink.
+func (s *webhookSink) Close() error {
+	s.closeOnce.Do(func() { close(s.events) })
+	<-s.done
+	return nil
+}
+
+// run batches events until the sink is closed. A batch is sent when it is
+// full or when its oldest event has waited for the batch interval.
+func (s *webhookSink) run() {
+	defer close(s.done)
+
+	var (
+		batch []Event
+		timer <-chan time.Time
+	)
+	flush := func() {
+		if len(batch) > 0 {
+			s.deliver(batch)
+		}
+		batch, timer = nil, nil
+	}
+
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer = time.After(s.config.BatchInterval)
+			}
+			batch = append(batch, event)
+			if len(batch) >= s.config.BatchSize {
+				flush()
+			}
+		case <-timer:
+			flush()
+		}
+	}
+}
+
+// deliver sends a batch, retrying with exponential backoff on network errors,
+// server errors and throttling.
+func (s *webhookSink) deliver(batch []Event) {
+	body, err := json.Marshal(webhookPayload{Events: batch})
+	if err != nil {
+		slog.Error("Could not encode webhook events", "url", s.url, "error", err)
+		return
+	}
+
+	backoff := s.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.send(body)
+		if err == nil {
+			slog.Debug("Delivered webhook events", "url", s.url, "events", len(batch))
+			return
+		}
+		if !retry || attempt >= s.config.MaxRetries {
+			slog.Error("Failed to deliver webhook events", "url", s.url, "events", len(batch), "attempts", attempt+1, "error", err)
+			return
+		}
+		slog.Warn("Webhook delivery failed. Retrying", "url", s.url, "attempt", attempt+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send makes a single request and reports whether a failure may be retried.
+func (s *webhookSink) send(body []byte) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "echos3/"+Version)
+	if s.config.Secret != "" {
+		request.Header.Set(webhookSignatureHeader, signHMAC(s.config.Secret, body))
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected response: %s", response.Status)
+	}
+	return false, fmt.Errorf("unexpected response: %s", response.Status)
+}
+
+// signHMAC returns the signature of body used by webhooks and manifests:
+// "sha256=" followed by the hex encoded HMAC-SHA256 of the body keyed with
+// secret.
+func signHMAC(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
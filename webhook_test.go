@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookRecorder is a webhook endpoint that records the requests it receives
+// and answers with the queued status codes, then with 200.
+type webhookRecorder struct {
+	mu         sync.Mutex
+	payloads   []webhookPayload
+	signatures []string
+	statuses   []int
+	requests   atomic.Int64
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.requests.Add(1)
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var payload webhookPayload
+	_ = json.Unmarshal(body, &payload)
+	r.payloads = append(r.payloads, payload)
+	r.signatures = append(r.signatures, req.Header.Get(webhookSignatureHeader))
+}
+
+func (r *webhookRecorder) events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []Event
+	for _, payload := range r.payloads {
+		events = append(events, payload.Events...)
+	}
+	return events
+}
+
+func newWebhookRecorder(t *testing.T, statuses ...int) (*webhookRecorder, string) {
+	t.Helper()
+	recorder := &webhookRecorder{statuses: statuses}
+	server := httptest.NewServer(recorder)
+	t.Cleanup(server.Close)
+	return recorder, server.URL
+}
+
+var testWebhookConfig = WebhookConfig{
+	BatchSize:     2,
+	BatchInterval: 10 * time.Millisecond,
+	Timeout:       time.Second,
+	MaxRetries:    2,
+	RetryBackoff:  time.Millisecond,
+}
+
+func TestWebhookSink_batching(t *testing.T) {
+	recorder, url := newWebhookRecorder(t)
+	sink := newWebhookSink(url, testWebhookConfig)
+
+	for _, key := range []string{"a", "b", "c"} {
+		sink.Publish(Event{Op: "upload", Key: key})
+	}
+	require.NoError(t, sink.Close())
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	require.Len(t, recorder.payloads, 2, "A full batch and the remainder should be sent separately")
+	assert.Len(t, recorder.payloads[0].Events, 2)
+	assert.Equal(t, "c", recorder.payloads[1].Events[0].Key)
+	assert.Equal(t, "", recorder.signatures[0], "Requests are unsigned without a secret")
+}
+
+func TestWebhookSink_batchInterval(t *testing.T) {
+	recorder, url := newWebhookRecorder(t)
+	sink := newWebhookSink(url, testWebhookConfig)
+	defer func() { _ = sink.Close() }()
+
+	sink.Publish(Event{Op: "upload", Key: "a"})
+	assert.Eventually(t, func() bool { return len(recorder.events()) == 1 }, time.Second, 5*time.Millisecond,
+		"A partial batch should be sent once the interval has passed")
+}
+
+func TestWebhookSink_signing(t *testing.T) {
+	recorder, url := newWebhookRecorder(t)
+	config := testWebhookConfig
+	config.Secret = "s3cret"
+	sink := newWebhookSink(url, config)
+
+	sink.Publish(Event{Op: "upload", Key: "a"})
+	require.NoError(t, sink.Close())
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	body, err := json.Marshal(recorder.payloads[0])
+	require.NoError(t, err)
+	assert.Equal(t, signHMAC("s3cret", body), recorder.signatures[0])
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", recorder.signatures[0])
+}
+
+func TestWebhookSink_retries(t *testing.T) {
+	t.Run("Server errors are retried", func(t *testing.T) {
+		recorder, url := newWebhookRecorder(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+		sink := newWebhookSink(url, testWebhookConfig)
+		sink.Publish(Event{Key: "a"})
+		require.NoError(t, sink.Close())
+
+		assert.Equal(t, int64(3), recorder.requests.Load())
+		assert.Len(t, recorder.events(), 1)
+	})
+
+	t.Run("Retries are limited", func(t *testing.T) {
+		recorder, url := newWebhookRecorder(t, 500, 500, 500, 500)
+		sink := newWebhookSink(url, testWebhookConfig)
+		sink.Publish(Event{Key: "a"})
+		require.NoError(t, sink.Close())
+
+		assert.Equal(t, int64(3), recorder.requests.Load())
+		assert.Empty(t, recorder.events())
+	})
+
+	t.Run("Client errors are not retried", func(t *testing.T) {
+		recorder, url := newWebhookRecorder(t, http.StatusBadRequest)
+		sink := newWebhookSink(url, testWebhookConfig)
+		sink.Publish(Event{Key: "a"})
+		require.NoError(t, sink.Close())
+
+		assert.Equal(t, int64(1), recorder.requests.Load())
+	})
+}
+
+func TestUploadWorkerPool_publishesEvents(t *testing.T) {
+	recorder, url := newWebhookRecorder(t)
+	pool := NewUploadWorkerPool(newMockS3Uploader(), "test-bucket", types.StorageClassStandard, 1)
+	pool.AddEventSink(newWebhookSink(url, testWebhookConfig))
+
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localFile, []byte("12345"), 0644))
+	pool.QueueUpload(localFile, "file.txt")
+	pool.QueueUpload(filepath.Join(t.TempDir(), "missing.txt"), "missing.txt")
+	pool.QueueDelete("old.txt")
+	pool.Shutdown() // Flushes the sink
+
+	events := recorder.events()
+	require.Len(t, events, 3)
+
+	assert.Equal(t, "upload", events[0].Op)
+	assert.Equal(t, eventSuccess, events[0].Status)
+	assert.Equal(t, localFile, events[0].LocalPath)
+	assert.Equal(t, "test-bucket", events[0].Bucket)
+	assert.Equal(t, "file.txt", events[0].Key)
+	assert.NotEmpty(t, events[0].ETag)
+	assert.Equal(t, int64(5), events[0].Size)
+
+	assert.Equal(t, eventFailure, events[1].Status)
+	assert.Contains(t, events[1].Error, "could not open file")
+
+	assert.Equal(t, "delete", events[2].Op)
+	assert.Equal(t, eventSuccess, events[2].Status)
+}